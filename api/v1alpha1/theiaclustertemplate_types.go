@@ -0,0 +1,59 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TheiaClusterTemplateSpec defines the constraints enforced on the Theia
+// referencing the template
+type TheiaClusterTemplateSpec struct {
+	// AllowedImages are the images the Theia containers may use. An entry
+	// ending with "*" allows every image starting with the entry. Every image
+	// is allowed when empty.
+	// +optional
+	AllowedImages []string `json:"allowedImages,omitempty"`
+	// MaxResources caps the requests and limits of each Theia container.
+	// +optional
+	MaxResources corev1.ResourceList `json:"maxResources,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// TheiaClusterTemplate is the Schema for the theiaclustertemplates API
+type TheiaClusterTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TheiaClusterTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TheiaClusterTemplateList contains a list of TheiaClusterTemplate
+type TheiaClusterTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TheiaClusterTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TheiaClusterTemplate{}, &TheiaClusterTemplateList{})
+}
@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,6 +31,198 @@ type TheiaSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	Template TheiaTemplateSpec `json:"template,omitempty"`
+	// Stopped scales the Theia down to zero when true, independently of the
+	// culler. The Theia is started again when set back to false.
+	// +optional
+	Stopped bool `json:"stopped,omitempty"`
+	// Credentials configures a Secret with a generated workspace token which is
+	// mounted into the Theia container.
+	// +optional
+	Credentials *CredentialsSpec `json:"credentials,omitempty"`
+	// GitRepo is cloned into the workspace when the Theia first starts.
+	// +optional
+	GitRepo *GitRepoSpec `json:"gitRepo,omitempty"`
+	// ClusterTemplate is the name of the TheiaClusterTemplate whose
+	// constraints the Theia has to satisfy.
+	// +optional
+	ClusterTemplate string `json:"clusterTemplate,omitempty"`
+	// NetworkBandwidth limits the traffic of the Theia pod with the CNI
+	// bandwidth plugin.
+	// +optional
+	NetworkBandwidth *NetworkBandwidthSpec `json:"networkBandwidth,omitempty"`
+	// CullingPolicy overrides the culling defaults of the controller for the Theia.
+	// +optional
+	CullingPolicy *CullingPolicySpec `json:"cullingPolicy,omitempty"`
+	// GatewayTimeout overrides the timeout and idle timeout of the route of
+	// the Theia at the Istio gateway, e.g. for long lived websockets.
+	// +optional
+	GatewayTimeout *metav1.Duration `json:"gatewayTimeout,omitempty"`
+	// PublishNotReadyAddresses makes the services of the Theia resolve before
+	// its pod is ready. Defaults to the PUBLISH_NOT_READY_ADDRESSES of the
+	// controller.
+	// +optional
+	PublishNotReadyAddresses *bool `json:"publishNotReadyAddresses,omitempty"`
+	// ImagePullSecrets are added to the pod of the Theia to pull its images
+	// from private registries. Defaults to the DEFAULT_IMAGE_PULL_SECRETS of
+	// the controller.
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Volume configures the workspace volume of the Theia container.
+	// +optional
+	Volume *VolumeSpec `json:"volume,omitempty"`
+	// Probes configures the readiness and liveness probes added to the Theia
+	// container when it doesn't define any. Setting it adds the probes even
+	// when the ADD_READINESS_PROBE and ADD_LIVENESS_PROBE of the controller
+	// aren't enabled.
+	// +optional
+	Probes *ProbesSpec `json:"probes,omitempty"`
+	// NodeSelector is merged into the node selector of the pod template, and
+	// wins over it. Defaults to the DEFAULT_NODE_SELECTOR of the controller.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations are added to the tolerations of the pod template, replacing
+	// those of the same key and effect. Defaults to the DEFAULT_TOLERATIONS of
+	// the controller.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity replaces the affinity of the pod template. Defaults to the
+	// DEFAULT_AFFINITY of the controller.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// Routing configures the route of the Theia in the Istio VirtualService.
+	// +optional
+	Routing *RoutingSpec `json:"routing,omitempty"`
+	// ServiceLabels are added to the labels of the Theia copied to its Service,
+	// e.g. for cost allocation.
+	// +optional
+	ServiceLabels map[string]string `json:"serviceLabels,omitempty"`
+	// ServiceAnnotations are added to the annotations of the Theia copied to
+	// its Service, e.g. for the load balancer of the cloud provider.
+	// +optional
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+	// StatefulSetLabels are set on the StatefulSet of the Theia.
+	// +optional
+	StatefulSetLabels map[string]string `json:"statefulSetLabels,omitempty"`
+	// StatefulSetAnnotations are set on the StatefulSet of the Theia.
+	// +optional
+	StatefulSetAnnotations map[string]string `json:"statefulSetAnnotations,omitempty"`
+	// Replicas is the number of pods of the Theia while it isn't stopped, for
+	// headless backends serving several replicas behind the Service. Defaults
+	// to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// FSGroup is the fsGroup of the pod of the Theia, unless its pod template
+	// sets one in its security context. Defaults to 100 when the ADD_FSGROUP of
+	// the controller isn't disabled.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	FSGroup *int64 `json:"fsGroup,omitempty"`
+	// EnvFrom are appended to the EnvFrom of the Theia container, to inject
+	// the variables of ConfigMaps and Secrets.
+	// +optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// ServiceType is the type of the Service of the Theia, to reach it from
+	// outside the cluster without Istio. Possible values are
+	// ClusterIP|NodePort|LoadBalancer. Defaults to ClusterIP.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
+	// LoadBalancerSourceRanges are the CIDRs allowed to reach the Service of
+	// the Theia when its ServiceType is LoadBalancer.
+	// +optional
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+	// NodePort fixes the node port of the Theia port of the Service when its
+	// ServiceType is NodePort or LoadBalancer. Allocated by the cluster when
+	// unset.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	NodePort *int32 `json:"nodePort,omitempty"`
+}
+
+// RoutingSpec defines the route of the Theia
+type RoutingSpec struct {
+	// Timeout of the requests to the Theia as a Go duration, e.g. 1h. Zero
+	// disables the timeout. Defaults to 300s.
+	// +optional
+	Timeout string `json:"timeout,omitempty"`
+	// Gateway is the Istio gateway of the route in the namespace/name form.
+	// Defaults to the ISTIO_GATEWAY of the controller.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// ProbesSpec defines the default probes of the Theia container
+type ProbesSpec struct {
+	// Disabled prevents the probes from being added.
+	// +optional
+	Disabled bool `json:"disabled,omitempty"`
+	// Path is the HTTP path probed, for images serving Theia on another path
+	// than the root. Defaults to the READINESS_PROBE_PATH of the controller.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// VolumeSpec defines the name and the location of the workspace volume
+type VolumeSpec struct {
+	// Name of the workspace volume and of the volume claim template. Defaults
+	// to "theia".
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +optional
+	Name string `json:"name,omitempty"`
+	// MountPath is where the workspace is mounted in the Theia container.
+	// Defaults to /home/project.
+	// +optional
+	MountPath string `json:"mountPath,omitempty"`
+	// ExistingClaim is the name of an existing PVC mounted as workspace
+	// instead of the PVC of the volume claim template, e.g. a ReadWriteMany
+	// PVC shared by several Theia. The PVC isn't deleted with the Theia.
+	// +optional
+	ExistingClaim string `json:"existingClaim,omitempty"`
+}
+
+// CullingPolicySpec defines how the Theia is culled when idle
+type CullingPolicySpec struct {
+	// IdleTimeMinutes is how long the Theia may be idle before it is culled.
+	// Defaults to the IDLE_TIME of the controller, and 0 disables the culling.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	IdleTimeMinutes *int32 `json:"idleTimeMinutes,omitempty"`
+}
+
+// NetworkBandwidthSpec defines the bandwidth limits of the Theia pod in bits
+// per second, e.g. 10M
+type NetworkBandwidthSpec struct {
+	// Ingress is the limit of the traffic to the pod.
+	// +optional
+	Ingress *resource.Quantity `json:"ingress,omitempty"`
+	// Egress is the limit of the traffic from the pod.
+	// +optional
+	Egress *resource.Quantity `json:"egress,omitempty"`
+}
+
+// GitRepoSpec defines a git repository cloned into the workspace
+type GitRepoSpec struct {
+	// URL of the git repository
+	URL string `json:"url"`
+	// Ref is the branch, tag or commit checked out after cloning. Defaults to
+	// the default branch of the repository.
+	// +optional
+	Ref string `json:"ref,omitempty"`
+	// Path relative to the workspace the repository is cloned into. Defaults to
+	// the name of the repository.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// CredentialsSpec defines the generated workspace credentials of the Theia
+type CredentialsSpec struct {
+	// RotationPeriodMinutes is the period after which the token is regenerated.
+	// The token is never rotated when unset.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	RotationPeriodMinutes int32 `json:"rotationPeriodMinutes,omitempty"`
 }
 
 // TheiaTemplateSpec defines the pod spec for the Theia
@@ -37,6 +230,40 @@ type TheiaTemplateSpec struct {
 	metav1.ObjectMeta                `json:"metadata,omitempty"`
 	corev1.PersistentVolumeClaimSpec `json:"pvc,omitempty"`
 	Spec                             corev1.PodSpec `json:"spec,omitempty"`
+	// SeccompProfile is the seccomp profile applied to the Theia container.
+	// +optional
+	SeccompProfile *SeccompProfile `json:"seccompProfile,omitempty"`
+	// PreStopTimeoutSeconds is how long the preStop hooks of the containers
+	// may take. The termination grace period of the pod is extended to cover it.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	PreStopTimeoutSeconds *int64 `json:"preStopTimeoutSeconds,omitempty"`
+	// ProcMount is the type of proc mount of the Theia container. Possible
+	// values are Default|Unmasked
+	// +kubebuilder:validation:Enum=Default;Unmasked
+	// +optional
+	ProcMount *corev1.ProcMountType `json:"procMount,omitempty"`
+	// Architecture of the nodes the Theia runs on, e.g. arm64, which selects
+	// the default image built for it. Defaults to the DEFAULT_ARCHITECTURE of
+	// the controller.
+	// +optional
+	Architecture string `json:"architecture,omitempty"`
+	// VolumeDevices are added to the Theia container. A pvc of volumeMode
+	// Block is attached to the Theia container as the volume device of the
+	// workspace volume name, instead of being mounted.
+	// +optional
+	VolumeDevices []corev1.VolumeDevice `json:"volumeDevices,omitempty"`
+}
+
+// SeccompProfile defines the seccomp profile applied to the Theia container
+type SeccompProfile struct {
+	// Type is the kind of seccomp profile. Possible values are RuntimeDefault|Localhost|Unconfined
+	// +kubebuilder:validation:Enum=RuntimeDefault;Localhost;Unconfined
+	Type string `json:"type"`
+	// LocalhostProfile is the path of the profile on the node, relative to the
+	// kubelet seccomp profile location. Required when Type is Localhost.
+	// +optional
+	LocalhostProfile string `json:"localhostProfile,omitempty"`
 }
 
 // TheiaStatus defines the observed state of Theia
@@ -49,11 +276,91 @@ type TheiaStatus struct {
 	ReadyReplicas int32 `json:"readyReplicas"`
 	// ContainerState is the state of underlying container.
 	ContainerState corev1.ContainerState `json:"containerState"`
+	// Phase is a high-level summary of the state of the Theia.
+	// +kubebuilder:validation:Enum=Provisioning;Running;Stopped;Error;Terminating
+	// +optional
+	Phase TheiaPhase `json:"phase,omitempty"`
+	// VolumeName is the name of the PVC bound to the Theia workspace.
+	// +optional
+	VolumeName string `json:"volumeName,omitempty"`
+	// VolumeCapacity is the storage capacity of the bound PVC.
+	// +optional
+	VolumeCapacity string `json:"volumeCapacity,omitempty"`
+	// URL is where the Theia is served: the path prefix of its route at the
+	// Istio gateway or the Ingress, or the in-cluster URL of its service
+	// without either.
+	// +optional
+	URL string `json:"url,omitempty"`
+	// AssignedAt is when the Theia was assigned to its user, i.e. got its user
+	// label. The Theia isn't culled for being idle before it was assigned.
+	// +optional
+	AssignedAt *metav1.Time `json:"assignedAt,omitempty"`
+	// Migration is the state of the latest migration of the workspace to
+	// another storage class.
+	// +optional
+	Migration *StorageMigrationStatus `json:"migration,omitempty"`
+	// ArchiveLocation is where the workspace of the Theia is archived before
+	// it is deleted for being culled longer than the retention time.
+	// +optional
+	ArchiveLocation string `json:"archiveLocation,omitempty"`
+	// Warnings are the messages of the warnings currently reported for the
+	// Theia, by event reason. Their event is only emitted when they start or
+	// their message changes.
+	// +optional
+	Warnings map[string]string `json:"warnings,omitempty"`
 }
 
+// StorageMigrationStatus defines the observed state of a workspace migration
+type StorageMigrationStatus struct {
+	// StorageClass is the storage class the workspace is migrated to.
+	StorageClass string `json:"storageClass"`
+	// Phase is the state of the migration. Possible values are Pending|Copying|Succeeded|Failed
+	Phase StorageMigrationPhase `json:"phase"`
+	// SourceClaim is the name of the PVC the workspace is copied from.
+	SourceClaim string `json:"sourceClaim"`
+	// TargetClaim is the name of the PVC the workspace is copied to.
+	TargetClaim string `json:"targetClaim"`
+	// Message regarding the state of the migration.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// StorageMigrationPhase is the state of a workspace migration
+type StorageMigrationPhase string
+
+// These are the valid phases of a workspace migration
+const (
+	// MigrationPending means the Theia is being stopped before the copy
+	MigrationPending StorageMigrationPhase = "Pending"
+	// MigrationCopying means the job copying the workspace is running
+	MigrationCopying StorageMigrationPhase = "Copying"
+	// MigrationSucceeded means the Theia uses the copied workspace
+	MigrationSucceeded StorageMigrationPhase = "Succeeded"
+	// MigrationFailed means the copy failed and the Theia keeps its workspace
+	MigrationFailed StorageMigrationPhase = "Failed"
+)
+
+// TheiaPhase is a high-level summary of the state of the Theia
+type TheiaPhase string
+
+// These are the valid phases of a Theia
+const (
+	// TheiaProvisioning means the Theia has been accepted but isn't ready yet
+	TheiaProvisioning TheiaPhase = "Provisioning"
+	// TheiaRunning means the Theia has a ready pod
+	TheiaRunning TheiaPhase = "Running"
+	// TheiaStopped means the Theia has been stopped by the user or the culler
+	TheiaStopped TheiaPhase = "Stopped"
+	// TheiaError means the Theia container is failing to start or has
+	// terminated, or the Theia has been rejected
+	TheiaError TheiaPhase = "Error"
+	// TheiaTerminating means the Theia is being deleted
+	TheiaTerminating TheiaPhase = "Terminating"
+)
+
 // TheiaCondition defines the conditions of Theia status
 type TheiaCondition struct {
-	// Type is the type of the condition. Possible values are Running|Waiting|Terminated
+	// Type is the type of the condition. Possible values are Running|Waiting|Terminated|Stopped|Failed|QuotaExceeded
 	Type string `json:"type"`
 	// Last time we probed the condition.
 	// +optional
@@ -67,6 +374,10 @@ type TheiaCondition struct {
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Ready",type="integer",JSONPath=".status.readyReplicas"
+// +kubebuilder:printcolumn:name="URL",type="string",JSONPath=".status.url",priority=1
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // Theia is the Schema for the theia API
 type Theia struct {
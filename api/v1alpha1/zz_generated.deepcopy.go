@@ -21,9 +21,146 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialsSpec) DeepCopyInto(out *CredentialsSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialsSpec.
+func (in *CredentialsSpec) DeepCopy() *CredentialsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CullingPolicySpec) DeepCopyInto(out *CullingPolicySpec) {
+	*out = *in
+	if in.IdleTimeMinutes != nil {
+		in, out := &in.IdleTimeMinutes, &out.IdleTimeMinutes
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CullingPolicySpec.
+func (in *CullingPolicySpec) DeepCopy() *CullingPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CullingPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitRepoSpec) DeepCopyInto(out *GitRepoSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitRepoSpec.
+func (in *GitRepoSpec) DeepCopy() *GitRepoSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GitRepoSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkBandwidthSpec) DeepCopyInto(out *NetworkBandwidthSpec) {
+	*out = *in
+	if in.Ingress != nil {
+		in, out := &in.Ingress, &out.Ingress
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Egress != nil {
+		in, out := &in.Egress, &out.Egress
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NetworkBandwidthSpec.
+func (in *NetworkBandwidthSpec) DeepCopy() *NetworkBandwidthSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkBandwidthSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProbesSpec) DeepCopyInto(out *ProbesSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProbesSpec.
+func (in *ProbesSpec) DeepCopy() *ProbesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProbesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RoutingSpec) DeepCopyInto(out *RoutingSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RoutingSpec.
+func (in *RoutingSpec) DeepCopy() *RoutingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RoutingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SeccompProfile) DeepCopyInto(out *SeccompProfile) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SeccompProfile.
+func (in *SeccompProfile) DeepCopy() *SeccompProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(SeccompProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageMigrationStatus) DeepCopyInto(out *StorageMigrationStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageMigrationStatus.
+func (in *StorageMigrationStatus) DeepCopy() *StorageMigrationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageMigrationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Theia) DeepCopyInto(out *Theia) {
 	*out = *in
@@ -51,6 +188,91 @@ func (in *Theia) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TheiaClusterTemplate) DeepCopyInto(out *TheiaClusterTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TheiaClusterTemplate.
+func (in *TheiaClusterTemplate) DeepCopy() *TheiaClusterTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(TheiaClusterTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TheiaClusterTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TheiaClusterTemplateList) DeepCopyInto(out *TheiaClusterTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TheiaClusterTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TheiaClusterTemplateList.
+func (in *TheiaClusterTemplateList) DeepCopy() *TheiaClusterTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(TheiaClusterTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TheiaClusterTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TheiaClusterTemplateSpec) DeepCopyInto(out *TheiaClusterTemplateSpec) {
+	*out = *in
+	if in.AllowedImages != nil {
+		in, out := &in.AllowedImages, &out.AllowedImages
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MaxResources != nil {
+		in, out := &in.MaxResources, &out.MaxResources
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TheiaClusterTemplateSpec.
+func (in *TheiaClusterTemplateSpec) DeepCopy() *TheiaClusterTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TheiaClusterTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TheiaCondition) DeepCopyInto(out *TheiaCondition) {
 	*out = *in
@@ -103,6 +325,130 @@ func (in *TheiaList) DeepCopyObject() runtime.Object {
 func (in *TheiaSpec) DeepCopyInto(out *TheiaSpec) {
 	*out = *in
 	in.Template.DeepCopyInto(&out.Template)
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(CredentialsSpec)
+		**out = **in
+	}
+	if in.GitRepo != nil {
+		in, out := &in.GitRepo, &out.GitRepo
+		*out = new(GitRepoSpec)
+		**out = **in
+	}
+	if in.NetworkBandwidth != nil {
+		in, out := &in.NetworkBandwidth, &out.NetworkBandwidth
+		*out = new(NetworkBandwidthSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CullingPolicy != nil {
+		in, out := &in.CullingPolicy, &out.CullingPolicy
+		*out = new(CullingPolicySpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GatewayTimeout != nil {
+		in, out := &in.GatewayTimeout, &out.GatewayTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.PublishNotReadyAddresses != nil {
+		in, out := &in.PublishNotReadyAddresses, &out.PublishNotReadyAddresses
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]v1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.Volume != nil {
+		in, out := &in.Volume, &out.Volume
+		*out = new(VolumeSpec)
+		**out = **in
+	}
+	if in.Probes != nil {
+		in, out := &in.Probes, &out.Probes
+		*out = new(ProbesSpec)
+		**out = **in
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]v1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(v1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Routing != nil {
+		in, out := &in.Routing, &out.Routing
+		*out = new(RoutingSpec)
+		**out = **in
+	}
+	if in.ServiceLabels != nil {
+		in, out := &in.ServiceLabels, &out.ServiceLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ServiceAnnotations != nil {
+		in, out := &in.ServiceAnnotations, &out.ServiceAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.StatefulSetLabels != nil {
+		in, out := &in.StatefulSetLabels, &out.StatefulSetLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.StatefulSetAnnotations != nil {
+		in, out := &in.StatefulSetAnnotations, &out.StatefulSetAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.FSGroup != nil {
+		in, out := &in.FSGroup, &out.FSGroup
+		*out = new(int64)
+		**out = **in
+	}
+	if in.EnvFrom != nil {
+		in, out := &in.EnvFrom, &out.EnvFrom
+		*out = make([]v1.EnvFromSource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LoadBalancerSourceRanges != nil {
+		in, out := &in.LoadBalancerSourceRanges, &out.LoadBalancerSourceRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NodePort != nil {
+		in, out := &in.NodePort, &out.NodePort
+		*out = new(int32)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TheiaSpec.
@@ -126,6 +472,22 @@ func (in *TheiaStatus) DeepCopyInto(out *TheiaStatus) {
 		}
 	}
 	in.ContainerState.DeepCopyInto(&out.ContainerState)
+	if in.AssignedAt != nil {
+		in, out := &in.AssignedAt, &out.AssignedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Migration != nil {
+		in, out := &in.Migration, &out.Migration
+		*out = new(StorageMigrationStatus)
+		**out = **in
+	}
+	if in.Warnings != nil {
+		in, out := &in.Warnings, &out.Warnings
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TheiaStatus.
@@ -144,6 +506,26 @@ func (in *TheiaTemplateSpec) DeepCopyInto(out *TheiaTemplateSpec) {
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.PersistentVolumeClaimSpec.DeepCopyInto(&out.PersistentVolumeClaimSpec)
 	in.Spec.DeepCopyInto(&out.Spec)
+	if in.SeccompProfile != nil {
+		in, out := &in.SeccompProfile, &out.SeccompProfile
+		*out = new(SeccompProfile)
+		**out = **in
+	}
+	if in.PreStopTimeoutSeconds != nil {
+		in, out := &in.PreStopTimeoutSeconds, &out.PreStopTimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.ProcMount != nil {
+		in, out := &in.ProcMount, &out.ProcMount
+		*out = new(v1.ProcMountType)
+		**out = **in
+	}
+	if in.VolumeDevices != nil {
+		in, out := &in.VolumeDevices, &out.VolumeDevices
+		*out = make([]v1.VolumeDevice, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TheiaTemplateSpec.
@@ -155,3 +537,18 @@ func (in *TheiaTemplateSpec) DeepCopy() *TheiaTemplateSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VolumeSpec) DeepCopyInto(out *VolumeSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VolumeSpec.
+func (in *VolumeSpec) DeepCopy() *VolumeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VolumeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
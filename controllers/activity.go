@@ -0,0 +1,71 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"theia-controller/pkg/culler"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ActivitySidecarPort is the port of the activity tracker. It proxies the
+	// requests to the Theia container and serves the last activity at
+	// culler.ACTIVITY_SIDECAR_PATH.
+	ActivitySidecarPort = 8081
+	// ActivitySidecarMountPath is where the activity tracker keeps the last
+	// activity, so that it survives a restart of the sidecar
+	ActivitySidecarMountPath = "/var/run/activity"
+)
+
+// generateActivitySidecar generates the activity tracker proxying the requests
+// to the Theia container listening on port. There is no default image of the
+// activity tracker, it must be set with ACTIVITY_SIDECAR_IMAGE.
+func generateActivitySidecar(port int32) corev1.Container {
+	return corev1.Container{
+		Name:  "activity-tracker",
+		Image: os.Getenv("ACTIVITY_SIDECAR_IMAGE"),
+		Env: []corev1.EnvVar{
+			{Name: "LISTEN_PORT", Value: fmt.Sprint(ActivitySidecarPort)},
+			{Name: "UPSTREAM_URL", Value: fmt.Sprintf("http://localhost:%d", port)},
+			{Name: "ACTIVITY_PATH", Value: culler.ACTIVITY_SIDECAR_PATH},
+			{Name: "ACTIVITY_FILE", Value: ActivitySidecarMountPath + "/last-activity"},
+		},
+		Ports: []corev1.ContainerPort{{
+			ContainerPort: ActivitySidecarPort,
+			Name:          "activity-port",
+			Protocol:      "TCP",
+		}},
+		VolumeMounts: []corev1.VolumeMount{{Name: "activity", MountPath: ActivitySidecarMountPath}},
+	}
+}
+
+// addActivitySidecar injects the activity tracker and its volume into the pod,
+// proxying to the Theia container at index.
+func addActivitySidecar(podSpec *corev1.PodSpec, index int) {
+	port := int32(DefaultContainerPort)
+	if ports := podSpec.Containers[index].Ports; len(ports) > 0 {
+		port = ports[0].ContainerPort
+	}
+	podSpec.Containers = append(podSpec.Containers, generateActivitySidecar(port))
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name:         "activity",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+}
@@ -0,0 +1,137 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// DefaultArchiveImage is the image uploading the workspace to the object storage
+const DefaultArchiveImage = "amazon/aws-cli:latest"
+
+// archiveScript streams a tarball of the workspace to the archive location.
+const archiveScript = `tar -czf - -C /workspace . | aws s3 cp - "$ARCHIVE_LOCATION"`
+
+// archiveIsEnabled returns true if ENABLE_ARCHIVE_ON_DELETE is set to "true"
+// and ARCHIVE_BUCKET is set
+func archiveIsEnabled() bool {
+	return os.Getenv("ENABLE_ARCHIVE_ON_DELETE") == "true" && os.Getenv("ARCHIVE_BUCKET") != ""
+}
+
+func archiveJobName(instance *v1alpha1.Theia) string {
+	return instance.Name + "-archive"
+}
+
+// archiveLocation returns where the workspace of the Theia is archived in the
+// ARCHIVE_BUCKET, e.g. s3://bucket/namespace/name.tar.gz
+func archiveLocation(instance *v1alpha1.Theia) string {
+	bucket := strings.TrimSuffix(os.Getenv("ARCHIVE_BUCKET"), "/")
+	if !strings.Contains(bucket, "://") {
+		bucket = "s3://" + bucket
+	}
+	return fmt.Sprintf("%s/%s/%s.tar.gz", bucket, instance.Namespace, instance.Name)
+}
+
+// generateArchiveJob generates the job archiving the workspace PVC. The
+// credentials of the object storage are read from the ARCHIVE_CREDENTIALS_SECRET
+// of the namespace when set.
+func generateArchiveJob(instance *v1alpha1.Theia, pvcName string) *batchv1.Job {
+	image := os.Getenv("ARCHIVE_IMAGE")
+	if image == "" {
+		image = DefaultArchiveImage
+	}
+	backoffLimit := int32(2)
+	container := corev1.Container{
+		Name:         "archive",
+		Image:        image,
+		Command:      []string{"sh", "-c", archiveScript},
+		Env:          []corev1.EnvVar{{Name: "ARCHIVE_LOCATION", Value: archiveLocation(instance)}},
+		VolumeMounts: []corev1.VolumeMount{{Name: "workspace", MountPath: "/workspace", ReadOnly: true}},
+	}
+	if secret := os.Getenv("ARCHIVE_CREDENTIALS_SECRET"); secret != "" {
+		container.EnvFrom = []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secret}},
+		}}
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      archiveJobName(instance),
+			Namespace: instance.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{container},
+					Volumes:       []corev1.Volume{migrationVolume("workspace", pvcName)},
+				},
+			},
+		},
+	}
+}
+
+// archiveWorkspace archives the workspace PVC of a Theia about to be deleted
+// with a job, and records the archive location in the status. Returns true once
+// the job is complete. The Theia isn't deleted if the job fails, which is
+// reported once as a status warning.
+func (r *TheiaReconciler) archiveWorkspace(ctx context.Context, instance *v1alpha1.Theia, pvcName string) (bool, error) {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: archiveJobName(instance), Namespace: instance.Namespace}, job)
+	if err != nil && apierrs.IsNotFound(err) {
+		job = generateArchiveJob(instance, pvcName)
+		if err := ctrl.SetControllerReference(instance, job, r.Scheme); err != nil {
+			return false, err
+		}
+		log.Info("Creating archive Job", "namespace", job.Namespace, "name", job.Name)
+		if err := r.Create(ctx, job); err != nil {
+			return false, err
+		}
+		instance.Status.ArchiveLocation = archiveLocation(instance)
+		return false, r.updateStatus(ctx, instance)
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobFailed:
+			return false, r.reportWarning(ctx, instance, EventReasonArchiveFailed,
+				fmt.Sprintf("Unable to archive workspace: %s", condition.Message))
+		case batchv1.JobComplete:
+			r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonUpdated,
+				"Archived workspace to %s", instance.Status.ArchiveLocation)
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,152 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	v1alpha1 "theia-controller/api/v1alpha1"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// CredentialsTokenKey is the key of the generated token in the credentials Secret
+const CredentialsTokenKey = "token"
+
+// CredentialsMountPath is the location the credentials Secret is mounted at
+const CredentialsMountPath = "/var/run/secrets/theia"
+
+// RotatedAtAnnotation records when the token of the credentials Secret was
+// last generated.
+const RotatedAtAnnotation = "theia.e2.fyi/rotated-at"
+
+func credentialsSecretName(name string) string {
+	return name + "-credentials"
+}
+
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// addCredentials mounts the credentials Secret into the Theia container as a
+// file under CredentialsMountPath, whose path is set in the THEIA_TOKEN_FILE env
+// var. The token isn't set in an env var, as the kubelet only refreshes the
+// mounted file once the token is rotated.
+func addCredentials(instance *v1alpha1.Theia, podSpec *corev1.PodSpec, container *corev1.Container) {
+	secretName := credentialsSecretName(instance.Name)
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "THEIA_TOKEN_FILE",
+		Value: CredentialsMountPath + "/" + CredentialsTokenKey,
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "theia-credentials",
+		MountPath: CredentialsMountPath,
+		ReadOnly:  true,
+	})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "theia-credentials",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+		},
+	})
+}
+
+// credentialsRotationPeriod returns the rotation period of the token, or zero
+// if it is never rotated.
+func credentialsRotationPeriod(instance *v1alpha1.Theia) time.Duration {
+	return time.Duration(instance.Spec.Credentials.RotationPeriodMinutes) * time.Minute
+}
+
+// credentialsRotationIn returns how long until the token of the Secret is due
+// for rotation, or zero if it is never rotated. It is negative once the token
+// is older than the rotation period.
+func credentialsRotationIn(instance *v1alpha1.Theia, secret *corev1.Secret) time.Duration {
+	period := credentialsRotationPeriod(instance)
+	if period <= 0 {
+		return 0
+	}
+	rotatedAt, err := time.Parse(time.RFC3339, secret.Annotations[RotatedAtAnnotation])
+	if err != nil {
+		return -1
+	}
+	return time.Until(rotatedAt.Add(period))
+}
+
+// credentialsNeedRotation returns true if the token of the Secret is older than
+// the configured rotation period.
+func credentialsNeedRotation(instance *v1alpha1.Theia, secret *corev1.Secret) bool {
+	if _, ok := secret.Data[CredentialsTokenKey]; !ok {
+		return true
+	}
+	return credentialsRotationPeriod(instance) > 0 && credentialsRotationIn(instance, secret) <= 0
+}
+
+// reconcileCredentials generates the token of the credentials Secret, and
+// rotates it once it is older than the rotation period. Returns how long until
+// the next rotation, or zero if the token is never rotated.
+func (r *TheiaReconciler) reconcileCredentials(instance *v1alpha1.Theia) (time.Duration, error) {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	name := credentialsSecretName(instance.Name)
+	found := &corev1.Secret{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: instance.Namespace}, found)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return 0, err
+	}
+	justCreated := apierrs.IsNotFound(err)
+	if !justCreated && !credentialsNeedRotation(instance, found) {
+		return credentialsRotationIn(instance, found), nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return 0, err
+	}
+	if justCreated {
+		found = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: instance.Namespace,
+			},
+			Type: corev1.SecretTypeOpaque,
+		}
+		if err := ctrl.SetControllerReference(instance, found, r.Scheme); err != nil {
+			return 0, err
+		}
+	}
+	if found.Annotations == nil {
+		found.Annotations = map[string]string{}
+	}
+	found.Annotations[RotatedAtAnnotation] = time.Now().Format(time.RFC3339)
+	found.Data = map[string][]byte{CredentialsTokenKey: []byte(token)}
+
+	if justCreated {
+		log.Info("Creating credentials Secret", "namespace", instance.Namespace, "name", name)
+		return credentialsRotationPeriod(instance), r.Create(context.TODO(), found)
+	}
+	log.Info("Rotating credentials Secret", "namespace", instance.Namespace, "name", name)
+	return credentialsRotationPeriod(instance), r.Update(context.TODO(), found)
+}
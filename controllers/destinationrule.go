@@ -0,0 +1,127 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// The defaults of the connection pool of the DestinationRule, suited to the
+// long lived websockets of Theia
+const (
+	DefaultMaxConnections       = 1024
+	DefaultHTTPIdleTimeout      = "1h"
+	DefaultConsecutive5xxErrors = 5
+)
+
+// destinationRuleIsEnabled returns true if USE_ISTIO is set to "true", and
+// either ENABLE_DESTINATION_RULE or ISTIO_WEBSOCKET_ROUTING too, as the
+// websockets are only closed by the idle timeout of the DestinationRule
+func destinationRuleIsEnabled() bool {
+	return os.Getenv("USE_ISTIO") == "true" &&
+		(os.Getenv("ENABLE_DESTINATION_RULE") == "true" || websocketRoutingIsEnabled())
+}
+
+func newDestinationRule() *unstructured.Unstructured {
+	destinationRule := &unstructured.Unstructured{}
+	destinationRule.SetAPIVersion("networking.istio.io/v1alpha3")
+	destinationRule.SetKind("DestinationRule")
+	return destinationRule
+}
+
+func getEnvInt(variable string, defaultVal int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(variable), 10, 64)
+	if err != nil || value <= 0 {
+		return defaultVal
+	}
+	return value
+}
+
+// generateDestinationRule generates the DestinationRule of the service of the
+// Theia. The pool can be tuned with the ISTIO_MAX_CONNECTIONS,
+// ISTIO_HTTP_IDLE_TIMEOUT and ISTIO_CONSECUTIVE_ERRORS env vars, the latter
+// setting the consecutive 5xx errors ejecting the pod.
+func generateDestinationRule(instance *v1alpha1.Theia) *unstructured.Unstructured {
+	idleTimeout := os.Getenv("ISTIO_HTTP_IDLE_TIMEOUT")
+	if idleTimeout == "" {
+		idleTimeout = DefaultHTTPIdleTimeout
+	}
+	destinationRule := newDestinationRule()
+	destinationRule.SetName(instance.Name)
+	destinationRule.SetNamespace(instance.Namespace)
+	destinationRule.Object["spec"] = map[string]interface{}{
+		"host": serviceHost(instance),
+		"trafficPolicy": map[string]interface{}{
+			"connectionPool": map[string]interface{}{
+				"tcp": map[string]interface{}{
+					"maxConnections": getEnvInt("ISTIO_MAX_CONNECTIONS", DefaultMaxConnections),
+				},
+				"http": map[string]interface{}{
+					"idleTimeout": idleTimeout,
+				},
+			},
+			"outlierDetection": map[string]interface{}{
+				"consecutive5xxErrors": getEnvInt("ISTIO_CONSECUTIVE_ERRORS", DefaultConsecutive5xxErrors),
+				"interval":             "30s",
+				"baseEjectionTime":     "30s",
+			},
+		},
+	}
+	return destinationRule
+}
+
+// deleteDestinationRule deletes the DestinationRule of the Theia, left behind
+// once the DestinationRule is disabled.
+func (r *TheiaReconciler) deleteDestinationRule(ctx context.Context, instance *v1alpha1.Theia) error {
+	destinationRule := newDestinationRule()
+	destinationRule.SetName(instance.Name)
+	destinationRule.SetNamespace(instance.Namespace)
+	return r.deleteIfExists(ctx, destinationRule)
+}
+
+func (r *TheiaReconciler) reconcileDestinationRule(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	destinationRule := generateDestinationRule(instance)
+	if err := ctrl.SetControllerReference(instance, destinationRule, r.Scheme); err != nil {
+		return err
+	}
+	// Check if the DestinationRule already exists
+	found := newDestinationRule()
+	err := r.Get(ctx, types.NamespacedName{Name: destinationRule.GetName(), Namespace: destinationRule.GetNamespace()}, found)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating DestinationRule", "namespace", destinationRule.GetNamespace(), "name", destinationRule.GetName())
+		return r.Create(ctx, destinationRule)
+	} else if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(found.Object["spec"], destinationRule.Object["spec"]) {
+		found.Object["spec"] = destinationRule.Object["spec"]
+		log.Info("Updating DestinationRule", "namespace", found.GetNamespace(), "name", found.GetName())
+		return r.Update(ctx, found)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// envoyFilterIsEnabled returns true if USE_ISTIO and ENABLE_GATEWAY_TIMEOUT
+// are both set to "true"
+func envoyFilterIsEnabled() bool {
+	return os.Getenv("USE_ISTIO") == "true" && os.Getenv("ENABLE_GATEWAY_TIMEOUT") == "true"
+}
+
+func newEnvoyFilter() *unstructured.Unstructured {
+	envoyFilter := &unstructured.Unstructured{}
+	envoyFilter.SetAPIVersion("networking.istio.io/v1alpha3")
+	envoyFilter.SetKind("EnvoyFilter")
+	return envoyFilter
+}
+
+func envoyFilterName(instance *v1alpha1.Theia) string {
+	return fmt.Sprintf("theia-%s-timeout", instance.Name)
+}
+
+// generateEnvoyFilter generates the EnvoyFilter setting the gateway timeout of
+// the Theia on its route, which is matched by the route name of the virtual
+// service. nil is returned if the Theia has no gateway timeout or the route has
+// no name.
+func generateEnvoyFilter(instance *v1alpha1.Theia) *unstructured.Unstructured {
+	routeName := virtualServiceRouteName(instance)
+	if instance.Spec.GatewayTimeout == nil || routeName == "" {
+		return nil
+	}
+	// Envoy only accepts durations in seconds
+	timeout := formatSeconds(instance.Spec.GatewayTimeout.Duration)
+	envoyFilter := newEnvoyFilter()
+	envoyFilter.SetName(envoyFilterName(instance))
+	envoyFilter.SetNamespace(instance.Namespace)
+	envoyFilter.Object["spec"] = map[string]interface{}{
+		"configPatches": []interface{}{
+			map[string]interface{}{
+				"applyTo": "HTTP_ROUTE",
+				"match": map[string]interface{}{
+					"context": "GATEWAY",
+					"routeConfiguration": map[string]interface{}{
+						"vhost": map[string]interface{}{
+							"route": map[string]interface{}{
+								"name": routeName,
+							},
+						},
+					},
+				},
+				"patch": map[string]interface{}{
+					"operation": "MERGE",
+					"value": map[string]interface{}{
+						"route": map[string]interface{}{
+							"timeout":      timeout,
+							"idle_timeout": timeout,
+						},
+					},
+				},
+			},
+		},
+	}
+	return envoyFilter
+}
+
+// deleteEnvoyFilter deletes the EnvoyFilter of the Theia, left behind once the
+// gateway timeouts are disabled.
+func (r *TheiaReconciler) deleteEnvoyFilter(ctx context.Context, instance *v1alpha1.Theia) error {
+	envoyFilter := newEnvoyFilter()
+	envoyFilter.SetName(envoyFilterName(instance))
+	envoyFilter.SetNamespace(instance.Namespace)
+	return r.deleteIfExists(ctx, envoyFilter)
+}
+
+// reconcileEnvoyFilter creates or updates the EnvoyFilter of the gateway
+// timeout of the Theia, and deletes it once the timeout is unset.
+func (r *TheiaReconciler) reconcileEnvoyFilter(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	envoyFilter := generateEnvoyFilter(instance)
+	found := newEnvoyFilter()
+	err := r.Get(ctx, types.NamespacedName{Name: envoyFilterName(instance), Namespace: instance.Namespace}, found)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	if envoyFilter == nil {
+		if exists {
+			log.Info("Deleting EnvoyFilter", "namespace", found.GetNamespace(), "name", found.GetName())
+			return ignoreNotFound(r.Delete(ctx, found))
+		}
+		return nil
+	}
+	if err := ctrl.SetControllerReference(instance, envoyFilter, r.Scheme); err != nil {
+		return err
+	}
+	if !exists {
+		log.Info("Creating EnvoyFilter", "namespace", envoyFilter.GetNamespace(), "name", envoyFilter.GetName())
+		return r.Create(ctx, envoyFilter)
+	}
+	if !reflect.DeepEqual(found.Object["spec"], envoyFilter.Object["spec"]) {
+		found.Object["spec"] = envoyFilter.Object["spec"]
+		log.Info("Updating EnvoyFilter", "namespace", found.GetNamespace(), "name", found.GetName())
+		return r.Update(ctx, found)
+	}
+	return nil
+}
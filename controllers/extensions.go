@@ -0,0 +1,186 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// ExtensionsKey is the key of the list of extensions in the extensions ConfigMap
+const ExtensionsKey = "extensions.json"
+
+// ExtensionsMountPath is the location the extensions ConfigMap is mounted at. It
+// is added to the THEIA_DEFAULT_PLUGINS of the Theia container as a local-dir
+// plugin source, for Theia to load it.
+const ExtensionsMountPath = "/etc/theia/extensions"
+
+// ExtensionsAnnotation on a namespace overrides the THEIA_EXTENSIONS of the
+// controller for the Theia of the namespace
+const ExtensionsAnnotation = "theia.e2.fyi/extensions"
+
+// extensionsAreEnabled returns true if ENABLE_EXTENSIONS_CONFIGMAP is set to "true"
+func extensionsAreEnabled() bool {
+	return os.Getenv("ENABLE_EXTENSIONS_CONFIGMAP") == "true"
+}
+
+func extensionsConfigMapName(name string) string {
+	return name + "-extensions"
+}
+
+// addExtensions mounts the extensions ConfigMap into the Theia container, and
+// adds it to the plugin sources of THEIA_DEFAULT_PLUGINS, keeping the sources
+// the container already defines.
+func addExtensions(instance *v1alpha1.Theia, podSpec *corev1.PodSpec, container *corev1.Container) {
+	source := "local-dir:" + ExtensionsMountPath
+	found := false
+	for i := range container.Env {
+		if env := &container.Env[i]; env.Name == "THEIA_DEFAULT_PLUGINS" && env.ValueFrom == nil {
+			found = true
+			if env.Value == "" {
+				env.Value = source
+			} else {
+				env.Value += "," + source
+			}
+		}
+	}
+	if !found {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "THEIA_DEFAULT_PLUGINS", Value: source})
+	}
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "theia-extensions",
+		MountPath: ExtensionsMountPath,
+		ReadOnly:  true,
+	})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "theia-extensions",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: extensionsConfigMapName(instance.Name)},
+			},
+		},
+	})
+}
+
+// namespaceExtensionsRequests maps a namespace to its Theia, so that the change
+// of its ExtensionsAnnotation is applied to them.
+func (r *TheiaReconciler) namespaceExtensionsRequests(a handler.MapObject) []ctrl.Request {
+	theias := &v1alpha1.TheiaList{}
+	if err := r.List(context.TODO(), theias, client.InNamespace(a.Meta.GetName())); err != nil {
+		r.Log.Error(err, "unable to list the Theia of namespace", "namespace", a.Meta.GetName())
+		return nil
+	}
+	requests := []ctrl.Request{}
+	for _, theia := range theias.Items {
+		requests = append(requests, ctrl.Request{
+			NamespacedName: types.NamespacedName{Name: theia.Name, Namespace: theia.Namespace},
+		})
+	}
+	return requests
+}
+
+// extensionsAnnotationChanged only lets through the updates of namespaces
+// changing their ExtensionsAnnotation.
+var extensionsAnnotationChanged = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool { return false },
+	DeleteFunc: func(e event.DeleteEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return e.MetaOld.GetAnnotations()[ExtensionsAnnotation] != e.MetaNew.GetAnnotations()[ExtensionsAnnotation]
+	},
+	GenericFunc: func(e event.GenericEvent) bool { return false },
+}
+
+// approvedExtensions returns the ids of the extensions approved for the
+// namespace, from the comma separated list of its ExtensionsAnnotation or of the
+// THEIA_EXTENSIONS env var.
+func (r *TheiaReconciler) approvedExtensions(ctx context.Context, namespace string) ([]string, error) {
+	extensions := os.Getenv("THEIA_EXTENSIONS")
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return nil, err
+	}
+	if value, ok := ns.Annotations[ExtensionsAnnotation]; ok {
+		extensions = value
+	}
+	ids := []string{}
+	for _, id := range strings.Split(extensions, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// generateExtensionsConfigMap generates the ConfigMap listing the extensions as
+// the recommendations of an extensions.json.
+func generateExtensionsConfigMap(instance *v1alpha1.Theia, extensions []string) (*corev1.ConfigMap, error) {
+	content, err := json.MarshalIndent(map[string][]string{"recommendations": extensions}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      extensionsConfigMapName(instance.Name),
+			Namespace: instance.Namespace,
+		},
+		Data: map[string]string{ExtensionsKey: string(content)},
+	}, nil
+}
+
+func (r *TheiaReconciler) reconcileExtensions(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	extensions, err := r.approvedExtensions(ctx, instance.Namespace)
+	if err != nil {
+		return err
+	}
+	configMap, err := generateExtensionsConfigMap(instance, extensions)
+	if err != nil {
+		return err
+	}
+	if err := ctrl.SetControllerReference(instance, configMap, r.Scheme); err != nil {
+		return err
+	}
+	found := &corev1.ConfigMap{}
+	err = r.Get(ctx, types.NamespacedName{Name: configMap.Name, Namespace: configMap.Namespace}, found)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating extensions ConfigMap", "namespace", configMap.Namespace, "name", configMap.Name)
+		return r.Create(ctx, configMap)
+	} else if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(found.Data, configMap.Data) {
+		found.Data = configMap.Data
+		log.Info("Updating extensions ConfigMap", "namespace", configMap.Namespace, "name", configMap.Name)
+		return r.Update(ctx, found)
+	}
+	return nil
+}
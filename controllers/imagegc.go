@@ -0,0 +1,72 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ImageGCAnnotation hints the image garbage collection of the nodes whether to
+// retain the Theia image for faster restarts or to evict it to save space. On
+// a namespace, it overrides the DEFAULT_IMAGE_GC_POLICY of the controller for
+// the Theia of the namespace. Neither the kubelet nor the controller act on the
+// annotation of the pods: it only takes effect with an external agent on the
+// nodes, e.g. a DaemonSet pinning or removing the images of the annotated pods.
+const ImageGCAnnotation = "theia.e2.fyi/image-gc"
+
+// The image garbage collection policies of ImageGCAnnotation
+const (
+	ImageGCRetain = "retain"
+	ImageGCEvict  = "evict"
+)
+
+// imageGCPolicy returns the image garbage collection policy of the namespace,
+// from its ImageGCAnnotation or from the DEFAULT_IMAGE_GC_POLICY env var.
+// Unknown policies are ignored.
+func (r *TheiaReconciler) imageGCPolicy(ctx context.Context, namespace string) (string, error) {
+	policy := os.Getenv("DEFAULT_IMAGE_GC_POLICY")
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return "", err
+	}
+	if value, ok := ns.Annotations[ImageGCAnnotation]; ok {
+		policy = value
+	}
+	if policy != ImageGCRetain && policy != ImageGCEvict {
+		return "", nil
+	}
+	return policy, nil
+}
+
+// addImageGCHint annotates the pod template of the StatefulSet with the image
+// garbage collection policy, for the agent of the nodes to act on.
+func addImageGCHint(ss *appsv1.StatefulSet, policy string) {
+	if policy == "" {
+		return
+	}
+	if ss.Spec.Template.Annotations == nil {
+		ss.Spec.Template.Annotations = map[string]string{}
+	}
+	ss.Spec.Template.Annotations[ImageGCAnnotation] = policy
+}
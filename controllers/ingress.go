@@ -0,0 +1,121 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"reflect"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// RewriteTargetAnnotation makes the nginx ingress controller strip the prefix
+// of the Theia, as the rewrite of the Istio virtual service does
+const RewriteTargetAnnotation = "nginx.ingress.kubernetes.io/rewrite-target"
+
+// ingressIsEnabled returns true if USE_INGRESS is set to "true"
+func ingressIsEnabled() bool {
+	return os.Getenv("USE_INGRESS") == "true"
+}
+
+// The networking.k8s.io/v1 Ingress is newer than the pinned k8s.io/api, so it
+// is handled as unstructured like the Istio resources.
+func newIngress() *unstructured.Unstructured {
+	ingress := &unstructured.Unstructured{}
+	ingress.SetAPIVersion("networking.k8s.io/v1")
+	ingress.SetKind("Ingress")
+	return ingress
+}
+
+// generateIngress generates the Ingress routing the prefix of the Theia to its
+// service. The ingress class can be set with the INGRESS_CLASS env var.
+func generateIngress(instance *v1alpha1.Theia) *unstructured.Unstructured {
+	ingress := newIngress()
+	ingress.SetName(instance.Name)
+	ingress.SetNamespace(instance.Namespace)
+	ingress.SetAnnotations(map[string]string{
+		RewriteTargetAnnotation:                 "/$1",
+		"nginx.ingress.kubernetes.io/use-regex": "true",
+	})
+	spec := map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{
+				"http": map[string]interface{}{
+					"paths": []interface{}{
+						map[string]interface{}{
+							"path":     virtualServicePrefix(instance) + "(.*)",
+							"pathType": "ImplementationSpecific",
+							"backend": map[string]interface{}{
+								"service": map[string]interface{}{
+									"name": instance.Name,
+									"port": map[string]interface{}{
+										"number": int64(DefaultServingPort),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if ingressClass := os.Getenv("INGRESS_CLASS"); ingressClass != "" {
+		spec["ingressClassName"] = ingressClass
+	}
+	ingress.Object["spec"] = spec
+	return ingress
+}
+
+// deleteIngress deletes the Ingress of the Theia, left behind once the Ingress
+// backend is disabled.
+func (r *TheiaReconciler) deleteIngress(ctx context.Context, instance *v1alpha1.Theia) error {
+	ingress := newIngress()
+	ingress.SetName(instance.Name)
+	ingress.SetNamespace(instance.Namespace)
+	return r.deleteIfExists(ctx, ingress)
+}
+
+func (r *TheiaReconciler) reconcileIngress(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	ingress := generateIngress(instance)
+	if err := ctrl.SetControllerReference(instance, ingress, r.Scheme); err != nil {
+		return err
+	}
+	// Check if the Ingress already exists
+	found := newIngress()
+	err := r.Get(ctx, types.NamespacedName{Name: ingress.GetName(), Namespace: ingress.GetNamespace()}, found)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating Ingress", "namespace", ingress.GetNamespace(), "name", ingress.GetName())
+		return r.Create(ctx, ingress)
+	} else if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(found.Object["spec"], ingress.Object["spec"]) ||
+		!reflect.DeepEqual(found.GetAnnotations(), ingress.GetAnnotations()) {
+		found.Object["spec"] = ingress.Object["spec"]
+		found.SetAnnotations(ingress.GetAnnotations())
+		log.Info("Updating Ingress", "namespace", found.GetNamespace(), "name", found.GetName())
+		return r.Update(ctx, found)
+	}
+	return nil
+}
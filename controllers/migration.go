@@ -0,0 +1,268 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// MigrateStorageClassAnnotation requests the workspace to be migrated to
+	// the storage class given as value
+	MigrateStorageClassAnnotation = "theia.e2.fyi/migrate-storage-class"
+	// WorkspaceClaimAnnotation holds the name of the PVC mounted as workspace
+	// instead of the one of the volume claim template, once migrated
+	WorkspaceClaimAnnotation = "theia.e2.fyi/workspace-claim"
+	// DefaultMigrationImage is the image copying the workspace
+	DefaultMigrationImage = "alpine:latest"
+)
+
+// migrationIsEnabled returns true if ENABLE_STORAGE_MIGRATION is set to "true"
+func migrationIsEnabled() bool {
+	return os.Getenv("ENABLE_STORAGE_MIGRATION") == "true"
+}
+
+// migrationInProgress returns true while the workspace of the Theia is being
+// migrated. The Theia is stopped meanwhile.
+func migrationInProgress(instance *v1alpha1.Theia) bool {
+	migration := instance.Status.Migration
+	return migration != nil &&
+		(migration.Phase == v1alpha1.MigrationPending || migration.Phase == v1alpha1.MigrationCopying)
+}
+
+func migrationJobName(instance *v1alpha1.Theia) string {
+	return instance.Name + "-migrate-storage"
+}
+
+// generateMigrationJob generates the job copying the workspace from the source
+// to the target PVC of the migration.
+func generateMigrationJob(instance *v1alpha1.Theia) *batchv1.Job {
+	image := os.Getenv("MIGRATION_IMAGE")
+	if image == "" {
+		image = DefaultMigrationImage
+	}
+	backoffLimit := int32(2)
+	migration := instance.Status.Migration
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migrationJobName(instance),
+			Namespace: instance.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    "migrate-storage",
+						Image:   image,
+						Command: []string{"sh", "-c", "cp -a /source/. /target/"},
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "source", MountPath: "/source"},
+							{Name: "target", MountPath: "/target"},
+						},
+					}},
+					Volumes: []corev1.Volume{
+						migrationVolume("source", migration.SourceClaim),
+						migrationVolume("target", migration.TargetClaim),
+					},
+				},
+			},
+		},
+	}
+}
+
+func migrationVolume(name string, claimName string) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+		},
+	}
+}
+
+// reconcileMigration migrates the workspace of the Theia to the storage class
+// requested with the MigrateStorageClassAnnotation. The Theia is stopped, the
+// workspace is copied by a job to a new PVC of the storage class, and the
+// StatefulSet is recreated to mount the new PVC. The source PVC is kept.
+// ss is the desired StatefulSet and found the existing one.
+// Returns true if the rest of the reconciliation has to wait for the migration.
+func (r *TheiaReconciler) reconcileMigration(ctx context.Context, instance *v1alpha1.Theia, ss, found *appsv1.StatefulSet) (ctrl.Result, bool, error) {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	target := instance.Annotations[MigrateStorageClassAnnotation]
+	migration := instance.Status.Migration
+	if target == "" {
+		return ctrl.Result{}, false, nil
+	}
+
+	// Start a new migration
+	if migration == nil || migration.StorageClass != target {
+		source, err := r.workspaceClaimName(ctx, instance, ss)
+		if err != nil {
+			return ctrl.Result{}, false, err
+		}
+		if source == "" {
+			r.EventRecorder.Event(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Theia has no workspace PVC to migrate")
+			return ctrl.Result{}, false, nil
+		}
+		if blockWorkspace(instance) {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Theia workspace %s is a block device, which isn't migrated", source)
+			return ctrl.Result{}, false, nil
+		}
+		if existingClaim(instance) != "" {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Theia mounts the existing PVC %s, which isn't migrated", source)
+			return ctrl.Result{}, false, nil
+		}
+		log.Info("Migrating workspace", "namespace", instance.Namespace, "name", instance.Name, "storageClass", target)
+		// Remove the job of a previous migration
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: migrationJobName(instance), Namespace: instance.Namespace}}
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); ignoreNotFound(err) != nil {
+			return ctrl.Result{}, true, err
+		}
+		instance.Status.Migration = &v1alpha1.StorageMigrationStatus{
+			StorageClass: target,
+			Phase:        v1alpha1.MigrationPending,
+			SourceClaim:  source,
+			TargetClaim:  fmt.Sprintf("%s-%s", source, target),
+		}
+		// The StatefulSet is scaled down on the next reconciliation
+		return ctrl.Result{Requeue: true}, true, r.updateStatus(ctx, instance)
+	}
+	if !migrationInProgress(instance) {
+		return ctrl.Result{}, false, nil
+	}
+
+	// Wait for the pod to release the workspace
+	if found.Status.Replicas > 0 {
+		return ctrl.Result{}, true, nil
+	}
+
+	if err := r.createMigrationClaim(ctx, instance); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, true, r.failMigration(ctx, instance, err.Error())
+		}
+		return ctrl.Result{}, true, err
+	}
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: migrationJobName(instance), Namespace: instance.Namespace}, job)
+	if err != nil && apierrs.IsNotFound(err) {
+		job = generateMigrationJob(instance)
+		if err := ctrl.SetControllerReference(instance, job, r.Scheme); err != nil {
+			return ctrl.Result{}, true, err
+		}
+		log.Info("Creating migration Job", "namespace", job.Namespace, "name", job.Name)
+		if err := r.Create(ctx, job); err != nil {
+			return ctrl.Result{}, true, err
+		}
+		migration.Phase = v1alpha1.MigrationCopying
+		return ctrl.Result{}, true, r.updateStatus(ctx, instance)
+	} else if err != nil {
+		return ctrl.Result{}, true, err
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobFailed:
+			return ctrl.Result{}, true, r.failMigration(ctx, instance, condition.Message)
+		case batchv1.JobComplete:
+			return ctrl.Result{Requeue: true}, true, r.completeMigration(ctx, instance, found)
+		}
+	}
+	return ctrl.Result{}, true, nil
+}
+
+// createMigrationClaim creates the PVC the workspace is copied to, with the
+// same spec as the source PVC but for the storage class.
+func (r *TheiaReconciler) createMigrationClaim(ctx context.Context, instance *v1alpha1.Theia) error {
+	migration := instance.Status.Migration
+	found := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: migration.TargetClaim, Namespace: instance.Namespace}, found)
+	if err == nil || !apierrs.IsNotFound(err) {
+		return err
+	}
+	source := &corev1.PersistentVolumeClaim{}
+	err = r.Get(ctx, types.NamespacedName{Name: migration.SourceClaim, Namespace: instance.Namespace}, source)
+	if err != nil {
+		return err
+	}
+	storageClass := migration.StorageClass
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migration.TargetClaim,
+			Namespace: instance.Namespace,
+			Labels:    source.Labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      source.Spec.AccessModes,
+			Resources:        source.Spec.Resources,
+			VolumeMode:       source.Spec.VolumeMode,
+			StorageClassName: &storageClass,
+		},
+	}
+	return r.Create(ctx, pvc)
+}
+
+// completeMigration points the Theia to the migrated workspace and deletes the
+// StatefulSet so that it is recreated without the volume claim template.
+func (r *TheiaReconciler) completeMigration(ctx context.Context, instance *v1alpha1.Theia, ss *appsv1.StatefulSet) error {
+	migration := instance.Status.Migration
+	r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonUpdated,
+		"Migrated workspace to PVC %s of storage class %s", migration.TargetClaim, migration.StorageClass)
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[WorkspaceClaimAnnotation] = migration.TargetClaim
+	if err := r.Update(ctx, instance); err != nil {
+		return err
+	}
+	migration = instance.Status.Migration
+	migration.Phase = v1alpha1.MigrationSucceeded
+	migration.Message = ""
+	if err := r.updateStatus(ctx, instance); err != nil {
+		return err
+	}
+	return ignoreNotFound(r.Delete(ctx, ss))
+}
+
+// failMigration records why the migration failed. The Theia is started again
+// with its current workspace.
+func (r *TheiaReconciler) failMigration(ctx context.Context, instance *v1alpha1.Theia, message string) error {
+	r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+		"Unable to migrate workspace: %s", message)
+	instance.Status.Migration.Phase = v1alpha1.MigrationFailed
+	instance.Status.Migration.Message = message
+	return r.updateStatus(ctx, instance)
+}
@@ -0,0 +1,186 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	v1alpha1 "theia-controller/api/v1alpha1"
+	"theia-controller/pkg/culler"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// QuotaExceeded is the condition type and the event reason used when the
+// namespace doesn't have enough quota left for the Theia, or when its user
+// already has the maximum number of running Theia
+const QuotaExceeded = "QuotaExceeded"
+
+// UserLabel is the label of the Theia holding the name of its user
+const UserLabel = "user"
+
+// quotaCheckIsEnabled returns true unless CHECK_RESOURCE_QUOTA is set to
+// anything else than "true"
+func quotaCheckIsEnabled() bool {
+	value, exists := os.LookupEnv("CHECK_RESOURCE_QUOTA")
+	return !exists || value == "true"
+}
+
+// podQuotaUsage returns the quota a pod with podSpec is charged with. Init
+// containers run one after another, so only the largest of them counts
+// against the sum of the containers.
+func podQuotaUsage(podSpec *corev1.PodSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	limits := corev1.ResourceList{}
+	for _, container := range podSpec.Containers {
+		addResources(requests, container.Resources.Requests)
+		addResources(limits, container.Resources.Limits)
+	}
+	for _, container := range podSpec.InitContainers {
+		maxResources(requests, container.Resources.Requests)
+		maxResources(limits, container.Resources.Limits)
+	}
+	usage := corev1.ResourceList{
+		corev1.ResourcePods: resource.MustParse("1"),
+	}
+	for name, quantity := range requests {
+		usage[name] = quantity
+		usage[corev1.ResourceName("requests."+string(name))] = quantity
+	}
+	for name, quantity := range limits {
+		usage[corev1.ResourceName("limits."+string(name))] = quantity
+	}
+	return usage
+}
+
+func addResources(total corev1.ResourceList, resources corev1.ResourceList) {
+	for name, quantity := range resources {
+		sum := total[name]
+		sum.Add(quantity)
+		total[name] = sum
+	}
+}
+
+func maxResources(total corev1.ResourceList, resources corev1.ResourceList) {
+	for name, quantity := range resources {
+		if current, ok := total[name]; !ok || quantity.Cmp(current) > 0 {
+			total[name] = quantity
+		}
+	}
+}
+
+// scaleResources returns the resources multiplied by replicas.
+func scaleResources(resources corev1.ResourceList, replicas int32) corev1.ResourceList {
+	scaled := corev1.ResourceList{}
+	for name, quantity := range resources {
+		sum := resource.Quantity{Format: quantity.Format}
+		for i := int32(0); i < replicas; i++ {
+			sum.Add(quantity)
+		}
+		scaled[name] = sum
+	}
+	return scaled
+}
+
+// resourceQuotaExceeded returns why the pods of the StatefulSet don't fit in
+// what is left of the ResourceQuotas of the namespace, or an empty string if
+// they fit.
+func (r *TheiaReconciler) resourceQuotaExceeded(ctx context.Context, ss *appsv1.StatefulSet) (string, error) {
+	quotas := &corev1.ResourceQuotaList{}
+	if err := r.List(ctx, quotas, client.InNamespace(ss.Namespace)); err != nil {
+		return "", err
+	}
+	replicas := int32(1)
+	if ss.Spec.Replicas != nil {
+		replicas = *ss.Spec.Replicas
+	}
+	usage := scaleResources(podQuotaUsage(&ss.Spec.Template.Spec), replicas)
+	for _, quota := range quotas.Items {
+		hard := quota.Status.Hard
+		if len(hard) == 0 {
+			hard = quota.Spec.Hard
+		}
+		for name, limit := range hard {
+			requested, ok := usage[name]
+			if !ok {
+				continue
+			}
+			remaining := limit.DeepCopy()
+			if used, ok := quota.Status.Used[name]; ok {
+				remaining.Sub(used)
+			}
+			if requested.Cmp(remaining) > 0 {
+				return fmt.Sprintf("%s of %s exceeds the %s left in ResourceQuota %s",
+					name, requested.String(), remaining.String(), quota.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// maxInstancesPerUser returns the number of running Theia a user may have, from
+// the MAX_INSTANCES_PER_USER env var. Zero means unlimited.
+func maxInstancesPerUser() int {
+	max, err := strconv.Atoi(os.Getenv("MAX_INSTANCES_PER_USER"))
+	if err != nil || max < 0 {
+		return 0
+	}
+	return max
+}
+
+// userInstanceLimitExceeded returns why the user of the Theia can't start
+// another Theia, or an empty string if they can. The running Theia of the user
+// are counted in every namespace. A Theia is running if it isn't stopped and
+// its StatefulSet has replicas, so stopped Theia don't count and the cap is
+// checked again when one of them is resumed.
+func (r *TheiaReconciler) userInstanceLimitExceeded(ctx context.Context, instance *v1alpha1.Theia) (string, error) {
+	max := maxInstancesPerUser()
+	user, ok := instance.Labels[UserLabel]
+	if max == 0 || !ok {
+		return "", nil
+	}
+	theias := &v1alpha1.TheiaList{}
+	if err := r.List(ctx, theias, client.MatchingLabels{UserLabel: user}); err != nil {
+		return "", err
+	}
+	running := 0
+	for i := range theias.Items {
+		theia := &theias.Items[i]
+		if (theia.Name == instance.Name && theia.Namespace == instance.Namespace) ||
+			culler.StopAnnotationIsSet(theia.ObjectMeta) {
+			continue
+		}
+		ss := &appsv1.StatefulSet{}
+		err := r.Get(ctx, types.NamespacedName{Name: theia.Name, Namespace: theia.Namespace}, ss)
+		if err == nil && (ss.Spec.Replicas == nil || *ss.Spec.Replicas > 0) {
+			running++
+		} else if err != nil && !apierrs.IsNotFound(err) {
+			return "", err
+		}
+	}
+	if running >= max {
+		return fmt.Sprintf("user %s already has %d running Theia out of %d", user, running, max), nil
+	}
+	return "", nil
+}
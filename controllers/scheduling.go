@@ -0,0 +1,154 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// addScheduling merges the node selector, the tolerations and the affinity of
+// the Theia spec into the pod. The defaults of the controller are only applied
+// when neither the Theia spec nor the pod template set them.
+func addScheduling(instance *v1alpha1.Theia, podSpec *corev1.PodSpec) {
+	nodeSelector := instance.Spec.NodeSelector
+	if len(nodeSelector) == 0 && len(instance.Spec.Template.Spec.NodeSelector) == 0 {
+		nodeSelector = defaultNodeSelector()
+	}
+	for key, value := range nodeSelector {
+		if podSpec.NodeSelector == nil {
+			podSpec.NodeSelector = map[string]string{}
+		}
+		podSpec.NodeSelector[key] = value
+	}
+
+	tolerations := instance.Spec.Tolerations
+	if len(tolerations) == 0 && len(instance.Spec.Template.Spec.Tolerations) == 0 {
+		tolerations = defaultTolerations()
+	}
+	for _, toleration := range tolerations {
+		podSpec.Tolerations = mergeToleration(podSpec.Tolerations, toleration)
+	}
+
+	if instance.Spec.Affinity != nil {
+		podSpec.Affinity = instance.Spec.Affinity.DeepCopy()
+	} else if instance.Spec.Template.Spec.Affinity == nil {
+		podSpec.Affinity = defaultAffinity()
+		if term := workloadAntiAffinity(); term != nil {
+			if podSpec.Affinity == nil {
+				podSpec.Affinity = &corev1.Affinity{}
+			}
+			if podSpec.Affinity.PodAntiAffinity == nil {
+				podSpec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+			}
+			antiAffinity := podSpec.Affinity.PodAntiAffinity
+			antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+				antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, *term)
+		}
+	}
+}
+
+// workloadAntiAffinity returns the anti-affinity keeping the Theia off the
+// nodes running the pods of the ANTI_AFFINITY_SELECTOR env var, e.g.
+// "workload=batch", when ENABLE_WORKLOAD_ANTI_AFFINITY is set to "true". The
+// pods are looked up in the comma separated ANTI_AFFINITY_NAMESPACES, or in
+// the namespace of the Theia.
+func workloadAntiAffinity() *corev1.WeightedPodAffinityTerm {
+	if os.Getenv("ENABLE_WORKLOAD_ANTI_AFFINITY") != "true" {
+		return nil
+	}
+	selector := parseSelector(os.Getenv("ANTI_AFFINITY_SELECTOR"))
+	if len(selector) == 0 {
+		return nil
+	}
+	var namespaces []string
+	for _, namespace := range strings.Split(os.Getenv("ANTI_AFFINITY_NAMESPACES"), ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return &corev1.WeightedPodAffinityTerm{
+		Weight: 100,
+		PodAffinityTerm: corev1.PodAffinityTerm{
+			LabelSelector: &metav1.LabelSelector{MatchLabels: selector},
+			Namespaces:    namespaces,
+			TopologyKey:   corev1.LabelHostname,
+		},
+	}
+}
+
+// mergeToleration replaces the toleration of the same key and effect, or
+// appends the toleration.
+func mergeToleration(tolerations []corev1.Toleration, toleration corev1.Toleration) []corev1.Toleration {
+	for i := range tolerations {
+		if tolerations[i].Key == toleration.Key && tolerations[i].Effect == toleration.Effect {
+			tolerations[i] = toleration
+			return tolerations
+		}
+	}
+	return append(tolerations, toleration)
+}
+
+// defaultNodeSelector returns the node selector of the DEFAULT_NODE_SELECTOR
+// env var, e.g. "pool=cpu,disk=ssd"
+func defaultNodeSelector() map[string]string {
+	return parseSelector(os.Getenv("DEFAULT_NODE_SELECTOR"))
+}
+
+// parseSelector parses labels of the "key=value,..." form, skipping the
+// malformed items.
+func parseSelector(value string) map[string]string {
+	selector := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" {
+			selector[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return selector
+}
+
+// defaultTolerations returns the tolerations of the DEFAULT_TOLERATIONS env var
+// as a JSON list. Invalid JSON is ignored.
+func defaultTolerations() []corev1.Toleration {
+	tolerations := []corev1.Toleration{}
+	if value := os.Getenv("DEFAULT_TOLERATIONS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &tolerations); err != nil {
+			return nil
+		}
+	}
+	return tolerations
+}
+
+// defaultAffinity returns the affinity of the DEFAULT_AFFINITY env var as JSON.
+// Invalid JSON is ignored.
+func defaultAffinity() *corev1.Affinity {
+	value := os.Getenv("DEFAULT_AFFINITY")
+	if value == "" {
+		return nil
+	}
+	affinity := &corev1.Affinity{}
+	if err := json.Unmarshal([]byte(value), affinity); err != nil {
+		return nil
+	}
+	return affinity
+}
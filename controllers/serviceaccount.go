@@ -0,0 +1,72 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// serviceAccountIsEnabled returns true if CREATE_SERVICE_ACCOUNT is set to "true"
+func serviceAccountIsEnabled() bool {
+	return os.Getenv("CREATE_SERVICE_ACCOUNT") == "true"
+}
+
+func serviceAccountName(name string) string {
+	return "theia-" + name
+}
+
+// usesOwnServiceAccount returns true if the pod of the Theia runs as the
+// ServiceAccount of the Theia, i.e. the pod template doesn't set another one
+func usesOwnServiceAccount(instance *v1alpha1.Theia) bool {
+	return serviceAccountIsEnabled() && instance.Spec.Template.Spec.ServiceAccountName == ""
+}
+
+func generateServiceAccount(instance *v1alpha1.Theia) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceAccountName(instance.Name),
+			Namespace: instance.Namespace,
+			Labels:    map[string]string{"theia-name": instance.Name},
+		},
+	}
+}
+
+// reconcileServiceAccount creates the ServiceAccount of the Theia. It is only
+// created, so that the annotations added for the workload identity and the
+// secrets of its tokens are kept.
+func (r *TheiaReconciler) reconcileServiceAccount(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	serviceAccount := generateServiceAccount(instance)
+	if err := ctrl.SetControllerReference(instance, serviceAccount, r.Scheme); err != nil {
+		return err
+	}
+	found := &corev1.ServiceAccount{}
+	err := r.Get(ctx, types.NamespacedName{Name: serviceAccount.Name, Namespace: serviceAccount.Namespace}, found)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating ServiceAccount", "namespace", serviceAccount.Namespace, "name", serviceAccount.Name)
+		return r.Create(ctx, serviceAccount)
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	v1alpha1 "theia-controller/api/v1alpha1"
+	"theia-controller/pkg/culler"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// SnapshotAnnotation holds the name of the VolumeSnapshot the workspace
+	// of a culled Theia is restored from when it is resumed
+	SnapshotAnnotation = "theia.e2.fyi/workspace-snapshot"
+	// SnapshotGroup is the API group of the VolumeSnapshot CRD
+	SnapshotGroup = "snapshot.storage.k8s.io"
+	// SnapshotAPIVersion is the version of the VolumeSnapshot CRD
+	SnapshotAPIVersion = SnapshotGroup + "/v1beta1"
+)
+
+// snapshotOnCullIsEnabled returns true if ENABLE_SNAPSHOT_ON_CULL is set to "true"
+func snapshotOnCullIsEnabled() bool {
+	return os.Getenv("ENABLE_SNAPSHOT_ON_CULL") == "true"
+}
+
+func newVolumeSnapshot() *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetAPIVersion(SnapshotAPIVersion)
+	snapshot.SetKind("VolumeSnapshot")
+	return snapshot
+}
+
+func newVolumeSnapshotList() *unstructured.UnstructuredList {
+	snapshots := &unstructured.UnstructuredList{}
+	snapshots.SetAPIVersion(SnapshotAPIVersion)
+	snapshots.SetKind("VolumeSnapshotList")
+	return snapshots
+}
+
+// generateVolumeSnapshot generates the VolumeSnapshot of the workspace PVC. The
+// snapshot class can be set with the VOLUME_SNAPSHOT_CLASS env var.
+func generateVolumeSnapshot(instance *v1alpha1.Theia, pvcName string) *unstructured.Unstructured {
+	snapshot := newVolumeSnapshot()
+	snapshot.SetName(fmt.Sprintf("%s-%d", pvcName, time.Now().Unix()))
+	snapshot.SetNamespace(instance.Namespace)
+	snapshot.SetLabels(map[string]string{"theia-name": instance.Name})
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvcName,
+		},
+	}
+	if snapshotClass := os.Getenv("VOLUME_SNAPSHOT_CLASS"); snapshotClass != "" {
+		spec["volumeSnapshotClassName"] = snapshotClass
+	}
+	snapshot.Object["spec"] = spec
+	return snapshot
+}
+
+// snapshotWorkspace takes a VolumeSnapshot of the workspace of a Theia being
+// culled, and records it with the SnapshotAnnotation. Only the PVC of the
+// volume claim template is snapshotted, and nothing is done if the
+// VolumeSnapshot CRD isn't installed.
+func (r *TheiaReconciler) snapshotWorkspace(ctx context.Context, instance *v1alpha1.Theia, ss *appsv1.StatefulSet) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	if len(ss.Spec.VolumeClaimTemplates) == 0 {
+		return nil
+	}
+	pvcName, err := r.workspaceClaimName(ctx, instance, ss)
+	if err != nil {
+		return err
+	}
+	snapshot := generateVolumeSnapshot(instance, pvcName)
+	if err := ctrl.SetControllerReference(instance, snapshot, r.Scheme); err != nil {
+		return err
+	}
+	// Replace the snapshots of the previous culls
+	previous := newVolumeSnapshotList()
+	err = r.List(ctx, previous, client.InNamespace(instance.Namespace), client.MatchingLabels{"theia-name": instance.Name})
+	if meta.IsNoMatchError(err) {
+		log.Info("VolumeSnapshot CRD isn't installed, not taking a snapshot")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := range previous.Items {
+		if err := r.Delete(ctx, &previous.Items[i]); ignoreNotFound(err) != nil {
+			return err
+		}
+	}
+	log.Info("Creating VolumeSnapshot", "namespace", instance.Namespace, "name", snapshot.GetName())
+	if err := r.Create(ctx, snapshot); err != nil {
+		return err
+	}
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[SnapshotAnnotation] = snapshot.GetName()
+	return nil
+}
+
+// reconcileSnapshot frees the workspace PVC of a culled Theia once its snapshot
+// is ready and the pod is gone, and restores the PVC from the snapshot before
+// the Theia is resumed. ss is the desired StatefulSet and found the existing one.
+func (r *TheiaReconciler) reconcileSnapshot(ctx context.Context, instance *v1alpha1.Theia, ss, found *appsv1.StatefulSet) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	snapshotName := instance.Annotations[SnapshotAnnotation]
+	if snapshotName == "" || len(ss.Spec.VolumeClaimTemplates) == 0 {
+		return nil
+	}
+	pvcName, err := r.workspaceClaimName(ctx, instance, ss)
+	if err != nil {
+		return err
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	err = r.Get(ctx, types.NamespacedName{Name: pvcName, Namespace: instance.Namespace}, pvc)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	pvcFound := err == nil
+
+	if culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		if !pvcFound || pvc.DeletionTimestamp != nil || found.Status.Replicas > 0 {
+			return nil
+		}
+		snapshot := newVolumeSnapshot()
+		err := r.Get(ctx, types.NamespacedName{Name: snapshotName, Namespace: instance.Namespace}, snapshot)
+		if err != nil {
+			return ignoreNotFound(err)
+		}
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready {
+			return nil
+		}
+		log.Info("Deleting the snapshotted workspace", "namespace", instance.Namespace, "name", pvcName)
+		return ignoreNotFound(r.Delete(ctx, pvc))
+	}
+
+	// Restore the workspace before the StatefulSet creates an empty one
+	if !pvcFound {
+		apiGroup := SnapshotGroup
+		restored := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pvcName,
+				Namespace: instance.Namespace,
+				Labels:    ss.Spec.Template.Labels,
+			},
+			Spec: *ss.Spec.VolumeClaimTemplates[0].Spec.DeepCopy(),
+		}
+		restored.Spec.DataSource = &corev1.TypedLocalObjectReference{
+			APIGroup: &apiGroup,
+			Kind:     "VolumeSnapshot",
+			Name:     snapshotName,
+		}
+		log.Info("Restoring the workspace from its snapshot", "namespace", instance.Namespace, "name", pvcName)
+		if err := r.Create(ctx, restored); err != nil {
+			return err
+		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonResumed,
+			"Restored workspace %s from VolumeSnapshot %s", pvcName, snapshotName)
+	}
+	delete(instance.Annotations, SnapshotAnnotation)
+	return r.Update(ctx, instance)
+}
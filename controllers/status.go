@@ -0,0 +1,118 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	v1alpha1 "theia-controller/api/v1alpha1"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultMaxConditions is the default number of conditions kept in the
+	// status of a Theia, the oldest being dropped first
+	DefaultMaxConditions = 20
+	// DefaultMaxConditionMessageLength is the default length the messages of
+	// the conditions are truncated to
+	DefaultMaxConditionMessageLength = 1024
+	// DefaultMaxStatusSize is the default size in bytes of the status of a
+	// Theia serialized as JSON, well below the size limit of etcd
+	DefaultMaxStatusSize = 64 * 1024
+)
+
+// trimStatus keeps the status of the Theia small enough to be stored: the
+// condition history is capped to MAX_CONDITIONS, the condition messages are
+// truncated to MAX_CONDITION_MESSAGE_LENGTH, and the oldest conditions are
+// dropped while the status exceeds MAX_STATUS_SIZE bytes. Returns true if the
+// status was oversized.
+func trimStatus(instance *v1alpha1.Theia) bool {
+	status := &instance.Status
+	if max := int(getEnvInt("MAX_CONDITIONS", DefaultMaxConditions)); len(status.Conditions) > max {
+		status.Conditions = status.Conditions[:max]
+	}
+	maxLength := int(getEnvInt("MAX_CONDITION_MESSAGE_LENGTH", DefaultMaxConditionMessageLength))
+	for i := range status.Conditions {
+		if message := status.Conditions[i].Message; maxLength > 3 && len(message) > maxLength {
+			status.Conditions[i].Message = truncateMessage(message, maxLength-3) + "..."
+		}
+	}
+
+	maxSize := int(getEnvInt("MAX_STATUS_SIZE", DefaultMaxStatusSize))
+	oversized := false
+	for len(status.Conditions) > 0 && statusSize(status) > maxSize {
+		oversized = true
+		status.Conditions = status.Conditions[:len(status.Conditions)-1]
+	}
+	return oversized
+}
+
+// truncateMessage truncates the message to at most length bytes, without
+// splitting a multi-byte character.
+func truncateMessage(message string, length int) string {
+	for length > 0 && !utf8.RuneStart(message[length]) {
+		length--
+	}
+	return message[:length]
+}
+
+func statusSize(status *v1alpha1.TheiaStatus) int {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// updateStatus trims the status of the Theia before writing it.
+func (r *TheiaReconciler) updateStatus(ctx context.Context, instance *v1alpha1.Theia) error {
+	if trimStatus(instance) {
+		r.Log.WithValues("theia", instance.Namespace).Info("Trimmed the conditions of an oversized status",
+			"namespace", instance.Namespace, "name", instance.Name, "conditions", len(instance.Status.Conditions))
+		r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonStatusTrimmed,
+			"Dropped the oldest conditions of the status exceeding MAX_STATUS_SIZE, %d are kept",
+			len(instance.Status.Conditions))
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// reportWarning emits the warning event of reason unless the same message is
+// already reported in the status, so that a lasting problem isn't reported
+// again on every reconciliation.
+func (r *TheiaReconciler) reportWarning(ctx context.Context, instance *v1alpha1.Theia, reason, message string) error {
+	if reported, ok := instance.Status.Warnings[reason]; ok && reported == message {
+		return nil
+	}
+	r.EventRecorder.Event(instance, corev1.EventTypeWarning, reason, message)
+	if instance.Status.Warnings == nil {
+		instance.Status.Warnings = map[string]string{}
+	}
+	instance.Status.Warnings[reason] = message
+	return r.updateStatus(ctx, instance)
+}
+
+// clearWarning forgets the warning of reason once its problem is gone, for it
+// to be reported again if the problem comes back.
+func (r *TheiaReconciler) clearWarning(ctx context.Context, instance *v1alpha1.Theia, reason string) error {
+	if _, ok := instance.Status.Warnings[reason]; !ok {
+		return nil
+	}
+	delete(instance.Status.Warnings, reason)
+	return r.updateStatus(ctx, instance)
+}
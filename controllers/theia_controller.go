@@ -19,21 +19,30 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	v1alpha1 "theia-controller/api/v1alpha1"
 	"theia-controller/pkg/culler"
+	"theia-controller/pkg/lifecycle"
 	"theia-controller/pkg/metrics"
+	"time"
 
 	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
 
 	"github.com/go-logr/logr"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
 
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -49,6 +58,18 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
+// ReconcilingCondition is the condition type reported while the StatefulSet of
+// the Theia hasn't observed its latest change
+const ReconcilingCondition = "Reconciling"
+
+// DefaultContainerName is the name of the Theia container of the pod, unless
+// the Theia names another one with the TheiaContainerAnnotation
+const DefaultContainerName = "theia"
+
+// TheiaContainerAnnotation names the Theia container of the pod template, for
+// pod templates declaring sidecars before it
+const TheiaContainerAnnotation = "theia.e2.fyi/container"
+
 // DefaultContainerPort is the default port to use inside the container
 const DefaultContainerPort = 3000
 
@@ -65,9 +86,116 @@ const DefaultWkDir = "/home/theia"
 // DefaultMountPath is the default location to mount the PVC
 const DefaultMountPath = "/home/project"
 
+// DefaultVolumeName is the default name of the workspace volume
+const DefaultVolumeName = "theia"
+
+// DefaultWorkspaceSizeLimit is the default size limit of the emptyDir workspace
+// used when no PVC is configured
+const DefaultWorkspaceSizeLimit = "10Gi"
+
 // DefaultImage is the default image to use
 const DefaultImage = "theiaide/theia:latest"
 
+// DefaultIstioGateway is the default gateway of the virtual service
+const DefaultIstioGateway = "kubeflow/kubeflow-gateway"
+
+// DefaultIstioRouteName is the default name of the http route of the virtual service
+const DefaultIstioRouteName = "theia-{name}"
+
+// DefaultGitCloneImage is the default image of the init container cloning the
+// git repository into the workspace
+const DefaultGitCloneImage = "alpine/git:latest"
+
+// gitCloneScript clones the repository $1 into $2 and checks out the ref $3.
+// Nothing is done if $2 already exists, so the workspace is only seeded once.
+const gitCloneScript = `if [ -e "$2" ]; then echo "$2 already exists, skipping clone"; exit 0; fi
+git clone "$1" "$2" && if [ -n "$3" ]; then git -C "$2" checkout "$3"; fi`
+
+// The reasons of the events the controller emits on the Theia. Frontends can
+// rely on this set of reasons, besides the events reissued from the pod and the
+// StatefulSet of the Theia.
+const (
+	// EventReasonCreated is emitted when the StatefulSet or a Service of the
+	// Theia is created
+	EventReasonCreated = "Created"
+	// EventReasonUpdated is emitted when the spec of the StatefulSet changed
+	EventReasonUpdated = "Updated"
+	// EventReasonCulled is emitted when the culler stops an idle or expired Theia
+	EventReasonCulled = "Culled"
+	// EventReasonResumed is emitted when a stopped Theia is started again
+	EventReasonResumed = "Resumed"
+	// EventReasonFailed is emitted when the Theia can't be reconciled
+	EventReasonFailed = "Failed"
+	// EventReasonUnschedulable is emitted when the pod of the Theia can't be scheduled
+	EventReasonUnschedulable = "Unschedulable"
+	// EventReasonImmutableFieldChanged is emitted when a change needs the
+	// StatefulSet to be recreated
+	EventReasonImmutableFieldChanged = "ImmutableFieldChanged"
+	// EventReasonRetentionElapsed is emitted when a culled Theia is deleted
+	EventReasonRetentionElapsed = "RetentionElapsed"
+	// EventReasonWorkingDirMismatch is emitted when the working dir is outside
+	// of the workspace
+	EventReasonWorkingDirMismatch = "WorkingDirMismatch"
+	// EventReasonOwnerConflict is emitted when a resource of the Theia already
+	// exists and is controlled by another owner
+	EventReasonOwnerConflict = "OwnerConflict"
+	// EventReasonTTLExpired is emitted when a Theia is deleted once its TTL
+	// expired
+	EventReasonTTLExpired = "TTLExpired"
+	// EventReasonCleanupFailed is emitted when a finalizer is removed although
+	// the cleanup it holds the deletion for keeps failing
+	EventReasonCleanupFailed = "CleanupFailed"
+	// EventReasonStatusTrimmed is emitted when the oldest conditions are
+	// dropped from an oversized status
+	EventReasonStatusTrimmed = "StatusTrimmed"
+	// EventReasonArchiveFailed is emitted when the workspace of a culled Theia
+	// can't be archived, which keeps the Theia from being deleted
+	EventReasonArchiveFailed = "ArchiveFailed"
+)
+
+// ReadyAtAnnotation records when the Theia first became ready, once its ready
+// latency is observed
+const ReadyAtAnnotation = "theia.e2.fyi/ready-at"
+
+// The pod annotations read by the CNI bandwidth plugin
+const (
+	IngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	EgressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+)
+
+// DefaultIgnoredEventReasons are the routine events of the pod and the
+// StatefulSet which aren't reissued on the Theia
+const DefaultIgnoredEventReasons = "SuccessfulCreate,SuccessfulDelete"
+
+// LifecycleFinalizer holds the deletion of the Theia until its deleted
+// lifecycle callback has been sent.
+const LifecycleFinalizer = "theia.e2.fyi/lifecycle"
+
+// MaintenanceAnnotation puts the Theia in maintenance when set to "true": its
+// route answers with an empty 503 instead of reaching the pod, as an Istio
+// abort can't carry a body or a message.
+const MaintenanceAnnotation = "theia.e2.fyi/maintenance"
+
+// DefaultRouteTimeout is the default timeout of the route of the Theia
+const DefaultRouteTimeout = "300s"
+
+// RoutingFinalizer holds the deletion of the Theia until its VirtualService and
+// Ingress are deleted, in case the garbage collector misses them.
+const RoutingFinalizer = "theia.e2.fyi/routing"
+
+// CleanupFailingSinceAnnotation records when the cleanup of a Theia being
+// deleted first failed
+const CleanupFailingSinceAnnotation = "theia.e2.fyi/cleanup-failing-since"
+
+// DefaultCleanupTimeout is the default number of minutes the cleanup may keep
+// failing before the finalizer is removed anyway, instead of the Theia staying
+// in Terminating
+const DefaultCleanupTimeout = 60
+
+// RecreateAnnotation confirms that the StatefulSet of the Theia can be deleted
+// and created again, so that changes to its immutable fields are applied.
+const RecreateAnnotation = "theia.e2.fyi/recreate"
+
 /*
 We generally want to ignore (not requeue) NotFound errors, since we'll get a
 reconciliation request once the object exists, and requeuing in the meantime
@@ -80,6 +208,25 @@ func ignoreNotFound(err error) error {
 	return err
 }
 
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(slice []string, s string) []string {
+	result := []string{}
+	for _, item := range slice {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 // TheiaReconciler reconciles a Theia object
 type TheiaReconciler struct {
 	client.Client
@@ -90,15 +237,28 @@ type TheiaReconciler struct {
 }
 
 // +kubebuilder:rbac:groups=networking.istio.io,resources=virtualservices,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=envoyfilters,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=destinationrules,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
 // +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=statefulsets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=core,resources=resourcequotas,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=e2.fyi,resources=theia,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=e2.fyi,resources=theia/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=e2.fyi,resources=theiaclustertemplates,verbs=get;list;watch
 
 // Reconcile reconciles a Theia object
 func (r *TheiaReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
@@ -109,16 +269,24 @@ func (r *TheiaReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	event := &v1.Event{}
 	var getEventErr error
 	getEventErr = r.Get(ctx, req.NamespacedName, event)
-	if getEventErr == nil {
+	if getEventErr == nil && eventIsReissued(event) {
 		involvedTheia := &v1alpha1.Theia{}
 		theiaName, err := theiaNameFromInvolvedObject(r.Client, &event.InvolvedObject)
-		if err != nil {
+		if apierrs.IsNotFound(err) {
+			// the pod is gone, together with its Theia
+			log.V(1).Info("Skipping event of deleted pod", "pod", event.InvolvedObject.Name)
+			return ctrl.Result{}, nil
+		} else if err != nil {
 			return ctrl.Result{}, err
 		}
 		involvedTheiaKey := types.NamespacedName{Name: theiaName, Namespace: req.Namespace}
-		if err := r.Get(ctx, involvedTheiaKey, involvedTheia); err != nil {
+		if err := r.Get(ctx, involvedTheiaKey, involvedTheia); apierrs.IsNotFound(err) {
+			// the Theia was deleted since the event was emitted
+			log.V(1).Info("Skipping event of deleted Theia", "name", theiaName)
+			return ctrl.Result{}, nil
+		} else if err != nil {
 			log.Error(err, "unable to fetch Theia by looking at event")
-			return ctrl.Result{}, ignoreNotFound(err)
+			return ctrl.Result{}, err
 		}
 		r.EventRecorder.Eventf(involvedTheia, event.Type, event.Reason,
 			"Reissued from %s/%s: %s", strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Message)
@@ -131,20 +299,180 @@ func (r *TheiaReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	instance := &v1alpha1.Theia{}
 	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
 		log.Error(err, "unable to fetch Theia")
+		if apierrs.IsNotFound(err) {
+			r.Metrics.SetTheiaRunning(req.Namespace, req.Name, false)
+		}
 		return ctrl.Result{}, ignoreNotFound(err)
 	}
 
+	// Notify the deletion of the Theia before letting it go
+	if instance.DeletionTimestamp != nil {
+		if phase := getPhase(instance); len(instance.Finalizers) > 0 && phase != instance.Status.Phase {
+			instance.Status.Phase = phase
+			if err := r.updateStatus(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if containsString(instance.Finalizers, RoutingFinalizer) {
+			if err := r.deleteRouting(ctx, instance); err != nil {
+				if force, err := r.recordCleanupFailure(ctx, instance, RoutingFinalizer, err); !force {
+					return ctrl.Result{}, err
+				}
+			}
+			instance.Finalizers = removeString(instance.Finalizers, RoutingFinalizer)
+			if err := r.Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if containsString(instance.Finalizers, LifecycleFinalizer) {
+			lifecycle.Notify(lifecycle.Deleted, instance.ObjectMeta)
+			instance.Finalizers = removeString(instance.Finalizers, LifecycleFinalizer)
+			if err := r.Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		r.Metrics.SetTheiaRunning(instance.Namespace, instance.Name, false)
+		return ctrl.Result{}, nil
+	}
+	// Nothing can be created in a namespace being deleted
+	if terminating, err := r.namespaceIsTerminating(ctx, instance.Namespace); err != nil {
+		return ctrl.Result{}, err
+	} else if terminating {
+		log.Info("Skipping Theia in terminating namespace", "namespace", instance.Namespace, "name", instance.Name)
+		return ctrl.Result{}, nil
+	}
+	if lifecycle.Enabled() && !containsString(instance.Finalizers, LifecycleFinalizer) {
+		instance.Finalizers = append(instance.Finalizers, LifecycleFinalizer)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if (os.Getenv("USE_ISTIO") == "true" || ingressIsEnabled()) && !containsString(instance.Finalizers, RoutingFinalizer) {
+		instance.Finalizers = append(instance.Finalizers, RoutingFinalizer)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// Keep the stop annotation in line with spec.stopped
+	if syncStopAnnotation(instance) {
+		log.Info("Updating stop annotation", "namespace", instance.Namespace, "name", instance.Name,
+			"stopped", instance.Spec.Stopped)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Refuse to create anything for a Theia violating the policies
+	clusterTemplate, err := r.getClusterTemplate(ctx, instance)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		err = validateTheia(instance, clusterTemplate)
+	}
+	if err != nil {
+		log.Info("Rejecting Theia", "namespace", instance.Namespace, "name", instance.Name, "error", err.Error())
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, EventReasonFailed, err.Error())
+		if err := r.scaleDownRejected(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, r.setFailedCondition(ctx, instance, "Rejected", err.Error())
+	}
+
+	// Reconcile the workspace credentials before they are mounted by the StatefulSet
+	var rotateCredentialsIn time.Duration
+	if instance.Spec.Credentials != nil {
+		rotateCredentialsIn, err = r.reconcileCredentials(instance)
+		if err != nil {
+			log.Error(err, "unable to reconcile credentials Secret")
+			return ctrl.Result{}, err
+		}
+	}
+	if extensionsAreEnabled() {
+		if err := r.reconcileExtensions(ctx, instance); err != nil {
+			log.Error(err, "unable to reconcile extensions ConfigMap")
+			return ctrl.Result{}, err
+		}
+	}
+	if usesOwnServiceAccount(instance) {
+		if err := r.reconcileServiceAccount(ctx, instance); err != nil {
+			log.Error(err, "unable to reconcile ServiceAccount")
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Reconcile StatefulSet
 	ss := generateStatefulSet(instance)
+	imageGCPolicy, err := r.imageGCPolicy(ctx, instance.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	addImageGCHint(ss, imageGCPolicy)
 	if err := ctrl.SetControllerReference(instance, ss, r.Scheme); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	// Warn about a working dir which isn't part of the workspace
+	workingDirMismatch := ""
+	if os.Getenv("VALIDATE_WORKING_DIR") == "true" {
+		container := &ss.Spec.Template.Spec.Containers[theiaContainerIndex(instance, &ss.Spec.Template.Spec)]
+		if mountPath := workspaceMountPath(container, workspaceVolumeName(instance)); !isSubPath(mountPath, container.WorkingDir) {
+			workingDirMismatch = fmt.Sprintf("Working directory %s is not under the workspace mounted at %s",
+				container.WorkingDir, mountPath)
+		}
+	}
+	if workingDirMismatch != "" {
+		if err := r.reportWarning(ctx, instance, EventReasonWorkingDirMismatch, workingDirMismatch); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err := r.clearWarning(ctx, instance, EventReasonWorkingDirMismatch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Delete the Theia and its workspace once it has been stopped for too long
+	if culler.CulledRetentionElapsed(instance.ObjectMeta) {
+		return ctrl.Result{}, r.deleteCulled(ctx, instance, ss)
+	}
+
+	// Stop the Theia, or delete it with DELETE_ON_TTL_EXPIRY, once its TTL expired
+	if remaining, ok := culler.TTLRemaining(instance.ObjectMeta); ok && remaining <= 0 {
+		ttl := instance.Annotations[culler.TTL_ANNOTATION]
+		if os.Getenv("DELETE_ON_TTL_EXPIRY") == "true" {
+			log.Info("Deleting expired Theia", "namespace", instance.Namespace, "name", instance.Name, "ttl", ttl)
+			r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonTTLExpired,
+				"Theia is deleted once its TTL of %s expired", ttl)
+			return ctrl.Result{}, ignoreNotFound(r.Delete(ctx, instance))
+		}
+		if !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+			log.Info("Stopping expired Theia", "namespace", instance.Namespace, "name", instance.Name, "ttl", ttl)
+			message := fmt.Sprintf("Stopped the Theia once its TTL of %s expired", ttl)
+			if err := r.cullTheia(ctx, instance, ss, culler.STOP_REASON_TTL, message); err != nil {
+				return ctrl.Result{}, err
+			}
+			// Scale down the StatefulSet generated before the Theia was stopped
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
 	// Check if the StatefulSet already exists
 	foundStateful := &appsv1.StatefulSet{}
 	justCreated := false
-	err := r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, foundStateful)
+	err = r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, foundStateful)
 	if err != nil && apierrs.IsNotFound(err) {
+		// Don't create a StatefulSet whose pod would be refused by a ResourceQuota,
+		// or for a user who has too many running Theia
+		if *ss.Spec.Replicas > 0 {
+			exceeded, err := r.userInstanceLimitExceeded(ctx, instance)
+			if err == nil && exceeded == "" && quotaCheckIsEnabled() {
+				exceeded, err = r.resourceQuotaExceeded(ctx, ss)
+			}
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if exceeded != "" {
+				return r.quotaExceeded(ctx, instance, exceeded)
+			}
+		}
 		log.Info("Creating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
 		r.Metrics.TheiaCreation.WithLabelValues(ss.Namespace).Inc()
 		err = r.Create(ctx, ss)
@@ -152,49 +480,111 @@ func (r *TheiaReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		if err != nil {
 			log.Error(err, "unable to create Statefulset")
 			r.Metrics.TheiaFailCreation.WithLabelValues(ss.Namespace).Inc()
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Unable to create StatefulSet %s: %v", ss.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonCreated,
+			"Created StatefulSet %s", ss.Name)
+		lifecycle.Notify(lifecycle.Created, instance.ObjectMeta)
 	} else if err != nil {
 		log.Error(err, "error getting Statefulset")
 		return ctrl.Result{}, err
+	} else if foundStateful.DeletionTimestamp != nil {
+		// Wait for the StatefulSet being recreated to be gone
+		return ctrl.Result{Requeue: true}, nil
+	}
+	// Don't resume a Theia of a user who has too many running Theia meanwhile
+	if !justCreated && *ss.Spec.Replicas > 0 &&
+		foundStateful.Spec.Replicas != nil && *foundStateful.Spec.Replicas == 0 {
+		exceeded, err := r.userInstanceLimitExceeded(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if exceeded != "" {
+			return r.quotaExceeded(ctx, instance, exceeded)
+		}
+	}
+	adopted := false
+	if !justCreated {
+		var conflict string
+		adopted, conflict, err = r.adoptResource(instance, foundStateful)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if conflict != "" {
+			log.Info(conflict, "namespace", ss.Namespace, "name", ss.Name)
+			r.EventRecorder.Event(instance, corev1.EventTypeWarning, EventReasonOwnerConflict, conflict)
+			return ctrl.Result{RequeueAfter: culler.GetRequeueTime()}, nil
+		}
+	}
+	// Free or restore the workspace snapshotted on cull
+	if snapshotOnCullIsEnabled() && !justCreated {
+		if err := r.reconcileSnapshot(ctx, instance, ss, foundStateful); err != nil {
+			log.Error(err, "unable to reconcile the workspace snapshot")
+			return ctrl.Result{}, err
+		}
+	}
+	// Changes to immutable fields can only be applied by recreating the StatefulSet
+	if field := immutableFieldChanged(ss, foundStateful); !justCreated && field != "" {
+		if instance.Annotations[RecreateAnnotation] != "true" {
+			msg := fmt.Sprintf("StatefulSet field %s is immutable, set the annotation %s=\"true\" to recreate the StatefulSet",
+				field, RecreateAnnotation)
+			log.Info(msg, "namespace", ss.Namespace, "name", ss.Name)
+			if err := r.reportWarning(ctx, instance, EventReasonImmutableFieldChanged, msg); err != nil {
+				return ctrl.Result{}, err
+			}
+		} else {
+			log.Info("Recreating StatefulSet", "namespace", ss.Namespace, "name", ss.Name, "field", field)
+			if err := r.Delete(ctx, foundStateful); ignoreNotFound(err) != nil {
+				log.Error(err, "unable to delete Statefulset")
+				return ctrl.Result{}, err
+			}
+			delete(instance.Annotations, RecreateAnnotation)
+			if err := r.Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{Requeue: true}, nil
+		}
+	} else if err := r.clearWarning(ctx, instance, EventReasonImmutableFieldChanged); err != nil {
+		return ctrl.Result{}, err
 	}
 	// Update the foundStateful object and write the result back if there are any changes
-	if !justCreated && reconcilehelper.CopyStatefulSetFields(ss, foundStateful) {
+	if !justCreated && (copyStatefulSetFields(ss, foundStateful) || adopted) {
 		log.Info("Updating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
+		generation := foundStateful.Generation
 		err = r.Update(ctx, foundStateful)
 		if err != nil {
 			log.Error(err, "unable to update Statefulset")
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Unable to update StatefulSet %s: %v", ss.Name, err)
 			return ctrl.Result{}, err
 		}
+		// Only an actual change of the spec bumps the generation
+		if foundStateful.Generation != generation {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonUpdated,
+				"Updated StatefulSet %s", ss.Name)
+		}
 	}
+	r.Metrics.SetTheiaRunning(instance.Namespace, instance.Name, *ss.Spec.Replicas > 0)
 
-	// Reconcile service
-	service := generateService(instance)
-	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
-		return ctrl.Result{}, err
-	}
-	// Check if the Service already exists
-	foundService := &corev1.Service{}
-	justCreated = false
-	err = r.Get(ctx, types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, foundService)
-	if err != nil && apierrs.IsNotFound(err) {
-		log.Info("Creating Service", "namespace", service.Namespace, "name", service.Name)
-		err = r.Create(ctx, service)
-		justCreated = true
-		if err != nil {
-			log.Error(err, "unable to create Service")
-			return ctrl.Result{}, err
+	// Migrate the workspace to another storage class
+	if migrationIsEnabled() {
+		if result, wait, err := r.reconcileMigration(ctx, instance, ss, foundStateful); wait || err != nil {
+			return result, err
 		}
-	} else if err != nil {
-		log.Error(err, "error getting Statefulset")
+	}
+
+	// Reconcile service
+	err = r.reconcileService(instance, generateService(instance))
+	if err != nil {
 		return ctrl.Result{}, err
 	}
-	// Update the foundService object and write the result back if there are any changes
-	if !justCreated && reconcilehelper.CopyServiceFields(service, foundService) {
-		log.Info("Updating Service\n", "namespace", service.Namespace, "name", service.Name)
-		err = r.Update(ctx, foundService)
+
+	// Reconcile the headless service used as the governing service of the StatefulSet
+	if os.Getenv("USE_HEADLESS_SERVICE") == "true" {
+		err = r.reconcileService(instance, generateHeadlessService(instance))
 		if err != nil {
-			log.Error(err, "unable to update Service")
 			return ctrl.Result{}, err
 		}
 	}
@@ -206,36 +596,110 @@ func (r *TheiaReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			return ctrl.Result{}, err
 		}
 	}
+	if envoyFilterIsEnabled() {
+		if err := r.reconcileEnvoyFilter(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if os.Getenv("USE_ISTIO") == "true" {
+		if err := r.deleteEnvoyFilter(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if destinationRuleIsEnabled() {
+		if err := r.reconcileDestinationRule(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if os.Getenv("USE_ISTIO") == "true" {
+		if err := r.deleteDestinationRule(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Reconcile the ingress when routing without ISTIO.
+	if ingressIsEnabled() {
+		if err := r.reconcileIngress(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if containsString(instance.Finalizers, RoutingFinalizer) {
+		// Only a Theia routed before may have an Ingress left behind
+		if err := r.deleteIngress(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-	// Update the readyReplicas if the status is changed
-	if foundStateful.Status.ReadyReplicas != instance.Status.ReadyReplicas {
+	// Update the readyReplicas, the bound volume and the url if the status is changed
+	volumeName, volumeCapacity, err := r.boundVolume(ctx, instance, ss)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	url := theiaURL(instance)
+	assignedAt := instance.Status.AssignedAt
+	if _, ok := instance.Labels[UserLabel]; ok && assignedAt == nil {
+		now := metav1.Now()
+		assignedAt = &now
+	}
+	if foundStateful.Status.ReadyReplicas != instance.Status.ReadyReplicas ||
+		volumeName != instance.Status.VolumeName ||
+		volumeCapacity != instance.Status.VolumeCapacity ||
+		url != instance.Status.URL ||
+		assignedAt != instance.Status.AssignedAt {
 		log.Info("Updating Status", "namespace", instance.Namespace, "name", instance.Name)
+		becameReady := instance.Status.ReadyReplicas == 0 && foundStateful.Status.ReadyReplicas > 0
 		instance.Status.ReadyReplicas = foundStateful.Status.ReadyReplicas
-		err = r.Status().Update(ctx, instance)
+		instance.Status.VolumeName = volumeName
+		instance.Status.VolumeCapacity = volumeCapacity
+		instance.Status.URL = url
+		instance.Status.AssignedAt = assignedAt
+		err = r.updateStatus(ctx, instance)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		if becameReady {
+			lifecycle.Notify(lifecycle.Ready, instance.ObjectMeta)
+		}
+		// Only the first time the Theia becomes ready is observed
+		if becameReady && instance.Annotations[ReadyAtAnnotation] == "" {
+			now := time.Now()
+			r.Metrics.TheiaReadyLatency.WithLabelValues(instance.Namespace).
+				Observe(now.Sub(instance.CreationTimestamp.Time).Seconds())
+			if instance.Annotations == nil {
+				instance.Annotations = map[string]string{}
+			}
+			instance.Annotations[ReadyAtAnnotation] = now.Format(time.RFC3339)
+			if err := r.Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 	}
 
 	// Check the pod status
-	pod := &corev1.Pod{}
 	podFound := false
-	err = r.Get(ctx, types.NamespacedName{Name: ss.Name + "-0", Namespace: ss.Namespace}, pod)
-	if err != nil && apierrs.IsNotFound(err) {
+	pod, err := r.theiaPod(ctx, ss)
+	if err != nil {
+		return ctrl.Result{}, err
+	} else if pod == nil {
 		// This should be reconciled by the StatefulSet
 		log.Info("Pod not found...")
-	} else if err != nil {
-		return ctrl.Result{}, err
 	} else {
 		// Got the pod
 		podFound = true
-		if len(pod.Status.ContainerStatuses) > 0 &&
-			pod.Status.ContainerStatuses[0].State != instance.Status.ContainerState {
+		if message, unschedulable := podUnschedulable(pod); unschedulable {
+			if err := r.reportWarning(ctx, instance, EventReasonUnschedulable, message); err != nil {
+				return ctrl.Result{}, err
+			}
+		} else if err := r.clearWarning(ctx, instance, EventReasonUnschedulable); err != nil {
+			return ctrl.Result{}, err
+		}
+		containerStatus, hasStatus := theiaContainerStatus(instance, pod)
+		if hasStatus && containerStatus.State != instance.Status.ContainerState {
 			log.Info("Updating container state: ", "namespace", instance.Namespace, "name", instance.Name)
-			cs := pod.Status.ContainerStatuses[0].State
+			cs := containerStatus.State
 			instance.Status.ContainerState = cs
 			oldConditions := instance.Status.Conditions
 			newCondition := getNextCondition(cs)
+			if message, ok := crashLoopBackOffMessage(containerStatus); ok {
+				newCondition.Message = message
+			}
 			// Append new condition
 			if len(oldConditions) == 0 || oldConditions[0].Type != newCondition.Type ||
 				oldConditions[0].Reason != newCondition.Reason ||
@@ -243,174 +707,1374 @@ func (r *TheiaReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				log.Info("Appending to conditions: ", "namespace", instance.Namespace, "name", instance.Name, "type", newCondition.Type, "reason", newCondition.Reason, "message", newCondition.Message)
 				instance.Status.Conditions = append([]v1alpha1.TheiaCondition{newCondition}, oldConditions...)
 			}
-			err = r.Status().Update(ctx, instance)
+			err = r.updateStatus(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		} else if len(pod.Status.ContainerStatuses) == 0 && len(instance.Status.Conditions) == 0 {
+			// Give feedback until the kubelet reports the container statuses
+			log.Info("Appending to conditions: ", "namespace", instance.Namespace, "name", instance.Name, "type", "Pending", "reason", "Creating")
+			instance.Status.Conditions = []v1alpha1.TheiaCondition{{
+				Type:          "Pending",
+				LastProbeTime: metav1.Now(),
+				Reason:        "Creating",
+				Message:       fmt.Sprintf("Waiting for the containers of pod %s to be created", pod.Name),
+			}}
+			err = r.updateStatus(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Report the changes of the StatefulSet its controller hasn't observed yet
+	if generationSkewIsReported() {
+		if message, skewed := generationSkew(foundStateful); skewed {
+			if err := r.setCondition(ctx, instance, ReconcilingCondition, "GenerationSkew", message); err != nil {
+				return ctrl.Result{}, err
+			}
+		} else if removeConditions(instance, ReconcilingCondition) {
+			err = r.updateStatus(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Record why the Theia is stopped as the latest condition
+	if reason := culler.GetStopReason(instance.ObjectMeta); reason != "" {
+		oldConditions := instance.Status.Conditions
+		if len(oldConditions) == 0 || oldConditions[0].Type != "Stopped" ||
+			oldConditions[0].Reason != reason {
+			log.Info("Appending to conditions: ", "namespace", instance.Namespace, "name", instance.Name, "type", "Stopped", "reason", reason)
+			instance.Status.Conditions = append([]v1alpha1.TheiaCondition{{
+				Type:          "Stopped",
+				LastProbeTime: metav1.Now(),
+				Reason:        reason,
+				Message:       "Stopped since " + instance.Annotations[culler.STOP_ANNOTATION],
+			}}, oldConditions...)
+			err = r.updateStatus(ctx, instance)
 			if err != nil {
 				return ctrl.Result{}, err
 			}
 		}
 	}
 
-	// Check if the Theia needs to be stopped
-	if podFound && culler.TheiaNeedsCulling(instance.ObjectMeta) {
-		log.Info(fmt.Sprintf(
-			"Theia %s/%s needs culling. Setting annotations",
-			instance.Namespace, instance.Name))
+	// Summarize the state of the Theia in its phase
+	if phase := getPhase(instance); phase != instance.Status.Phase {
+		log.Info("Updating phase", "namespace", instance.Namespace, "name", instance.Name, "phase", phase)
+		if instance.Status.Phase == v1alpha1.TheiaStopped {
+			r.EventRecorder.Event(instance, corev1.EventTypeNormal, EventReasonResumed, "Theia is started again")
+		}
+		instance.Status.Phase = phase
+		err = r.updateStatus(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Record the last activity the culling keys off
+	if culler.ActivityAnnotationIsEnabled() && podFound && theiaIsServing(instance) &&
+		!culler.StopAnnotationIsSet(instance.ObjectMeta) && culler.UpdateLastActivity(&instance.ObjectMeta) {
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Check if the Theia needs to be stopped
+	idleTime := maxIdleTime(instance)
+	if podFound && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		log.Info("Checking idle time", "namespace", instance.Namespace, "name", instance.Name,
+			"maxIdleTime", idleTime.String())
+	}
+	activeSince := time.Time{}
+	if instance.Status.AssignedAt != nil {
+		activeSince = instance.Status.AssignedAt.Time
+	}
+	// A pod still pulling its image or starting isn't idle, however old it is
+	if podFound && theiaIsServing(instance) && culler.TheiaNeedsCulling(instance.ObjectMeta, pod.Name, idleTime, activeSince) {
+		log.Info(fmt.Sprintf(
+			"Theia %s/%s needs culling. Setting annotations",
+			instance.Namespace, instance.Name))
+
+		if err := r.cullTheia(ctx, instance, ss, culler.STOP_REASON_CULLED, idleCullMessage(idleTime)); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if podFound && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		// The Pod is either too fresh, or the idle time has passed and it has
+		// received traffic. In this case we will be periodically checking if
+		// it needs culling.
+		return requeueBefore(ctrl.Result{RequeueAfter: requeueTime(instance)}, rotateCredentialsIn), nil
+	} else if culler.StopAnnotationIsSet(instance.ObjectMeta) && culler.CulledDeletionIsEnabled() {
+		// Periodically check if the retention of the stopped Theia has elapsed
+		return requeueBefore(ctrl.Result{RequeueAfter: culler.GetRequeueTime()}, rotateCredentialsIn), nil
+	}
+
+	// Rotate the credentials on time
+	return requeueBefore(ctrl.Result{}, rotateCredentialsIn), nil
+}
+
+// requeueBefore caps the requeue of the result to after, unless after is zero.
+func requeueBefore(result ctrl.Result, after time.Duration) ctrl.Result {
+	if after > 0 && (result.RequeueAfter == 0 || after < result.RequeueAfter) {
+		result.RequeueAfter = after
+	}
+	return result
+}
+
+// cullTheia stops the idle or expired Theia for reason, and reports it with
+// message. The git workspace is committed first when ENABLE_GIT_COMMIT_ON_CULL
+// is set, and a failed commit is only reported, so that an unreachable Theia is
+// still culled.
+func (r *TheiaReconciler) cullTheia(ctx context.Context, instance *v1alpha1.Theia, ss *appsv1.StatefulSet, reason string, message string) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	if culler.GitCommitOnCullIsEnabled() && instance.Spec.GitRepo != nil {
+		if err := culler.CommitWorkspace(instance.Name, instance.Namespace); err != nil {
+			log.Error(err, "unable to commit the workspace")
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Unable to commit the workspace before culling: %v", err)
+		}
+	}
+
+	// Set annotations to the Theia
+	culler.SetStopAnnotation(&instance.ObjectMeta, r.Metrics)
+	instance.Annotations[culler.STOP_REASON_ANNOTATION] = reason
+	if snapshotOnCullIsEnabled() {
+		if err := r.snapshotWorkspace(ctx, instance, ss); err != nil {
+			log.Error(err, "unable to snapshot the workspace")
+			return err
+		}
+	}
+	if err := r.Update(ctx, instance); err != nil {
+		return err
+	}
+	r.EventRecorder.Event(instance, corev1.EventTypeNormal, EventReasonCulled, message)
+	lifecycle.Notify(lifecycle.Culled, instance.ObjectMeta)
+	return nil
+}
+
+// idleCullMessage tells the user why the Theia was culled.
+func idleCullMessage(idleTime time.Duration) string {
+	return fmt.Sprintf("Stopped the Theia after it was idle for more than %s", idleTime)
+}
+
+// theiaIsServing returns true once the Theia container is running, as last
+// reported in the status of the Theia.
+func theiaIsServing(instance *v1alpha1.Theia) bool {
+	return instance.Status.ContainerState.Running != nil
+}
+
+// requeueTime returns when to check again if the running Theia needs culling:
+// after the culling check period, or once its TTL expires or its activity is
+// polled again if that comes first.
+func requeueTime(instance *v1alpha1.Theia) time.Duration {
+	requeue := culler.GetRequeueTime()
+	if period := culler.GetActivityCheckPeriod(); culler.ActivityAnnotationIsEnabled() && period < requeue {
+		requeue = period
+	}
+	if remaining, ok := culler.TTLRemaining(instance.ObjectMeta); ok && remaining > 0 && remaining < requeue {
+		return remaining
+	}
+	return requeue
+}
+
+// syncStopAnnotation sets the stop annotation of a Theia whose spec.stopped is
+// true, so that the culler and the status see it as stopped, and removes the
+// annotation set this way once spec.stopped is false again. The annotation of a
+// Theia stopped by the culler or the user is kept, but the stop reason left
+// behind by a resume removing the stop annotation directly is dropped, for it
+// not to be reported for the next stop. Returns true if the annotations
+// changed.
+func syncStopAnnotation(instance *v1alpha1.Theia) bool {
+	changed := false
+	if _, ok := instance.Annotations[culler.STOP_REASON_ANNOTATION]; ok && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		delete(instance.Annotations, culler.STOP_REASON_ANNOTATION)
+		changed = true
+	}
+	reason := instance.Annotations[culler.STOP_REASON_ANNOTATION]
+	if !instance.Spec.Stopped {
+		if reason != culler.STOP_REASON_SPEC {
+			return changed
+		}
+		culler.RemoveStopAnnotation(&instance.ObjectMeta)
+		return true
+	}
+	if culler.StopAnnotationIsSet(instance.ObjectMeta) && reason == culler.STOP_REASON_SPEC {
+		return false
+	}
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	if !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		instance.Annotations[culler.STOP_ANNOTATION] = time.Now().Format(time.RFC3339)
+	}
+	instance.Annotations[culler.STOP_REASON_ANNOTATION] = culler.STOP_REASON_SPEC
+	return true
+}
+
+// maxIdleTime returns how long the Theia may be idle before it is culled, from
+// its culling policy or the default of the culler.
+func maxIdleTime(instance *v1alpha1.Theia) time.Duration {
+	if policy := instance.Spec.CullingPolicy; policy != nil && policy.IdleTimeMinutes != nil {
+		return time.Duration(*policy.IdleTimeMinutes) * time.Minute
+	}
+	return culler.GetMaxIdleTime()
+}
+
+// namespaceIsTerminating returns true if the namespace is being deleted, unless
+// SKIP_TERMINATING_NAMESPACES is set to anything else than "true".
+func (r *TheiaReconciler) namespaceIsTerminating(ctx context.Context, name string) (bool, error) {
+	if value, exists := os.LookupEnv("SKIP_TERMINATING_NAMESPACES"); exists && value != "true" {
+		return false, nil
+	}
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return false, ignoreNotFound(err)
+	}
+	return namespace.Status.Phase == corev1.NamespaceTerminating, nil
+}
+
+// workspaceClaimName returns the name of the PVC created by the StatefulSet for
+// the Theia workspace, or the PVC of the workspace volume when there is no claim
+// template. An empty string is returned if the workspace isn't a PVC.
+func (r *TheiaReconciler) workspaceClaimName(ctx context.Context, instance *v1alpha1.Theia, ss *appsv1.StatefulSet) (string, error) {
+	if len(ss.Spec.VolumeClaimTemplates) == 0 {
+		for _, volume := range ss.Spec.Template.Spec.Volumes {
+			if volume.Name == workspaceVolumeName(instance) && volume.PersistentVolumeClaim != nil {
+				return volume.PersistentVolumeClaim.ClaimName, nil
+			}
+		}
+		return "", nil
+	}
+	return r.templateClaimName(ctx, ss)
+}
+
+// templateClaimName returns the name of the PVC created by the StatefulSet from
+// its claim template for the pod of the lowest ordinal, or an empty string if
+// it has no claim template. The ordinal is the one of the pods, or of the PVCs
+// which outlive them, and 0 if there are neither yet.
+func (r *TheiaReconciler) templateClaimName(ctx context.Context, ss *appsv1.StatefulSet) (string, error) {
+	if len(ss.Spec.VolumeClaimTemplates) == 0 {
+		return "", nil
+	}
+	prefix := fmt.Sprintf("%s-%s-", ss.Spec.VolumeClaimTemplates[0].Name, ss.Name)
+	pod, err := r.theiaPod(ctx, ss)
+	if err != nil {
+		return "", err
+	}
+	if pod != nil {
+		ordinal, _ := podOrdinal(pod.Name, ss.Name+"-")
+		return prefix + strconv.Itoa(ordinal), nil
+	}
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(ss.Namespace)); err != nil {
+		return "", err
+	}
+	lowest := -1
+	for _, pvc := range pvcs.Items {
+		if ordinal, ok := podOrdinal(pvc.Name, prefix); ok && (lowest < 0 || ordinal < lowest) {
+			lowest = ordinal
+		}
+	}
+	if lowest < 0 {
+		lowest = 0
+	}
+	return prefix + strconv.Itoa(lowest), nil
+}
+
+// deleteCulled deletes a Theia which has been stopped for longer than the
+// retention time. The workspace PVC isn't owned by the StatefulSet, so it is
+// deleted explicitly to reclaim the storage, once archived if enabled. Only the
+// PVCs created for the Theia are deleted, never one the user mounted: the PVC
+// of the claim template, or the PVC a migration created and the source PVC it
+// kept.
+func (r *TheiaReconciler) deleteCulled(ctx context.Context, instance *v1alpha1.Theia, ss *appsv1.StatefulSet) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	var claims []string
+	if claim := instance.Annotations[WorkspaceClaimAnnotation]; claim != "" {
+		claims = append(claims, claim)
+		if migration := instance.Status.Migration; migration != nil && migration.SourceClaim != "" {
+			claims = append(claims, migration.SourceClaim)
+		}
+	} else if existingClaim(instance) == "" {
+		pvcName, err := r.templateClaimName(ctx, ss)
+		if err != nil {
+			return err
+		}
+		if pvcName != "" {
+			claims = append(claims, pvcName)
+		}
+	}
+	if len(claims) > 0 && archiveIsEnabled() {
+		if archived, err := r.archiveWorkspace(ctx, instance, claims[0]); err != nil || !archived {
+			return err
+		}
+	}
+
+	log.Info("Deleting culled Theia", "namespace", instance.Namespace, "name", instance.Name,
+		"stopped", instance.Annotations[culler.STOP_ANNOTATION])
+	r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonRetentionElapsed,
+		"Theia stopped since %s is deleted together with its workspace", instance.Annotations[culler.STOP_ANNOTATION])
+
+	for _, pvcName := range claims {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: pvcName, Namespace: ss.Namespace},
+		}
+		if err := r.Delete(ctx, pvc); ignoreNotFound(err) != nil {
+			log.Error(err, "unable to delete PersistentVolumeClaim")
+			return err
+		}
+	}
+	return ignoreNotFound(r.Delete(ctx, instance))
+}
+
+// boundVolume returns the name and storage capacity of the PVC created by the
+// StatefulSet for the Theia workspace. Empty strings are returned until the
+// PVC is bound.
+func (r *TheiaReconciler) boundVolume(ctx context.Context, instance *v1alpha1.Theia, ss *appsv1.StatefulSet) (string, string, error) {
+	pvcName, err := r.workspaceClaimName(ctx, instance, ss)
+	if pvcName == "" || err != nil {
+		return "", "", err
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	err = r.Get(ctx, types.NamespacedName{Name: pvcName, Namespace: ss.Namespace}, pvc)
+	if err != nil {
+		return "", "", ignoreNotFound(err)
+	}
+	if pvc.Status.Phase != corev1.ClaimBound {
+		return "", "", nil
+	}
+	capacity := ""
+	if storage, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		capacity = storage.String()
+	}
+	return pvc.Name, capacity, nil
+}
+
+// copyStatefulSetFields copies the owned fields from one StatefulSet to another
+// like reconcilehelper.CopyStatefulSetFields, and the pod template metadata on
+// top of it. Returns true if the fields copied from don't match to.
+func copyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
+	// reconcilehelper only notices the labels and annotations removed from to
+	requireUpdate := !apiequality.Semantic.DeepEqual(from.Labels, to.Labels) ||
+		!apiequality.Semantic.DeepEqual(from.Annotations, to.Annotations)
+	requireUpdate = reconcilehelper.CopyStatefulSetFields(from, to) || requireUpdate
+	if !apiequality.Semantic.DeepEqual(from.Spec.Template.Labels, to.Spec.Template.Labels) {
+		requireUpdate = true
+	}
+	to.Spec.Template.Labels = from.Spec.Template.Labels
+
+	if !apiequality.Semantic.DeepEqual(from.Spec.Template.Annotations, to.Spec.Template.Annotations) {
+		requireUpdate = true
+	}
+	to.Spec.Template.Annotations = from.Spec.Template.Annotations
+
+	return requireUpdate
+}
+
+// copyServiceFields copies the owned fields from one Service to another like
+// reconcilehelper.CopyServiceFields, and publishNotReadyAddresses on top of it.
+// The ports added to the Service by hand are kept when PRESERVE_SERVICE_PORTS
+// is set to "true". Returns true if the fields copied from don't match to.
+func copyServiceFields(from, to *corev1.Service) bool {
+	if os.Getenv("PRESERVE_SERVICE_PORTS") == "true" {
+		from = from.DeepCopy()
+		from.Spec.Ports = append(from.Spec.Ports, unmanagedServicePorts(from, to)...)
+	}
+	if from.Spec.Type == to.Spec.Type && from.Spec.Type != corev1.ServiceTypeClusterIP {
+		from = from.DeepCopy()
+		keepAllocatedNodePorts(from, to)
+	}
+	// reconcilehelper only notices the labels and annotations removed from to
+	requireUpdate := !apiequality.Semantic.DeepEqual(from.Labels, to.Labels) ||
+		!apiequality.Semantic.DeepEqual(from.Annotations, to.Annotations)
+	requireUpdate = reconcilehelper.CopyServiceFields(from, to) || requireUpdate
+	if from.Spec.Type != to.Spec.Type ||
+		!apiequality.Semantic.DeepEqual(from.Spec.LoadBalancerSourceRanges, to.Spec.LoadBalancerSourceRanges) {
+		requireUpdate = true
+	}
+	to.Spec.Type = from.Spec.Type
+	to.Spec.LoadBalancerSourceRanges = from.Spec.LoadBalancerSourceRanges
+	if from.Spec.PublishNotReadyAddresses != to.Spec.PublishNotReadyAddresses {
+		requireUpdate = true
+	}
+	to.Spec.PublishNotReadyAddresses = from.Spec.PublishNotReadyAddresses
+	return requireUpdate
+}
+
+// keepAllocatedNodePorts sets the node ports the cluster allocated to the
+// Service to on the ports of the Service from without a fixed node port, so
+// that they aren't reallocated on every update.
+func keepAllocatedNodePorts(from, to *corev1.Service) {
+	for i := range from.Spec.Ports {
+		port := &from.Spec.Ports[i]
+		if port.NodePort != 0 {
+			continue
+		}
+		for _, existing := range to.Spec.Ports {
+			if existing.Name == port.Name {
+				port.NodePort = existing.NodePort
+				break
+			}
+		}
+	}
+}
+
+// serviceType returns the type of the Service of the Theia, ClusterIP unless
+// set in its spec.
+func serviceType(instance *v1alpha1.Theia) corev1.ServiceType {
+	if instance.Spec.ServiceType == "" {
+		return corev1.ServiceTypeClusterIP
+	}
+	return instance.Spec.ServiceType
+}
+
+// unmanagedServicePorts returns the ports of `to` whose name and port don't
+// clash with the ports of `from`, i.e. those the controller didn't create.
+func unmanagedServicePorts(from, to *corev1.Service) []corev1.ServicePort {
+	ports := []corev1.ServicePort{}
+	for _, port := range to.Spec.Ports {
+		managed := false
+		for _, managedPort := range from.Spec.Ports {
+			if port.Name == managedPort.Name || port.Port == managedPort.Port {
+				managed = true
+				break
+			}
+		}
+		if !managed {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// mergeMaps returns the union of the maps, the later ones winning, or nil if
+// they are all empty.
+func mergeMaps(maps ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, m := range maps {
+		for k, v := range m {
+			if merged == nil {
+				merged = map[string]string{}
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// adoptResource sets the Theia as the controller of an existing resource
+// without any, e.g. one created by hand before the Theia, unless
+// ADOPT_RESOURCES is set to anything else than "true". Returns true if the
+// resource was adopted, or why it is left alone when another owner controls it.
+func (r *TheiaReconciler) adoptResource(instance *v1alpha1.Theia, object metav1.Object) (bool, string, error) {
+	owner := metav1.GetControllerOf(object)
+	if owner == nil {
+		if value, exists := os.LookupEnv("ADOPT_RESOURCES"); exists && value != "true" {
+			return false, "", nil
+		}
+		if err := ctrl.SetControllerReference(instance, object, r.Scheme); err != nil {
+			return false, "", err
+		}
+		return true, "", nil
+	}
+	if owner.Kind != "Theia" || owner.Name != instance.Name || owner.UID != instance.UID {
+		return false, fmt.Sprintf("%s is controlled by %s %s, not updating it",
+			object.GetName(), owner.Kind, owner.Name), nil
+	}
+	return false, "", nil
+}
+
+// immutableFieldChanged returns the path of the first immutable field which
+// differs between the desired and the existing StatefulSet, or an empty string
+// if the StatefulSet can be updated in place.
+func immutableFieldChanged(from, to *appsv1.StatefulSet) string {
+	if from.Spec.ServiceName != to.Spec.ServiceName {
+		return "spec.serviceName"
+	}
+	if from.Spec.Selector != nil && to.Spec.Selector != nil &&
+		!apiequality.Semantic.DeepEqual(from.Spec.Selector.MatchLabels, to.Spec.Selector.MatchLabels) {
+		return "spec.selector"
+	}
+	if len(from.Spec.VolumeClaimTemplates) != len(to.Spec.VolumeClaimTemplates) {
+		return "spec.volumeClaimTemplates"
+	}
+	for i := range from.Spec.VolumeClaimTemplates {
+		fromClaim, toClaim := from.Spec.VolumeClaimTemplates[i], to.Spec.VolumeClaimTemplates[i]
+		if fromClaim.Name != toClaim.Name ||
+			!apiequality.Semantic.DeepEqual(fromClaim.Spec.StorageClassName, toClaim.Spec.StorageClassName) ||
+			!apiequality.Semantic.DeepEqual(fromClaim.Spec.AccessModes, toClaim.Spec.AccessModes) ||
+			!apiequality.Semantic.DeepEqual(fromClaim.Spec.Resources, toClaim.Spec.Resources) {
+			return "spec.volumeClaimTemplates"
+		}
+	}
+	return ""
+}
+
+// scaleDownRejected scales down the StatefulSet of a Theia which started
+// violating the policies, e.g. by becoming privileged, so that its pod doesn't
+// keep running. It is scaled up again once the Theia is valid.
+func (r *TheiaReconciler) scaleDownRejected(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	ss := &appsv1.StatefulSet{}
+	err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, ss)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(ss, instance) || (ss.Spec.Replicas != nil && *ss.Spec.Replicas == 0) {
+		return nil
+	}
+	log.Info("Scaling down rejected Theia", "namespace", ss.Namespace, "name", ss.Name)
+	replicas := int32(0)
+	ss.Spec.Replicas = &replicas
+	if err := r.Update(ctx, ss); err != nil {
+		return err
+	}
+	r.Metrics.SetTheiaRunning(instance.Namespace, instance.Name, false)
+	return nil
+}
+
+// setFailedCondition records why the controller can't reconcile the Theia as
+// its latest condition.
+func (r *TheiaReconciler) setFailedCondition(ctx context.Context, instance *v1alpha1.Theia, reason string, message string) error {
+	return r.setCondition(ctx, instance, "Failed", reason, message)
+}
+
+// setCondition prepends a condition to the status of the Theia unless it is
+// already the latest one.
+func (r *TheiaReconciler) setCondition(ctx context.Context, instance *v1alpha1.Theia, conditionType string, reason string, message string) error {
+	oldConditions := instance.Status.Conditions
+	if len(oldConditions) > 0 && oldConditions[0].Type == conditionType &&
+		oldConditions[0].Reason == reason && oldConditions[0].Message == message {
+		return nil
+	}
+	instance.Status.Conditions = append([]v1alpha1.TheiaCondition{{
+		Type:          conditionType,
+		LastProbeTime: metav1.Now(),
+		Reason:        reason,
+		Message:       message,
+	}}, oldConditions...)
+	instance.Status.Phase = getPhase(instance)
+	return r.updateStatus(ctx, instance)
+}
+
+// quotaExceeded records why the pod of the Theia isn't started, and checks
+// again later.
+func (r *TheiaReconciler) quotaExceeded(ctx context.Context, instance *v1alpha1.Theia, exceeded string) (ctrl.Result, error) {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	log.Info("Quota exceeded", "namespace", instance.Namespace, "name", instance.Name, "reason", exceeded)
+	r.EventRecorder.Event(instance, corev1.EventTypeWarning, QuotaExceeded, exceeded)
+	if err := r.setCondition(ctx, instance, QuotaExceeded, QuotaExceeded, exceeded); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: culler.GetRequeueTime()}, nil
+}
+
+// generationSkewIsReported returns true unless REPORT_GENERATION_SKEW is set to
+// anything else than "true"
+func generationSkewIsReported() bool {
+	value, exists := os.LookupEnv("REPORT_GENERATION_SKEW")
+	return !exists || value == "true"
+}
+
+// generationSkew describes the lag of the observedGeneration of the StatefulSet
+// behind its generation, i.e. a change its controller hasn't processed yet.
+func generationSkew(ss *appsv1.StatefulSet) (string, bool) {
+	if ss.Status.ObservedGeneration >= ss.Generation {
+		return "", false
+	}
+	return fmt.Sprintf("Waiting for StatefulSet %s to observe generation %d (observed %d)",
+		ss.Name, ss.Generation, ss.Status.ObservedGeneration), true
+}
+
+// removeConditions removes the conditions of conditionType from the status of
+// the Theia. Returns true if any was removed.
+func removeConditions(instance *v1alpha1.Theia, conditionType string) bool {
+	conditions := []v1alpha1.TheiaCondition{}
+	for _, condition := range instance.Status.Conditions {
+		if condition.Type != conditionType {
+			conditions = append(conditions, condition)
+		}
+	}
+	if len(conditions) == len(instance.Status.Conditions) {
+		return false
+	}
+	instance.Status.Conditions = conditions
+	return true
+}
+
+// theiaPod returns the pod of the StatefulSet with the lowest ordinal, which
+// isn't necessarily 0, or nil if the StatefulSet has no pod yet.
+func (r *TheiaReconciler) theiaPod(ctx context.Context, ss *appsv1.StatefulSet) (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ss.Namespace), client.MatchingLabels{"statefulset": ss.Name}); err != nil {
+		return nil, err
+	}
+	var pod *corev1.Pod
+	lowest := -1
+	for i := range pods.Items {
+		if ordinal, ok := podOrdinal(pods.Items[i].Name, ss.Name+"-"); ok && (lowest < 0 || ordinal < lowest) {
+			pod, lowest = &pods.Items[i], ordinal
+		}
+	}
+	return pod, nil
+}
+
+// podOrdinal returns the ordinal suffixing the name of a pod of a StatefulSet,
+// or of one of its PVCs, after prefix. Returns false if the name has none.
+func podOrdinal(name, prefix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return ordinal, true
+}
+
+// podUnschedulable returns the message of the PodScheduled condition if the
+// scheduler reported that the pod can't be scheduled.
+func podUnschedulable(pod *corev1.Pod) (string, bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == corev1.PodReasonUnschedulable {
+			return condition.Message, true
+		}
+	}
+	return "", false
+}
+
+// failedWaitingReasons are the reasons of a waiting container which won't
+// recover without a change to the Theia
+var failedWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+}
+
+// getPhase derives the phase of the Theia from its deletion, the stop
+// annotation, the latest condition and the readiness of the StatefulSet.
+func getPhase(instance *v1alpha1.Theia) v1alpha1.TheiaPhase {
+	if instance.DeletionTimestamp != nil {
+		return v1alpha1.TheiaTerminating
+	}
+	if culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		return v1alpha1.TheiaStopped
+	}
+	if conditions := instance.Status.Conditions; len(conditions) > 0 {
+		if conditions[0].Type == "Terminated" || conditions[0].Type == "Failed" ||
+			(conditions[0].Type == "Waiting" && failedWaitingReasons[conditions[0].Reason]) {
+			return v1alpha1.TheiaError
+		}
+	}
+	if instance.Status.ReadyReplicas > 0 {
+		return v1alpha1.TheiaRunning
+	}
+	return v1alpha1.TheiaProvisioning
+}
+
+// crashLoopBackOffMessage describes how long the kubelet waits before restarting
+// a container in CrashLoopBackOff, and when it is restarted. The kubelet doubles
+// the backoff from 10s with each restart, up to 5m, from the last termination.
+func crashLoopBackOffMessage(status corev1.ContainerStatus) (string, bool) {
+	waiting := status.State.Waiting
+	terminated := status.LastTerminationState.Terminated
+	if waiting == nil || waiting.Reason != "CrashLoopBackOff" || terminated == nil {
+		return "", false
+	}
+	backoff := 10 * time.Second
+	for i := int32(1); i < status.RestartCount && backoff < 5*time.Minute; i++ {
+		backoff *= 2
+	}
+	if backoff > 5*time.Minute {
+		backoff = 5 * time.Minute
+	}
+	nextRestart := terminated.FinishedAt.Add(backoff)
+	return fmt.Sprintf("Back-off %s restarting the container after %d restarts, next restart at %s (last exit code %d: %s)",
+		backoff, status.RestartCount, nextRestart.UTC().Format(time.RFC3339), terminated.ExitCode, terminated.Reason), true
+}
+
+func getNextCondition(cs corev1.ContainerState) v1alpha1.TheiaCondition {
+	var nbtype = ""
+	var nbreason = ""
+	var nbmsg = ""
+
+	if cs.Running != nil {
+		nbtype = "Running"
+	} else if cs.Waiting != nil {
+		nbtype = "Waiting"
+		nbreason = cs.Waiting.Reason
+		nbmsg = cs.Waiting.Message
+	} else {
+		nbtype = "Terminated"
+		nbreason = cs.Terminated.Reason
+		nbmsg = cs.Terminated.Reason
+	}
+
+	newCondition := v1alpha1.TheiaCondition{
+		Type:          nbtype,
+		LastProbeTime: metav1.Now(),
+		Reason:        nbreason,
+		Message:       nbmsg,
+	}
+	return newCondition
+}
+
+// desiredReplicas returns the replicas of the StatefulSet of the Theia. A
+// stopped Theia always has none, whatever its spec.replicas, so that the culler
+// and spec.replicas never undo each other; spec.replicas applies again once the
+// Theia is resumed.
+func desiredReplicas(instance *v1alpha1.Theia) int32 {
+	if instance.Spec.Stopped || culler.StopAnnotationIsSet(instance.ObjectMeta) || migrationInProgress(instance) {
+		return 0
+	}
+	if instance.Spec.Replicas != nil {
+		return *instance.Spec.Replicas
+	}
+	return 1
+}
+
+func generateStatefulSet(instance *v1alpha1.Theia) *appsv1.StatefulSet {
+	replicas := desiredReplicas(instance)
+
+	volumeName := workspaceVolumeName(instance)
+	volumeClaimTemplates := []corev1.PersistentVolumeClaim{}
+	workspaceClaim := instance.Annotations[WorkspaceClaimAnnotation]
+	if claim := existingClaim(instance); claim != "" {
+		workspaceClaim = claim
+	}
+	if instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName != nil && workspaceClaim == "" {
+		volumeClaimTemplates = append(
+			volumeClaimTemplates,
+			corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: volumeName},
+				Spec:       instance.Spec.Template.PersistentVolumeClaimSpec,
+			},
+		)
+	}
+
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        instance.Name,
+			Namespace:   instance.Namespace,
+			Labels:      mergeMaps(instance.Spec.StatefulSetLabels),
+			Annotations: mergeMaps(instance.Spec.StatefulSetAnnotations),
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"statefulset": instance.Name,
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"statefulset": instance.Name,
+						"theia-name":  instance.Name,
+						"app":         "theia.e2.fyi",
+						"version":     "v1alpha1",
+					},
+					Annotations: map[string]string{},
+				},
+				// copy the pod spec so that the Theia isn't mutated
+				Spec: *instance.Spec.Template.Spec.DeepCopy(),
+			},
+			VolumeClaimTemplates: volumeClaimTemplates,
+		},
+	}
+	if os.Getenv("USE_HEADLESS_SERVICE") == "true" {
+		ss.Spec.ServiceName = headlessServiceName(instance.Name)
+	}
+	// copy the pod template annotations so that the Theia isn't mutated
+	annotations := ss.Spec.Template.ObjectMeta.Annotations
+	for k, v := range instance.Spec.Template.ObjectMeta.Annotations {
+		annotations[k] = v
+	}
+	// copy all of the Theia labels to the pod including poddefault related labels
+	l := &ss.Spec.Template.ObjectMeta.Labels
+	for k, v := range instance.ObjectMeta.Labels {
+		(*l)[k] = v
+	}
+
+	podSpec := &ss.Spec.Template.Spec
+	container := &podSpec.Containers[theiaContainerIndex(instance, podSpec)]
+	defaultTheiaContainer(instance, podSpec)
+	if len(container.Resources.Requests) == 0 && len(container.Resources.Limits) == 0 {
+		container.Resources = defaultResources()
+	}
+	setEnv(container, corev1.EnvVar{
+		Name:  "THEIA_NAME",
+		Value: instance.Name,
+	})
+	setEnv(container, corev1.EnvVar{
+		Name:  "THEIA_PREFIX",
+		Value: "/theia/" + instance.Namespace + "/" + instance.Name,
+	})
+	setEnv(container, corev1.EnvVar{
+		Name:  "NAMESPACE",
+		Value: instance.Namespace,
+	})
+	if value, exists := os.LookupEnv("ADD_DOWNWARD_API_ENV"); !exists || value == "true" {
+		setEnv(container, downwardAPIEnv("POD_NAME", "metadata.name"))
+		setEnv(container, downwardAPIEnv("POD_IP", "status.podIP"))
+		setEnv(container, downwardAPIEnv("NODE_NAME", "spec.nodeName"))
+	}
+	container.Env = append(container.Env, proxyEnv(container)...)
+	container.EnvFrom = append(container.EnvFrom, instance.Spec.EnvFrom...)
+	// A block workspace is attached by its volume device instead
+	if !blockWorkspace(instance) {
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{Name: volumeName, MountPath: workspaceVolumeMountPath(instance)})
+	}
+	container.VolumeDevices = append(container.VolumeDevices, instance.Spec.Template.VolumeDevices...)
+	// The probes are opt-in, so that enabling them doesn't restart every Theia
+	if probes := instance.Spec.Probes; probes == nil || !probes.Disabled {
+		port := int32(DefaultContainerPort)
+		if len(container.Ports) > 0 {
+			port = container.Ports[0].ContainerPort
+		}
+		requested := probes != nil
+		if (requested || os.Getenv("ADD_READINESS_PROBE") == "true") && container.ReadinessProbe == nil {
+			container.ReadinessProbe = generateReadinessProbe(port, probePath(instance))
+		}
+		if (requested || os.Getenv("ADD_LIVENESS_PROBE") == "true") && container.LivenessProbe == nil {
+			container.LivenessProbe = generateLivenessProbe(port, probePath(instance))
+		}
+	}
+	if procMount := instance.Spec.Template.ProcMount; procMount != nil {
+		if container.SecurityContext == nil {
+			container.SecurityContext = &corev1.SecurityContext{}
+		}
+		container.SecurityContext.ProcMount = procMount
+	}
+	if value, exists := os.LookupEnv("DISABLE_PRIVILEGE_ESCALATION"); !exists || value == "true" {
+		disablePrivilegeEscalation(container)
+	}
+	if instance.Spec.Credentials != nil {
+		addCredentials(instance, podSpec, container)
+	}
+	if extensionsAreEnabled() {
+		addExtensions(instance, podSpec, container)
+	}
+	podSpec.ImagePullSecrets = append(podSpec.ImagePullSecrets, imagePullSecrets(instance)...)
+	if usesOwnServiceAccount(instance) {
+		podSpec.ServiceAccountName = serviceAccountName(instance.Name)
+	}
+	addScheduling(instance, podSpec)
+	if instance.Spec.GitRepo != nil {
+		podSpec.InitContainers = append(podSpec.InitContainers,
+			generateGitCloneContainer(instance.Spec.GitRepo, volumeName, workspaceMountPath(container, volumeName)))
+	}
+	if profile := seccompProfile(instance); profile != "" {
+		annotations[corev1.SeccompContainerAnnotationKeyPrefix+container.Name] = profile
+	}
+	if bandwidth := instance.Spec.NetworkBandwidth; bandwidth != nil {
+		if bandwidth.Ingress != nil {
+			annotations[IngressBandwidthAnnotation] = bandwidth.Ingress.String()
+		}
+		if bandwidth.Egress != nil {
+			annotations[EgressBandwidthAnnotation] = bandwidth.Egress.String()
+		}
+	}
+	if workspaceClaim != "" && !hasVolume(podSpec, volumeName) {
+		// mount the existing PVC or the workspace migrated to another storage class
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: workspaceClaim},
+			},
+		})
+	}
+	if len(volumeClaimTemplates) == 0 && !hasVolume(podSpec, volumeName) {
+		podSpec.Volumes = append(podSpec.Volumes, generateWorkspaceEmptyDir(volumeName))
+	}
+	if ratio := limitsToRequestsRatio(); ratio > 0 {
+		for i := range podSpec.Containers {
+			deriveLimits(&podSpec.Containers[i].Resources, ratio)
+		}
+	}
+	if culler.ActivitySidecarIsEnabled() {
+		addActivitySidecar(podSpec, theiaContainerIndex(instance, podSpec))
+	}
+	// don't let the kubelet kill the containers before their preStop hooks are done
+	if timeout := preStopTimeout(instance); timeout > 0 && hasPreStopHook(podSpec) {
+		gracePeriod := int64(corev1.DefaultTerminationGracePeriodSeconds)
+		if podSpec.TerminationGracePeriodSeconds != nil {
+			gracePeriod = *podSpec.TerminationGracePeriodSeconds
+		}
+		if gracePeriod < timeout {
+			podSpec.TerminationGracePeriodSeconds = &timeout
+		}
+	}
+
+	// For some platforms (like OpenShift), adding fsGroup: 100 is troublesome.
+	// This allows for those platforms to bypass the automatic addition of the fsGroup
+	// and will allow for the Pod Security Policy controller to make an appropriate choice
+	// https://github.com/kubernetes-sigs/controller-runtime/issues/4617
+	// The fsGroup is added whenever it is unset, keeping the other fields of a
+	// user provided security context (runAsUser, runAsNonRoot, ...) as they are.
+	// A fsGroup set by the security context of the pod template is never
+	// overwritten, not even by spec.fsGroup, which is applied regardless of
+	// ADD_FSGROUP as it is explicitly requested.
+	fsGroup := instance.Spec.FSGroup
+	if value, exists := os.LookupEnv("ADD_FSGROUP"); fsGroup == nil && (!exists || value == "true") {
+		defaultFSGroup := DefaultFSGroup
+		fsGroup = &defaultFSGroup
+	}
+	if fsGroup != nil {
+		if podSpec.SecurityContext == nil {
+			podSpec.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		if podSpec.SecurityContext.FSGroup == nil {
+			group := *fsGroup
+			podSpec.SecurityContext.FSGroup = &group
+		}
+	}
+	return ss
+}
+
+func downwardAPIEnv(name string, fieldPath string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath},
+		},
+	}
+}
+
+// proxyEnv returns the proxy env vars configured for the workspaces with the
+// DEFAULT_HTTP_PROXY, DEFAULT_HTTPS_PROXY and DEFAULT_NO_PROXY env vars. The env
+// vars already set on the container are kept.
+func proxyEnv(container *corev1.Container) []corev1.EnvVar {
+	env := []corev1.EnvVar{}
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		value := os.Getenv("DEFAULT_" + name)
+		if value == "" || hasEnv(container, name) {
+			continue
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	return env
+}
+
+// setEnv sets env in the container, replacing the variables of the same name
+// of the pod template, as only one of them would be honored.
+func setEnv(container *corev1.Container, env corev1.EnvVar) {
+	vars := []corev1.EnvVar{}
+	for _, existing := range container.Env {
+		if existing.Name != env.Name {
+			vars = append(vars, existing)
+		}
+	}
+	container.Env = append(vars, env)
+}
+
+func hasEnv(container *corev1.Container, name string) bool {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// theiaContainerIndex returns the index of the Theia container in podSpec: the
+// container named by the TheiaContainerAnnotation of the Theia, or else the one
+// named DefaultContainerName. The first container is assumed to be the Theia
+// container when there is no such container.
+func theiaContainerIndex(instance *v1alpha1.Theia, podSpec *corev1.PodSpec) int {
+	name := theiaContainerName(instance)
+	for i, container := range podSpec.Containers {
+		if container.Name == name {
+			return i
+		}
+	}
+	return 0
+}
+
+func theiaContainerName(instance *v1alpha1.Theia) string {
+	if name := instance.Annotations[TheiaContainerAnnotation]; name != "" {
+		return name
+	}
+	return DefaultContainerName
+}
+
+// theiaContainerStatus returns the status of the Theia container of the pod,
+// which may not be the first one once sidecars are injected. Returns false
+// until the kubelet reports the container statuses.
+func theiaContainerStatus(instance *v1alpha1.Theia, pod *corev1.Pod) (corev1.ContainerStatus, bool) {
+	podSpec := &instance.Spec.Template.Spec
+	name := podSpec.Containers[theiaContainerIndex(instance, podSpec)].Name
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == name {
+			return status, true
+		}
+	}
+	if len(pod.Status.ContainerStatuses) > 0 {
+		return pod.Status.ContainerStatuses[0], true
+	}
+	return corev1.ContainerStatus{}, false
+}
+
+// defaultTheiaContainer sets the image, the working dir and the ports of the
+// Theia container of podSpec when unset. It is applied to the Theia by the
+// defaulting webhook, and to the StatefulSet for the Theia admitted without it.
+func defaultTheiaContainer(instance *v1alpha1.Theia, podSpec *corev1.PodSpec) {
+	container := &podSpec.Containers[theiaContainerIndex(instance, podSpec)]
+	if container.Image == "" {
+		image, arch := defaultImage(instance)
+		container.Image = image
+		// run the image on the nodes of the architecture it is built for
+		if _, ok := podSpec.NodeSelector[corev1.LabelArchStable]; arch != "" && !ok {
+			if podSpec.NodeSelector == nil {
+				podSpec.NodeSelector = map[string]string{}
+			}
+			podSpec.NodeSelector[corev1.LabelArchStable] = arch
+		}
+	}
+	if container.WorkingDir == "" {
+		container.WorkingDir = DefaultWkDir
+	}
+	if len(container.Ports) == 0 {
+		container.Ports = []corev1.ContainerPort{
+			{
+				ContainerPort: DefaultContainerPort,
+				Name:          "theia-port",
+				Protocol:      "TCP",
+			},
+		}
+	}
+}
+
+// defaultImage returns the image of a Theia container without any, and the
+// architecture it is built for. The images of each architecture are set with
+// the ARCHITECTURE_IMAGES env var, e.g. "amd64=theiaide/theia:latest,arm64=...",
+// and DefaultImage is used without an image for the architecture of the Theia.
+func defaultImage(instance *v1alpha1.Theia) (string, string) {
+	arch := instance.Spec.Template.Architecture
+	if arch == "" {
+		arch = os.Getenv("DEFAULT_ARCHITECTURE")
+	}
+	if arch == "" {
+		return DefaultImage, ""
+	}
+	for _, item := range strings.Split(os.Getenv("ARCHITECTURE_IMAGES"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) == 2 && parts[0] == arch && parts[1] != "" {
+			return parts[1], arch
+		}
+	}
+	return DefaultImage, ""
+}
+
+// imagePullSecrets returns the pull secrets of the Theia, or the comma separated
+// names of the DEFAULT_IMAGE_PULL_SECRETS env var when it has none.
+func imagePullSecrets(instance *v1alpha1.Theia) []corev1.LocalObjectReference {
+	if len(instance.Spec.ImagePullSecrets) > 0 {
+		return instance.Spec.ImagePullSecrets
+	}
+	secrets := []corev1.LocalObjectReference{}
+	for _, name := range strings.Split(os.Getenv("DEFAULT_IMAGE_PULL_SECRETS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			secrets = append(secrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+	return secrets
+}
+
+// defaultResources returns the resources of a Theia container without any, from
+// the DEFAULT_CPU_REQUEST, DEFAULT_MEMORY_REQUEST, DEFAULT_CPU_LIMIT and
+// DEFAULT_MEMORY_LIMIT env vars. Invalid quantities are ignored.
+func defaultResources() corev1.ResourceRequirements {
+	resources := corev1.ResourceRequirements{}
+	defaults := []struct {
+		env  string
+		name corev1.ResourceName
+		list *corev1.ResourceList
+	}{
+		{"DEFAULT_CPU_REQUEST", corev1.ResourceCPU, &resources.Requests},
+		{"DEFAULT_MEMORY_REQUEST", corev1.ResourceMemory, &resources.Requests},
+		{"DEFAULT_CPU_LIMIT", corev1.ResourceCPU, &resources.Limits},
+		{"DEFAULT_MEMORY_LIMIT", corev1.ResourceMemory, &resources.Limits},
+	}
+	for _, d := range defaults {
+		quantity, err := resource.ParseQuantity(os.Getenv(d.env))
+		if err != nil {
+			continue
+		}
+		if *d.list == nil {
+			*d.list = corev1.ResourceList{}
+		}
+		(*d.list)[d.name] = quantity
+	}
+	return resources
+}
+
+// limitsToRequestsRatio returns the LIMITS_TO_REQUESTS_RATIO env var, or 0 if
+// the limits aren't derived from the requests.
+func limitsToRequestsRatio() float64 {
+	ratio, err := strconv.ParseFloat(os.Getenv("LIMITS_TO_REQUESTS_RATIO"), 64)
+	if err != nil || ratio < 1 {
+		return 0
+	}
+	return ratio
+}
+
+// deriveLimits sets the missing limits of the requested resources to the
+// ratio of the requests.
+func deriveLimits(resources *corev1.ResourceRequirements, ratio float64) {
+	for name, request := range resources.Requests {
+		if _, ok := resources.Limits[name]; ok {
+			continue
+		}
+		if resources.Limits == nil {
+			resources.Limits = corev1.ResourceList{}
+		}
+		limit := resource.NewMilliQuantity(int64(float64(request.MilliValue())*ratio), request.Format)
+		if name != corev1.ResourceCPU {
+			limit = resource.NewQuantity(int64(float64(request.Value())*ratio), request.Format)
+		}
+		resources.Limits[name] = *limit
+	}
+}
+
+// generateReadinessProbe generates the readiness probe of the Theia container
+// listening on port.
+func generateReadinessProbe(port int32, path string) *corev1.Probe {
+	return &corev1.Probe{
+		Handler:             generateProbeHandler(port, path),
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       10,
+	}
+}
 
-		// Set annotations to the Theia
-		culler.SetStopAnnotation(&instance.ObjectMeta, r.Metrics)
-		r.Metrics.TheiaCullingCount.WithLabelValues(instance.Namespace, instance.Name).Inc()
-		err = r.Update(ctx, instance)
-		if err != nil {
-			return ctrl.Result{}, err
-		}
-	} else if podFound && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
-		// The Pod is either too fresh, or the idle time has passed and it has
-		// received traffic. In this case we will be periodically checking if
-		// it needs culling.
-		return ctrl.Result{RequeueAfter: culler.GetRequeueTime()}, nil
+// generateLivenessProbe generates the probe restarting a hung Theia. It starts
+// later and tolerates more failures than the readiness probe, so that a slow
+// start isn't mistaken for a hung IDE.
+func generateLivenessProbe(port int32, path string) *corev1.Probe {
+	return &corev1.Probe{
+		Handler:             generateProbeHandler(port, path),
+		InitialDelaySeconds: 30,
+		PeriodSeconds:       20,
+		FailureThreshold:    6,
 	}
+}
 
-	return ctrl.Result{}, nil
+// generateProbeHandler generates the HTTP GET of path on port. The kubelet only
+// accepts a HTTP status from 200 to 399, so a TCP probe is used when
+// PROBE_SUCCESS_STATUS expects another status.
+func generateProbeHandler(port int32, path string) corev1.Handler {
+	status, err := strconv.Atoi(os.Getenv("PROBE_SUCCESS_STATUS"))
+	if err == nil && (status < 200 || status >= 400) {
+		return corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(int(port))}}
+	}
+	return corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: path, Port: intstr.FromInt(int(port))}}
 }
 
-func getNextCondition(cs corev1.ContainerState) v1alpha1.TheiaCondition {
-	var nbtype = ""
-	var nbreason = ""
-	var nbmsg = ""
+// probePath returns the HTTP path probed, from the Theia spec, or from the
+// READINESS_PROBE_PATH env var when unset.
+func probePath(instance *v1alpha1.Theia) string {
+	if probes := instance.Spec.Probes; probes != nil && probes.Path != "" {
+		return probes.Path
+	}
+	if path := os.Getenv("READINESS_PROBE_PATH"); path != "" {
+		return path
+	}
+	return "/"
+}
 
-	if cs.Running != nil {
-		nbtype = "Running"
-	} else if cs.Waiting != nil {
-		nbtype = "Waiting"
-		nbreason = cs.Waiting.Reason
-		nbmsg = cs.Waiting.Message
-	} else {
-		nbtype = "Terminated"
-		nbreason = cs.Terminated.Reason
-		nbmsg = cs.Terminated.Reason
+// preStopTimeout returns how long the preStop hooks may take in seconds, from
+// the Theia spec, or from the PRESTOP_TIMEOUT_SECONDS env var when unset.
+func preStopTimeout(instance *v1alpha1.Theia) int64 {
+	if timeout := instance.Spec.Template.PreStopTimeoutSeconds; timeout != nil {
+		return *timeout
 	}
+	timeout, err := strconv.ParseInt(os.Getenv("PRESTOP_TIMEOUT_SECONDS"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
 
-	newCondition := v1alpha1.TheiaCondition{
-		Type:          nbtype,
-		LastProbeTime: metav1.Now(),
-		Reason:        nbreason,
-		Message:       nbmsg,
+func hasPreStopHook(podSpec *corev1.PodSpec) bool {
+	for _, container := range podSpec.Containers {
+		if container.Lifecycle != nil && container.Lifecycle.PreStop != nil {
+			return true
+		}
 	}
-	return newCondition
+	return false
 }
 
-func generateStatefulSet(instance *v1alpha1.Theia) *appsv1.StatefulSet {
-	replicas := int32(1)
-	if culler.StopAnnotationIsSet(instance.ObjectMeta) {
-		replicas = 0
+// disablePrivilegeEscalation sets allowPrivilegeEscalation to false unless the
+// user set it. Privileged containers and containers with CAP_SYS_ADMIN are left
+// alone, as the API server refuses to disable the escalation for them.
+func disablePrivilegeEscalation(container *corev1.Container) {
+	sc := container.SecurityContext
+	if sc != nil {
+		if sc.AllowPrivilegeEscalation != nil || (sc.Privileged != nil && *sc.Privileged) {
+			return
+		}
+		if sc.Capabilities != nil {
+			for _, capability := range sc.Capabilities.Add {
+				if capability == "SYS_ADMIN" || capability == "CAP_SYS_ADMIN" {
+					return
+				}
+			}
+		}
 	}
+	if container.SecurityContext == nil {
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	allowPrivilegeEscalation := false
+	container.SecurityContext.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+}
 
-	volumeClaimTemplates := []corev1.PersistentVolumeClaim{}
-	if instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName != nil {
-		volumeClaimTemplates = append(
-			volumeClaimTemplates,
-			corev1.PersistentVolumeClaim{
-				ObjectMeta: metav1.ObjectMeta{Name: "theia"},
-				Spec:       instance.Spec.Template.PersistentVolumeClaimSpec,
-			},
-		)
+// seccompProfile returns the seccomp annotation value for the Theia container
+// from the Theia spec, or from the SECCOMP_PROFILE env var (e.g. RuntimeDefault)
+// when unset. An empty string is returned if no valid profile is configured,
+// an invalid SECCOMP_PROFILE being logged by logInvalidSettings.
+func seccompProfile(instance *v1alpha1.Theia) string {
+	profile := instance.Spec.Template.SeccompProfile
+	if profile == nil {
+		profile = &v1alpha1.SeccompProfile{Type: os.Getenv("SECCOMP_PROFILE")}
+	}
+	switch profile.Type {
+	case "RuntimeDefault":
+		return corev1.SeccompProfileRuntimeDefault
+	case "Unconfined":
+		return "unconfined"
+	case "Localhost":
+		if profile.LocalhostProfile != "" {
+			return "localhost/" + profile.LocalhostProfile
+		}
 	}
+	return ""
+}
 
-	ss := &appsv1.StatefulSet{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      instance.Name,
-			Namespace: instance.Namespace,
-		},
-		Spec: appsv1.StatefulSetSpec{
-			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"statefulset": instance.Name,
-				},
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"statefulset": instance.Name,
-						"theia-name":  instance.Name,
-						"app":         "theia.e2.fyi",
-						"version":     "v1alpha1",
-					},
-					Annotations: instance.Spec.Template.ObjectMeta.Annotations,
-				},
-				Spec: instance.Spec.Template.Spec,
-			},
-			VolumeClaimTemplates: volumeClaimTemplates,
-		},
+// generateGitCloneContainer generates the init container cloning the git repo
+// into the workspace volume mounted at mountPath.
+func generateGitCloneContainer(repo *v1alpha1.GitRepoSpec, volumeName string, mountPath string) corev1.Container {
+	image := os.Getenv("GIT_CLONE_IMAGE")
+	if image == "" {
+		image = DefaultGitCloneImage
 	}
-	// copy all of the Theia labels to the pod including poddefault related labels
-	l := &ss.Spec.Template.ObjectMeta.Labels
-	for k, v := range instance.ObjectMeta.Labels {
-		(*l)[k] = v
+	target := repo.Path
+	if target == "" {
+		target = strings.TrimSuffix(path.Base(repo.URL), ".git")
 	}
+	// keep the clone inside of the workspace
+	target = path.Join(mountPath, path.Clean("/"+target))
+	return corev1.Container{
+		Name:         "git-clone",
+		Image:        image,
+		Command:      []string{"sh", "-c", gitCloneScript, "git-clone"},
+		Args:         []string{repo.URL, target, repo.Ref},
+		VolumeMounts: []corev1.VolumeMount{{Name: volumeName, MountPath: mountPath}},
+	}
+}
 
-	podSpec := &ss.Spec.Template.Spec
-	container := &podSpec.Containers[0]
-	if container.Image == "" {
-		container.Image = DefaultImage
+// workspaceVolumeName returns the name of the workspace volume of the Theia
+func workspaceVolumeName(instance *v1alpha1.Theia) string {
+	if volume := instance.Spec.Volume; volume != nil && volume.Name != "" {
+		return volume.Name
 	}
-	if container.WorkingDir == "" {
-		container.WorkingDir = DefaultWkDir
+	return DefaultVolumeName
+}
+
+// workspaceVolumeMountPath returns where the workspace of the Theia is mounted
+func workspaceVolumeMountPath(instance *v1alpha1.Theia) string {
+	if volume := instance.Spec.Volume; volume != nil && volume.MountPath != "" {
+		return volume.MountPath
 	}
-	if container.Ports == nil {
-		container.Ports = []corev1.ContainerPort{
-			{
-				ContainerPort: DefaultContainerPort,
-				Name:          "theia-port",
-				Protocol:      "TCP",
-			},
+	return DefaultMountPath
+}
+
+// existingClaim returns the name of the existing PVC mounted as workspace of
+// the Theia, or an empty string if the volume claim template is used
+func existingClaim(instance *v1alpha1.Theia) string {
+	if volume := instance.Spec.Volume; volume != nil {
+		return volume.ExistingClaim
+	}
+	return ""
+}
+
+// blockWorkspace returns true if the volume claim template of the workspace is
+// a raw block device.
+func blockWorkspace(instance *v1alpha1.Theia) bool {
+	volumeMode := instance.Spec.Template.PersistentVolumeClaimSpec.VolumeMode
+	return volumeMode != nil && *volumeMode == corev1.PersistentVolumeBlock
+}
+
+// workspaceMountPath returns where the workspace volume is mounted in the container
+func workspaceMountPath(container *corev1.Container, volumeName string) string {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == volumeName {
+			return mount.MountPath
 		}
 	}
-	container.Env = append(container.Env, corev1.EnvVar{
-		Name:  "THEIA_NAME",
-		Value: instance.Name,
-	})
-	container.Env = append(container.Env, corev1.EnvVar{
-		Name:  "THEIA_PREFIX",
-		Value: "/theia/" + instance.Namespace + "/" + instance.Name,
-	})
-	container.Env = append(container.Env, corev1.EnvVar{
-		Name:  "NAMESPACE",
-		Value: instance.Namespace,
-	})
-	container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{Name: "theia", MountPath: DefaultMountPath})
+	return DefaultMountPath
+}
 
-	// For some platforms (like OpenShift), adding fsGroup: 100 is troublesome.
-	// This allows for those platforms to bypass the automatic addition of the fsGroup
-	// and will allow for the Pod Security Policy controller to make an appropriate choice
-	// https://github.com/kubernetes-sigs/controller-runtime/issues/4617
-	if value, exists := os.LookupEnv("ADD_FSGROUP"); !exists || value == "true" {
-		if podSpec.SecurityContext == nil {
-			fsGroup := DefaultFSGroup
-			podSpec.SecurityContext = &corev1.PodSecurityContext{
-				FSGroup: &fsGroup,
-			}
+// isSubPath returns true if target is the same as or located under base
+func isSubPath(base string, target string) bool {
+	base, target = path.Clean(base), path.Clean(target)
+	return target == base || strings.HasPrefix(target, strings.TrimSuffix(base, "/")+"/")
+}
+
+func hasVolume(podSpec *corev1.PodSpec, name string) bool {
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == name {
+			return true
 		}
 	}
-	return ss
+	return false
+}
+
+// generateWorkspaceEmptyDir generates the ephemeral workspace volume used when
+// no PVC is configured. The size limit prevents a workspace from exhausting the
+// node disk, and can be changed with the WORKSPACE_SIZE_LIMIT env var.
+func generateWorkspaceEmptyDir(name string) corev1.Volume {
+	sizeLimit := workspaceSizeLimit()
+	return corev1.Volume{
+		Name:         name,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &sizeLimit}},
+	}
+}
+
+// workspaceSizeLimit returns the size limit of the emptyDir workspaces from
+// WORKSPACE_SIZE_LIMIT, or DefaultWorkspaceSizeLimit if it is unset or invalid.
+func workspaceSizeLimit() resource.Quantity {
+	if quantity, err := resource.ParseQuantity(os.Getenv("WORKSPACE_SIZE_LIMIT")); err == nil {
+		return quantity
+	}
+	return resource.MustParse(DefaultWorkspaceSizeLimit)
 }
 
 func generateService(instance *v1alpha1.Theia) *corev1.Service {
 	// Define the desired Service object
 	port := DefaultContainerPort
-	containerPorts := instance.Spec.Template.Spec.Containers[0].Ports
-	if containerPorts != nil {
+	podSpec := &instance.Spec.Template.Spec
+	containerPorts := podSpec.Containers[theiaContainerIndex(instance, podSpec)].Ports
+	if len(containerPorts) > 0 {
 		port = int(containerPorts[0].ContainerPort)
 	}
+	// route the requests through the activity tracker
+	if culler.ActivitySidecarIsEnabled() {
+		port = ActivitySidecarPort
+	}
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        instance.Name,
 			Namespace:   instance.Namespace,
-			Labels:      instance.Labels,
-			Annotations: instance.Annotations,
+			Labels:      mergeMaps(instance.Labels, instance.Spec.ServiceLabels),
+			Annotations: mergeMaps(instance.Annotations, instance.Spec.ServiceAnnotations),
 		},
 		Spec: corev1.ServiceSpec{
-			Type:     "ClusterIP",
+			Type:     serviceType(instance),
 			Selector: map[string]string{"statefulset": instance.Name},
 			Ports: []corev1.ServicePort{
 				{
@@ -423,9 +2087,240 @@ func generateService(instance *v1alpha1.Theia) *corev1.Service {
 			},
 		},
 	}
+	publishNotReadyAddresses := os.Getenv("PUBLISH_NOT_READY_ADDRESSES") == "true"
+	if instance.Spec.PublishNotReadyAddresses != nil {
+		publishNotReadyAddresses = *instance.Spec.PublishNotReadyAddresses
+	}
+	svc.Spec.PublishNotReadyAddresses = publishNotReadyAddresses
+	switch svc.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		svc.Spec.LoadBalancerSourceRanges = instance.Spec.LoadBalancerSourceRanges
+		fallthrough
+	case corev1.ServiceTypeNodePort:
+		if instance.Spec.NodePort != nil {
+			svc.Spec.Ports[0].NodePort = *instance.Spec.NodePort
+		}
+	}
+	// expose the additional ports of the Theia container as they are declared
+	for i := 1; i < len(containerPorts); i++ {
+		containerPort := containerPorts[i]
+		name := containerPort.Name
+		if name == "" {
+			name = fmt.Sprintf("port-%d", containerPort.ContainerPort)
+		}
+		protocol := containerPort.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+			Name:       name,
+			Port:       containerPort.ContainerPort,
+			TargetPort: intstr.FromInt(int(containerPort.ContainerPort)),
+			Protocol:   protocol,
+		})
+	}
+	return svc
+}
+
+func headlessServiceName(name string) string {
+	return name + "-headless"
+}
+
+// generateHeadlessService generates the headless Service which provides the
+// stable DNS entries for the StatefulSet pods. The routable Service generated
+// by generateService is still the one used by Istio.
+func generateHeadlessService(instance *v1alpha1.Theia) *corev1.Service {
+	svc := generateService(instance)
+	svc.Name = headlessServiceName(instance.Name)
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
 	return svc
 }
 
+func (r *TheiaReconciler) reconcileService(instance *v1alpha1.Theia, service *corev1.Service) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
+		return err
+	}
+	// Check if the Service already exists
+	foundService := &corev1.Service{}
+	justCreated := false
+	err := r.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, foundService)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating Service", "namespace", service.Namespace, "name", service.Name)
+		err = r.Create(context.TODO(), service)
+		justCreated = true
+		if err != nil {
+			log.Error(err, "unable to create Service")
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Unable to create Service %s: %v", service.Name, err)
+			return err
+		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonCreated,
+			"Created Service %s", service.Name)
+	} else if err != nil {
+		log.Error(err, "error getting Service")
+		return err
+	}
+	adopted := false
+	if !justCreated {
+		var conflict string
+		adopted, conflict, err = r.adoptResource(instance, foundService)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			log.Info(conflict, "namespace", service.Namespace, "name", service.Name)
+			r.EventRecorder.Event(instance, corev1.EventTypeWarning, EventReasonOwnerConflict, conflict)
+			return nil
+		}
+	}
+	// Update the foundService object and write the result back if there are any changes
+	if !justCreated && (copyServiceFields(service, foundService) || adopted) {
+		log.Info("Updating Service", "namespace", service.Namespace, "name", service.Name)
+		err = r.Update(context.TODO(), foundService)
+		if err != nil {
+			log.Error(err, "unable to update Service")
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonFailed,
+				"Unable to update Service %s: %v", service.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// istioGatewayReference normalizes the gateway to the namespace/name form
+// expected by Istio. A gateway given only by name is looked up in the
+// namespace of the Theia.
+func istioGatewayReference(gateway string, namespace string) string {
+	gateway = strings.TrimSpace(gateway)
+	if len(gateway) == 0 {
+		return DefaultIstioGateway
+	}
+	if !strings.Contains(gateway, "/") {
+		return namespace + "/" + gateway
+	}
+	return gateway
+}
+
+// virtualServiceRouteName returns the name of the http route of the virtual
+// service, which Istio reports in its metrics and traces. The ISTIO_ROUTE_NAME
+// env var can change it with the {name} and {namespace} placeholders, or
+// remove it when set to an empty string.
+func virtualServiceRouteName(instance *v1alpha1.Theia) string {
+	routeName, exists := os.LookupEnv("ISTIO_ROUTE_NAME")
+	if !exists {
+		routeName = DefaultIstioRouteName
+	}
+	return strings.NewReplacer("{name}", instance.Name, "{namespace}", instance.Namespace).Replace(routeName)
+}
+
+// virtualServicePrefix returns the path prefix of the route of the Theia at the
+// Istio gateway.
+func virtualServicePrefix(instance *v1alpha1.Theia) string {
+	return fmt.Sprintf("/theia/%s/%s/", instance.Namespace, instance.Name)
+}
+
+// serviceHost returns the in-cluster DNS name of the service of the Theia, in
+// the cluster domain set with CLUSTER_DOMAIN.
+func serviceHost(instance *v1alpha1.Theia) string {
+	return fmt.Sprintf("%s.%s.svc.%s", instance.Name, instance.Namespace, culler.GetClusterDomain())
+}
+
+// theiaURL returns where the Theia is served, i.e. its prefix at the Istio
+// gateway or the Ingress, or the URL of its service when neither is used.
+func theiaURL(instance *v1alpha1.Theia) string {
+	if os.Getenv("USE_ISTIO") == "true" || ingressIsEnabled() {
+		return virtualServicePrefix(instance)
+	}
+	return "http://" + serviceHost(instance) + "/"
+}
+
+// deleteRouting deletes the VirtualService and the Ingress of a Theia being
+// deleted. Those already deleted, or whose CRD isn't installed, are skipped.
+func (r *TheiaReconciler) deleteRouting(ctx context.Context, instance *v1alpha1.Theia) error {
+	log := r.Log.WithValues("theia", instance.Namespace)
+	virtualService := &unstructured.Unstructured{}
+	virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
+	virtualService.SetKind("VirtualService")
+	virtualService.SetName(virtualServiceName(instance.Name, instance.Namespace))
+	virtualService.SetNamespace(instance.Namespace)
+	ingress := newIngress()
+	ingress.SetName(instance.Name)
+	ingress.SetNamespace(instance.Namespace)
+	for _, object := range []*unstructured.Unstructured{virtualService, ingress} {
+		err := r.Delete(ctx, object)
+		if err == nil {
+			log.Info("Deleted "+object.GetKind(), "namespace", object.GetNamespace(), "name", object.GetName())
+		} else if !apierrs.IsNotFound(err) && !meta.IsNoMatchError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIfExists deletes the object, unless it or its CRD doesn't exist.
+func (r *TheiaReconciler) deleteIfExists(ctx context.Context, object *unstructured.Unstructured) error {
+	err := r.Delete(ctx, object)
+	if err == nil {
+		r.Log.Info("Deleted "+object.GetKind(), "namespace", object.GetNamespace(), "name", object.GetName())
+	} else if !apierrs.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		return err
+	}
+	return nil
+}
+
+// recordCleanupFailure records when the cleanup of the finalizer first failed
+// with the CleanupFailingSinceAnnotation, and returns the error for the cleanup
+// to be retried with the backoff of the rate limiter. The annotation is only
+// written once, so that the retries aren't triggered by its update. Once the
+// cleanup has been failing for CLEANUP_TIMEOUT minutes, it returns true instead
+// for the finalizer to be removed anyway, warning that some resources may be
+// orphaned. Only the RoutingFinalizer has a cleanup which can fail, the
+// deleted lifecycle callback never blocks the deletion.
+func (r *TheiaReconciler) recordCleanupFailure(ctx context.Context, instance *v1alpha1.Theia, finalizer string, cleanupErr error) (bool, error) {
+	failingSince, err := time.Parse(time.RFC3339, instance.Annotations[CleanupFailingSinceAnnotation])
+	if err != nil {
+		if instance.Annotations == nil {
+			instance.Annotations = map[string]string{}
+		}
+		instance.Annotations[CleanupFailingSinceAnnotation] = time.Now().Format(time.RFC3339)
+		if err := r.Update(ctx, instance); err != nil {
+			return false, err
+		}
+		return false, cleanupErr
+	}
+	timeout := time.Duration(getEnvInt("CLEANUP_TIMEOUT", DefaultCleanupTimeout)) * time.Minute
+	if time.Since(failingSince) < timeout {
+		return false, cleanupErr
+	}
+	r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonCleanupFailed,
+		"Removing finalizer %s after the cleanup failed for more than %s, some resources of the Theia may be orphaned: %v",
+		finalizer, timeout, cleanupErr)
+	delete(instance.Annotations, CleanupFailingSinceAnnotation)
+	return true, nil
+}
+
+// virtualServiceTimeout returns the timeout of the route of the Theia in the
+// seconds of the protobuf JSON mapping Istio expects, e.g. 3600s for 1h. The
+// timeout is validated before the VirtualService is generated.
+func virtualServiceTimeout(instance *v1alpha1.Theia) string {
+	routing := instance.Spec.Routing
+	if routing == nil || routing.Timeout == "" {
+		return DefaultRouteTimeout
+	}
+	timeout, err := time.ParseDuration(routing.Timeout)
+	if err != nil || timeout < 0 {
+		return DefaultRouteTimeout
+	}
+	return formatSeconds(timeout)
+}
+
+// formatSeconds formats the duration in seconds, e.g. 3600s, the only form
+// accepted by Istio and Envoy.
+func formatSeconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'f', -1, 64) + "s"
+}
+
 func virtualServiceName(kfName string, namespace string) string {
 	return fmt.Sprintf("v1alpha1-%s-%s", namespace, kfName)
 }
@@ -433,10 +2328,9 @@ func virtualServiceName(kfName string, namespace string) string {
 func generateVirtualService(instance *v1alpha1.Theia) (*unstructured.Unstructured, error) {
 	name := instance.Name
 	namespace := instance.Namespace
-	prefix := fmt.Sprintf("/theia/%s/%s/", namespace, name)
+	prefix := virtualServicePrefix(instance)
 	// rewrite := fmt.Sprintf("/theia/%s/%s/", namespace, name)
-	// TODO(gabrielwen): Make clusterDomain an option.
-	service := fmt.Sprintf("%s.%s.svc.cluster.local", name, namespace)
+	service := serviceHost(instance)
 
 	vsvc := &unstructured.Unstructured{}
 	vsvc.SetAPIVersion("networking.istio.io/v1alpha3")
@@ -447,10 +2341,11 @@ func generateVirtualService(instance *v1alpha1.Theia) (*unstructured.Unstructure
 		return nil, fmt.Errorf("Set .spec.hosts error: %v", err)
 	}
 
-	istioGateway := os.Getenv("ISTIO_GATEWAY")
-	if len(istioGateway) == 0 {
-		istioGateway = "kubeflow/kubeflow-gateway"
+	gateway := os.Getenv("ISTIO_GATEWAY")
+	if routing := instance.Spec.Routing; routing != nil && routing.Gateway != "" {
+		gateway = routing.Gateway
 	}
+	istioGateway := istioGatewayReference(gateway, namespace)
 	if err := unstructured.SetNestedStringSlice(vsvc.Object, []string{istioGateway},
 		"spec", "gateways"); err != nil {
 		return nil, fmt.Errorf("Set .spec.gateways error: %v", err)
@@ -478,9 +2373,20 @@ func generateVirtualService(instance *v1alpha1.Theia) (*unstructured.Unstructure
 					},
 				},
 			},
-			"timeout": "300s",
+			"timeout": virtualServiceTimeout(instance),
 		},
 	}
+	if routeName := virtualServiceRouteName(instance); routeName != "" {
+		http[0].(map[string]interface{})["name"] = routeName
+	}
+	if websocketRoutingIsEnabled() {
+		http = append([]interface{}{generateWebsocketRoute(http[0].(map[string]interface{}))}, http...)
+	}
+	if maintenanceModeIsOn(instance) {
+		for _, route := range http {
+			route.(map[string]interface{})["fault"] = generateMaintenanceFault()
+		}
+	}
 	if err := unstructured.SetNestedSlice(vsvc.Object, http, "spec", "http"); err != nil {
 		return nil, fmt.Errorf("Set .spec.http error: %v", err)
 	}
@@ -489,6 +2395,47 @@ func generateVirtualService(instance *v1alpha1.Theia) (*unstructured.Unstructure
 
 }
 
+// maintenanceModeIsOn returns true if the Theia has the MaintenanceAnnotation
+// set to "true", or if MAINTENANCE_MODE is set to "true" for every Theia
+func maintenanceModeIsOn(instance *v1alpha1.Theia) bool {
+	return instance.Annotations[MaintenanceAnnotation] == "true" || os.Getenv("MAINTENANCE_MODE") == "true"
+}
+
+// generateMaintenanceFault generates the Istio fault answering every request
+// to the Theia with a 503 instead of routing it to the pod. The abort only sets
+// the status, Istio doesn't support a body or a message for it.
+func generateMaintenanceFault() map[string]interface{} {
+	return map[string]interface{}{
+		"abort": map[string]interface{}{
+			"httpStatus": int64(http.StatusServiceUnavailable),
+			"percentage": map[string]interface{}{"value": int64(100)},
+		},
+	}
+}
+
+// websocketRoutingIsEnabled returns true if ISTIO_WEBSOCKET_ROUTING is set to "true"
+func websocketRoutingIsEnabled() bool {
+	return os.Getenv("ISTIO_WEBSOCKET_ROUTING") == "true"
+}
+
+// generateWebsocketRoute generates the route of the websocket upgrades from the
+// route of the Theia. Envoy applies the request timeout to the whole upgraded
+// connection, so it is disabled for the websockets, which are closed by the
+// idle timeout of the DestinationRule instead.
+func generateWebsocketRoute(route map[string]interface{}) map[string]interface{} {
+	websocket := runtime.DeepCopyJSON(route)
+	for _, match := range websocket["match"].([]interface{}) {
+		match.(map[string]interface{})["headers"] = map[string]interface{}{
+			"upgrade": map[string]interface{}{"exact": "websocket"},
+		}
+	}
+	if name, ok := websocket["name"].(string); ok {
+		websocket["name"] = name + "-websocket"
+	}
+	websocket["timeout"] = "0s"
+	return websocket
+}
+
 func (r *TheiaReconciler) reconcileVirtualService(instance *v1alpha1.Theia) error {
 	log := r.Log.WithValues("theia", instance.Namespace)
 	virtualService, err := generateVirtualService(instance)
@@ -530,6 +2477,21 @@ func isStsOrPodEvent(event *v1.Event) bool {
 	return event.InvolvedObject.Kind == "Pod" || event.InvolvedObject.Kind == "StatefulSet"
 }
 
+// eventIsReissued returns true if the event has a reason worth reissuing on the
+// Theia. Only the reasons in REISSUE_EVENT_REASONS are reissued when it is set,
+// otherwise all reasons but the ones in IGNORE_EVENT_REASONS are. Both are
+// comma separated lists of reasons.
+func eventIsReissued(event *v1.Event) bool {
+	if allowed := os.Getenv("REISSUE_EVENT_REASONS"); allowed != "" {
+		return listContains(allowed, event.Reason)
+	}
+	ignored, exists := os.LookupEnv("IGNORE_EVENT_REASONS")
+	if !exists {
+		ignored = DefaultIgnoredEventReasons
+	}
+	return !listContains(ignored, event.Reason)
+}
+
 func theiaNameFromInvolvedObject(c client.Client, object *v1.ObjectReference) (string, error) {
 	name, namespace := object.Name, object.Namespace
 
@@ -564,12 +2526,33 @@ func theiaNameExists(client client.Client, nbName string, namespace string) bool
 	return true
 }
 
+// logInvalidSettings logs the env settings of the controller whose value is
+// invalid, once at startup rather than on each Theia they are ignored for.
+func (r *TheiaReconciler) logInvalidSettings() {
+	if value := os.Getenv("WORKSPACE_SIZE_LIMIT"); value != "" {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			r.Log.Info(fmt.Sprintf("Invalid WORKSPACE_SIZE_LIMIT '%s', using %s", value, DefaultWorkspaceSizeLimit))
+		}
+	}
+	if value := os.Getenv("SECCOMP_PROFILE"); value != "" && seccompProfile(&v1alpha1.Theia{}) == "" {
+		r.Log.Info(fmt.Sprintf("Invalid SECCOMP_PROFILE '%s', no seccomp profile is applied by default", value))
+	}
+}
+
 // SetupWithManager setups the reconciler with the manager
 func (r *TheiaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.logInvalidSettings()
+	if os.Getenv("ENABLE_ACTIVITY_SIDECAR") == "true" && !culler.ActivitySidecarIsEnabled() {
+		r.Log.Info("ENABLE_ACTIVITY_SIDECAR is ignored as ACTIVITY_SIDECAR_IMAGE is not set")
+	}
 	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&v1alpha1.Theia{}).
 		Owns(&appsv1.StatefulSet{}).
-		Owns(&corev1.Service{})
+		Owns(&corev1.Service{}).
+		Owns(&corev1.Secret{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.ServiceAccount{}).
+		Owns(&batchv1.Job{})
 
 	// watch Istio virtual service
 	if os.Getenv("USE_ISTIO") == "true" {
@@ -578,6 +2561,15 @@ func (r *TheiaReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		virtualService.SetKind("VirtualService")
 		builder.Owns(virtualService)
 	}
+	if envoyFilterIsEnabled() {
+		builder.Owns(newEnvoyFilter())
+	}
+	if destinationRuleIsEnabled() {
+		builder.Owns(newDestinationRule())
+	}
+	if ingressIsEnabled() {
+		builder.Owns(newIngress())
+	}
 
 	// TODO: After this is fixed:
 	// https://github.com/kubernetes-sigs/controller-runtime/issues/572
@@ -630,7 +2622,7 @@ func (r *TheiaReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				return false
 			}
 			return e.ObjectOld != e.ObjectNew &&
-				isStsOrPodEvent(event) &&
+				isStsOrPodEvent(event) && eventIsReissued(event) &&
 				theiaNameExists(r.Client, nbName, e.MetaNew.GetNamespace())
 		},
 		CreateFunc: func(e event.CreateEvent) bool {
@@ -639,7 +2631,7 @@ func (r *TheiaReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			if err != nil {
 				return false
 			}
-			return isStsOrPodEvent(event) &&
+			return isStsOrPodEvent(event) && eventIsReissued(event) &&
 				theiaNameExists(r.Client, nbName, e.Meta.GetNamespace())
 		},
 	}
@@ -662,5 +2654,26 @@ func (r *TheiaReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	// apply the extensions annotation of the namespaces to their Theia
+	if extensionsAreEnabled() {
+		if err = c.Watch(
+			&source.Kind{Type: &corev1.Namespace{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.namespaceExtensionsRequests),
+			},
+			extensionsAnnotationChanged); err != nil {
+			return err
+		}
+	}
+
+	// validate the Theia again when their cluster template changes
+	if err = c.Watch(
+		&source.Kind{Type: &v1alpha1.TheiaClusterTemplate{}},
+		&handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.clusterTemplateRequests),
+		}); err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,3432 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	v1alpha1 "theia-controller/api/v1alpha1"
+	"theia-controller/pkg/culler"
+	"theia-controller/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// testMetrics is shared by all reconcilers as the collectors can only be
+// registered once.
+var testMetrics = metrics.NewMetrics(nil)
+
+func newTestReconciler(objs ...runtime.Object) *TheiaReconciler {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+	return &TheiaReconciler{
+		Client:        fake.NewFakeClientWithScheme(scheme, objs...),
+		Log:           ctrl.Log.WithName("test"),
+		Scheme:        scheme,
+		Metrics:       testMetrics,
+		EventRecorder: record.NewFakeRecorder(100),
+	}
+}
+
+func newTestTheia() *v1alpha1.Theia {
+	return &v1alpha1.Theia{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia", Namespace: "default"},
+		Spec: v1alpha1.TheiaSpec{
+			Template: v1alpha1.TheiaTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "theia"}},
+				},
+			},
+		},
+	}
+}
+
+// envValue returns the value of the env var name, or an empty string
+func envValue(env []corev1.EnvVar, name string) string {
+	for _, e := range env {
+		if e.Name == name {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+func reconcileTheia(t *testing.T, r *TheiaReconciler, instance *v1alpha1.Theia) *v1alpha1.Theia {
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	found := &v1alpha1.Theia{}
+	if err := r.Get(context.TODO(), key, found); err != nil {
+		t.Fatalf("unable to fetch Theia: %v", err)
+	}
+	return found
+}
+
+func TestReconcileReportsBoundVolume(t *testing.T) {
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0", Namespace: "default"},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Phase: corev1.ClaimBound,
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: resource.MustParse("250Mi"),
+			},
+		},
+	}
+
+	found := reconcileTheia(t, newTestReconciler(instance, pvc), instance)
+	if found.Status.VolumeName != "theia-my-theia-0" {
+		t.Errorf("expected volume name theia-my-theia-0, got %q", found.Status.VolumeName)
+	}
+	if found.Status.VolumeCapacity != "250Mi" {
+		t.Errorf("expected volume capacity 250Mi, got %q", found.Status.VolumeCapacity)
+	}
+}
+
+func TestReconcileImmutableStatefulSetChange(t *testing.T) {
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	existing := generateStatefulSet(instance.DeepCopy())
+	oldStorageClass := "slow"
+	existing.Spec.VolumeClaimTemplates[0].Spec.StorageClassName = &oldStorageClass
+
+	r := newTestReconciler(instance, existing)
+	reconcileTheia(t, r, instance)
+	events := r.EventRecorder.(*record.FakeRecorder).Events
+	select {
+	case e := <-events:
+		if !strings.Contains(e, "ImmutableFieldChanged") || !strings.Contains(e, "spec.volumeClaimTemplates") {
+			t.Errorf("unexpected event %q", e)
+		}
+	default:
+		t.Errorf("expected an ImmutableFieldChanged event")
+	}
+	reconcileTheia(t, r, instance)
+	for _, e := range drainEvents(r) {
+		if strings.Contains(e, "ImmutableFieldChanged") {
+			t.Errorf("expected the ImmutableFieldChanged warning to be emitted once, got %q", e)
+		}
+	}
+	key := types.NamespacedName{Name: existing.Name, Namespace: existing.Namespace}
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); err != nil {
+		t.Fatalf("StatefulSet should be kept without confirmation: %v", err)
+	}
+
+	confirmed := &v1alpha1.Theia{}
+	_ = r.Get(context.TODO(), key, confirmed)
+	confirmed.Annotations = map[string]string{RecreateAnnotation: "true"}
+	_ = r.Update(context.TODO(), confirmed)
+	found := reconcileTheia(t, r, confirmed)
+	if _, ok := found.Annotations[RecreateAnnotation]; ok {
+		t.Errorf("expected %s annotation to be removed", RecreateAnnotation)
+	}
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected StatefulSet to be deleted for recreation, got %v", err)
+	}
+}
+
+func TestReconcileHeadlessService(t *testing.T) {
+	os.Setenv("USE_HEADLESS_SERVICE", "true")
+	defer os.Unsetenv("USE_HEADLESS_SERVICE")
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+
+	service := &corev1.Service{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, service); err != nil {
+		t.Fatalf("unable to fetch Service: %v", err)
+	}
+	if service.Spec.Type != corev1.ServiceTypeClusterIP || service.Spec.ClusterIP == corev1.ClusterIPNone {
+		t.Errorf("expected a routable ClusterIP Service, got %+v", service.Spec)
+	}
+	headless := &corev1.Service{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia-headless", Namespace: "default"}, headless); err != nil {
+		t.Fatalf("unable to fetch headless Service: %v", err)
+	}
+	if headless.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Errorf("expected a headless Service, got clusterIP %q", headless.Spec.ClusterIP)
+	}
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatalf("unable to fetch StatefulSet: %v", err)
+	}
+	if ss.Spec.ServiceName != "my-theia-headless" {
+		t.Errorf("expected StatefulSet serviceName my-theia-headless, got %q", ss.Spec.ServiceName)
+	}
+}
+
+func TestGenerateStatefulSetEmptyDirSizeLimit(t *testing.T) {
+	os.Setenv("WORKSPACE_SIZE_LIMIT", "5Gi")
+	defer os.Unsetenv("WORKSPACE_SIZE_LIMIT")
+	ss := generateStatefulSet(newTestTheia())
+	volumes := ss.Spec.Template.Spec.Volumes
+	if len(volumes) != 1 || volumes[0].Name != "theia" || volumes[0].EmptyDir == nil {
+		t.Fatalf("expected an emptyDir workspace volume, got %+v", volumes)
+	}
+	if sizeLimit := volumes[0].EmptyDir.SizeLimit; sizeLimit == nil || sizeLimit.String() != "5Gi" {
+		t.Errorf("expected size limit 5Gi, got %v", sizeLimit)
+	}
+
+	os.Setenv("WORKSPACE_SIZE_LIMIT", "5 gigs")
+	volumes = generateStatefulSet(newTestTheia()).Spec.Template.Spec.Volumes
+	if sizeLimit := volumes[0].EmptyDir.SizeLimit; sizeLimit == nil || sizeLimit.String() != DefaultWorkspaceSizeLimit {
+		t.Errorf("expected an invalid size limit to fall back to %s, got %v", DefaultWorkspaceSizeLimit, sizeLimit)
+	}
+}
+
+func TestReconcileLifecycleCallbacks(t *testing.T) {
+	var mutex sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload := struct {
+			Event string `json:"event"`
+			Name  string `json:"name"`
+		}{}
+		_ = json.NewDecoder(req.Body).Decode(&payload)
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, payload.Event+":"+payload.Name)
+	}))
+	defer server.Close()
+	os.Setenv("LIFECYCLE_WEBHOOK_URL", server.URL)
+	defer os.Unsetenv("LIFECYCLE_WEBHOOK_URL")
+
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	found := reconcileTheia(t, r, instance)
+	if !containsString(found.Finalizers, LifecycleFinalizer) {
+		t.Errorf("expected the %s finalizer to be added", LifecycleFinalizer)
+	}
+
+	ss := &appsv1.StatefulSet{}
+	_ = r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss)
+	ss.Status.ReadyReplicas = 1
+	_ = r.Update(context.TODO(), ss)
+	found = reconcileTheia(t, r, found)
+
+	if err := r.cullTheia(context.TODO(), found, ss, culler.STOP_REASON_CULLED, idleCullMessage(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	now := metav1.Now()
+	found.DeletionTimestamp = &now
+	_ = r.Update(context.TODO(), found)
+	found = reconcileTheia(t, r, found)
+	if containsString(found.Finalizers, LifecycleFinalizer) {
+		t.Errorf("expected the %s finalizer to be removed", LifecycleFinalizer)
+	}
+
+	// The callbacks are posted in the background
+	expected := []string{"created:my-theia", "ready:my-theia", "culled:my-theia", "deleted:my-theia"}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mutex.Lock()
+		done := len(received) >= len(expected)
+		mutex.Unlock()
+		if done {
+			break
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected callbacks %v, got %v", expected, received)
+	}
+}
+
+func TestReconcileDeletesCulledAfterRetention(t *testing.T) {
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	os.Setenv("CULLED_RETENTION_TIME", "1440")
+	defer os.Unsetenv("CULLED_RETENTION_TIME")
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Annotations = map[string]string{
+		culler.STOP_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0", Namespace: "default"},
+	}
+	r := newTestReconciler(instance, pvc)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &v1alpha1.Theia{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the Theia to be deleted, got %v", err)
+	}
+	pvcKey := types.NamespacedName{Name: "theia-my-theia-0", Namespace: "default"}
+	if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the workspace PVC to be deleted, got %v", err)
+	}
+	if e := <-r.EventRecorder.(*record.FakeRecorder).Events; !strings.HasPrefix(e, "Warning RetentionElapsed") {
+		t.Errorf("unexpected event %q", e)
+	}
+}
+
+func TestReconcileDeletesMigratedClaimsOfCulled(t *testing.T) {
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	os.Setenv("CULLED_RETENTION_TIME", "1440")
+	defer os.Unsetenv("CULLED_RETENTION_TIME")
+	instance := newTestTheia()
+	instance.Annotations = map[string]string{
+		culler.STOP_ANNOTATION:   time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+		WorkspaceClaimAnnotation: "theia-my-theia-0-fast",
+	}
+	instance.Status.Migration = &v1alpha1.StorageMigrationStatus{
+		StorageClass: "fast",
+		Phase:        v1alpha1.MigrationSucceeded,
+		SourceClaim:  "theia-my-theia-0",
+		TargetClaim:  "theia-my-theia-0-fast",
+	}
+	source := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0", Namespace: "default"}}
+	target := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0-fast", Namespace: "default"}}
+	r := newTestReconciler(instance, source, target)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	for _, name := range []string{"theia-my-theia-0", "theia-my-theia-0-fast"} {
+		pvcKey := types.NamespacedName{Name: name, Namespace: "default"}
+		if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); !apierrs.IsNotFound(err) {
+			t.Errorf("expected the PVC %s to be deleted, got %v", name, err)
+		}
+	}
+}
+
+func TestReconcileKeepsUserClaimOfCulled(t *testing.T) {
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	os.Setenv("CULLED_RETENTION_TIME", "1440")
+	defer os.Unsetenv("CULLED_RETENTION_TIME")
+	instance := newTestTheia()
+	instance.Annotations = map[string]string{
+		culler.STOP_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	instance.Spec.Template.Spec.Volumes = []corev1.Volume{{
+		Name: DefaultVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "user-data"},
+		},
+	}}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "user-data", Namespace: "default"},
+	}
+	r := newTestReconciler(instance, pvc)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &v1alpha1.Theia{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the Theia to be deleted, got %v", err)
+	}
+	pvcKey := types.NamespacedName{Name: "user-data", Namespace: "default"}
+	if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); err != nil {
+		t.Errorf("expected the PVC mounted by the user to be kept, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetSeccompProfile(t *testing.T) {
+	key := corev1.SeccompContainerAnnotationKeyPrefix + "theia"
+	os.Setenv("SECCOMP_PROFILE", "RuntimeDefault")
+	defer os.Unsetenv("SECCOMP_PROFILE")
+	ss := generateStatefulSet(newTestTheia())
+	if profile := ss.Spec.Template.Annotations[key]; profile != "runtime/default" {
+		t.Errorf("expected default profile runtime/default, got %q", profile)
+	}
+	os.Setenv("SECCOMP_PROFILE", "Default")
+	if profile, ok := generateStatefulSet(newTestTheia()).Spec.Template.Annotations[key]; ok {
+		t.Errorf("expected an unknown default profile to be ignored, got %q", profile)
+	}
+	os.Setenv("SECCOMP_PROFILE", "RuntimeDefault")
+
+	instance := newTestTheia()
+	instance.Spec.Template.SeccompProfile = &v1alpha1.SeccompProfile{
+		Type:             "Localhost",
+		LocalhostProfile: "profiles/theia.json",
+	}
+	ss = generateStatefulSet(instance)
+	if profile := ss.Spec.Template.Annotations[key]; profile != "localhost/profiles/theia.json" {
+		t.Errorf("expected profile localhost/profiles/theia.json, got %q", profile)
+	}
+
+	instance.Spec.Template.SeccompProfile = &v1alpha1.SeccompProfile{Type: "Localhost"}
+	ss = generateStatefulSet(instance)
+	if profile, ok := ss.Spec.Template.Annotations[key]; ok {
+		t.Errorf("expected an incomplete Localhost profile to be ignored, got %q", profile)
+	}
+}
+
+func TestReconcileCredentialsSecret(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Credentials = &v1alpha1.CredentialsSpec{RotationPeriodMinutes: 60}
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+
+	secret := &corev1.Secret{}
+	secretKey := types.NamespacedName{Name: "my-theia-credentials", Namespace: "default"}
+	if err := r.Get(context.TODO(), secretKey, secret); err != nil {
+		t.Fatalf("unable to fetch credentials Secret: %v", err)
+	}
+	token := string(secret.Data[CredentialsTokenKey])
+	if token == "" {
+		t.Errorf("expected a generated token")
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Name != "my-theia" {
+		t.Errorf("expected the Secret to be owned by the Theia, got %+v", secret.OwnerReferences)
+	}
+
+	ss := &appsv1.StatefulSet{}
+	_ = r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss)
+	container := ss.Spec.Template.Spec.Containers[0]
+	mounted := false
+	for _, mount := range container.VolumeMounts {
+		mounted = mounted || (mount.Name == "theia-credentials" && mount.MountPath == CredentialsMountPath)
+	}
+	if !mounted {
+		t.Errorf("expected the credentials to be mounted, got %+v", container.VolumeMounts)
+	}
+	if file := envValue(container.Env, "THEIA_TOKEN_FILE"); file != CredentialsMountPath+"/"+CredentialsTokenKey {
+		t.Errorf("expected the THEIA_TOKEN_FILE env var, got %+v", container.Env)
+	}
+	for _, env := range container.Env {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			t.Errorf("expected the token not to be copied to the env var %s", env.Name)
+		}
+	}
+
+	// The Theia is requeued for the token to be rotated on time
+	secret.Annotations[RotatedAtAnnotation] = time.Now().Add(-50 * time.Minute).Format(time.RFC3339)
+	_ = r.Update(context.TODO(), secret)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter <= 0 || result.RequeueAfter > 10*time.Minute {
+		t.Errorf("expected a requeue at the expiry of the token, got %v", result.RequeueAfter)
+	}
+
+	secret.Annotations[RotatedAtAnnotation] = time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	_ = r.Update(context.TODO(), secret)
+	reconcileTheia(t, r, instance)
+	_ = r.Get(context.TODO(), secretKey, secret)
+	if string(secret.Data[CredentialsTokenKey]) == token {
+		t.Errorf("expected the token to be rotated")
+	}
+}
+
+func TestReconcileRecordsStopReason(t *testing.T) {
+	userStopped := newTestTheia()
+	userStopped.Annotations = map[string]string{culler.STOP_ANNOTATION: time.Now().Format(time.RFC3339)}
+	culled := newTestTheia()
+	culled.Name = "culled-theia"
+	culler.SetStopAnnotation(&culled.ObjectMeta, nil)
+
+	r := newTestReconciler(userStopped, culled)
+	for instance, reason := range map[*v1alpha1.Theia]string{
+		userStopped: culler.STOP_REASON_USER,
+		culled:      culler.STOP_REASON_CULLED,
+	} {
+		found := reconcileTheia(t, r, instance)
+		conditions := found.Status.Conditions
+		if len(conditions) == 0 || conditions[0].Type != "Stopped" || conditions[0].Reason != reason {
+			t.Errorf("expected a Stopped condition with reason %s for %s, got %+v", reason, instance.Name, conditions)
+		}
+	}
+
+	culler.RemoveStopAnnotation(&culled.ObjectMeta)
+	if reason := culler.GetStopReason(culled.ObjectMeta); reason != "" {
+		t.Errorf("expected a resumed Theia to have no stop reason, got %s", reason)
+	}
+
+	// A culled Theia resumed by removing the stop annotation by hand is then
+	// stopped by the user
+	found := &v1alpha1.Theia{}
+	key := types.NamespacedName{Name: culled.Name, Namespace: culled.Namespace}
+	_ = r.Get(context.TODO(), key, found)
+	delete(found.Annotations, culler.STOP_ANNOTATION)
+	_ = r.Update(context.TODO(), found)
+	found = reconcileTheia(t, r, found)
+	if _, ok := found.Annotations[culler.STOP_REASON_ANNOTATION]; ok {
+		t.Errorf("expected the stop reason to be removed on resume, got %v", found.Annotations)
+	}
+	found.Annotations = map[string]string{culler.STOP_ANNOTATION: time.Now().Format(time.RFC3339)}
+	_ = r.Update(context.TODO(), found)
+	found = reconcileTheia(t, r, found)
+	if reason := culler.GetStopReason(found.ObjectMeta); reason != culler.STOP_REASON_USER {
+		t.Errorf("expected the manual stop to be reported as %s, got %s", culler.STOP_REASON_USER, reason)
+	}
+}
+
+func TestReconcileWarnsWorkingDirMismatch(t *testing.T) {
+	os.Setenv("VALIDATE_WORKING_DIR", "true")
+	defer os.Unsetenv("VALIDATE_WORKING_DIR")
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].WorkingDir = "/opt/theia"
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+	if e := <-r.EventRecorder.(*record.FakeRecorder).Events; !strings.HasPrefix(e, "Warning WorkingDirMismatch") {
+		t.Errorf("unexpected event %q", e)
+	}
+	reconcileTheia(t, r, instance)
+	for _, e := range drainEvents(r) {
+		if strings.HasPrefix(e, "Warning "+EventReasonWorkingDirMismatch) {
+			t.Errorf("expected the WorkingDirMismatch warning to be emitted once, got %q", e)
+		}
+	}
+
+	instance = newTestTheia()
+	instance.Name = "other-theia"
+	instance.Spec.Template.Spec.Containers[0].WorkingDir = DefaultMountPath + "/src"
+	r = newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+	for _, e := range drainEvents(r) {
+		if strings.HasPrefix(e, "Warning "+EventReasonWorkingDirMismatch) {
+			t.Errorf("expected no event for a working dir in the workspace, got %q", e)
+		}
+	}
+}
+
+// drainEvents returns the events recorded so far by the fake recorder.
+func drainEvents(r *TheiaReconciler) []string {
+	var events []string
+	for {
+		select {
+		case e := <-r.EventRecorder.(*record.FakeRecorder).Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestReconcileEmitsCreatedEvent(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+	events := drainEvents(r)
+	expected := []string{
+		"Normal " + EventReasonCreated + " Created StatefulSet my-theia",
+		"Normal " + EventReasonCreated + " Created Service my-theia",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected Created events for the StatefulSet and the Service, got %q", events)
+	}
+
+	// Nothing is created on the next reconcile
+	reconcileTheia(t, r, instance)
+	if events := drainEvents(r); len(events) != 0 {
+		t.Errorf("expected no Created event once created, got %q", events)
+	}
+}
+
+func TestGenerateStatefulSetGitCloneInitContainer(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.GitRepo = &v1alpha1.GitRepoSpec{
+		URL: "https://github.com/e2fyi/theia-controller.git",
+		Ref: "v0.1.0",
+	}
+	ss := generateStatefulSet(instance)
+	initContainers := ss.Spec.Template.Spec.InitContainers
+	if len(initContainers) != 1 || initContainers[0].Name != "git-clone" {
+		t.Fatalf("expected a git-clone init container, got %+v", initContainers)
+	}
+	expected := []string{
+		"https://github.com/e2fyi/theia-controller.git",
+		DefaultMountPath + "/theia-controller",
+		"v0.1.0",
+	}
+	if !reflect.DeepEqual(initContainers[0].Args, expected) {
+		t.Errorf("expected args %v, got %v", expected, initContainers[0].Args)
+	}
+	if mounts := initContainers[0].VolumeMounts; len(mounts) != 1 || mounts[0].Name != "theia" {
+		t.Errorf("expected the workspace to be mounted, got %+v", mounts)
+	}
+
+	instance.Spec.GitRepo.Path = "../../etc"
+	ss = generateStatefulSet(instance)
+	if target := ss.Spec.Template.Spec.InitContainers[0].Args[1]; target != DefaultMountPath+"/etc" {
+		t.Errorf("expected the clone to stay in the workspace, got %s", target)
+	}
+}
+
+func TestGenerateStatefulSetFSGroupWithUserSecurityContext(t *testing.T) {
+	instance := newTestTheia()
+	runAsUser := int64(1000)
+	instance.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &runAsUser}
+	ss := generateStatefulSet(instance)
+	securityContext := ss.Spec.Template.Spec.SecurityContext
+	if securityContext.FSGroup == nil || *securityContext.FSGroup != DefaultFSGroup {
+		t.Errorf("expected fsGroup %d, got %v", DefaultFSGroup, securityContext.FSGroup)
+	}
+	if securityContext.RunAsUser == nil || *securityContext.RunAsUser != runAsUser {
+		t.Errorf("expected the user provided runAsUser to be kept, got %v", securityContext.RunAsUser)
+	}
+	if instance.Spec.Template.Spec.SecurityContext.FSGroup != nil {
+		t.Errorf("expected the Theia spec not to be mutated")
+	}
+
+	os.Setenv("ADD_FSGROUP", "false")
+	defer os.Unsetenv("ADD_FSGROUP")
+	ss = generateStatefulSet(instance)
+	if ss.Spec.Template.Spec.SecurityContext.FSGroup != nil {
+		t.Errorf("expected no fsGroup when ADD_FSGROUP=false")
+	}
+}
+
+func TestReconcilePhaseTransitions(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	found := reconcileTheia(t, r, instance)
+	if found.Status.Phase != v1alpha1.TheiaProvisioning {
+		t.Errorf("expected phase Pending after creation, got %s", found.Status.Phase)
+	}
+
+	ss := &appsv1.StatefulSet{}
+	_ = r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss)
+	ss.Status.ReadyReplicas = 1
+	_ = r.Update(context.TODO(), ss)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia-0", Namespace: "default", Labels: map[string]string{"statefulset": "my-theia"}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		}}},
+	}
+	_ = r.Create(context.TODO(), pod)
+	found = reconcileTheia(t, r, found)
+	if found.Status.Phase != v1alpha1.TheiaRunning {
+		t.Errorf("expected phase Running once ready, got %s", found.Status.Phase)
+	}
+
+	culler.SetStopAnnotation(&found.ObjectMeta, nil)
+	_ = r.Update(context.TODO(), found)
+	found = reconcileTheia(t, r, found)
+	if found.Status.Phase != v1alpha1.TheiaStopped {
+		t.Errorf("expected phase Stopped once culled, got %s", found.Status.Phase)
+	}
+}
+
+func TestReconcileDeniesPrivilegedContainers(t *testing.T) {
+	instance := newTestTheia()
+	privileged := true
+	instance.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	r := newTestReconciler(instance)
+	found := reconcileTheia(t, r, instance)
+	if found.Status.Phase != v1alpha1.TheiaError || found.Status.Conditions[0].Reason != "Rejected" {
+		t.Errorf("expected the privileged Theia to be rejected, got %+v", found.Status)
+	}
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected no StatefulSet for a rejected Theia, got %v", err)
+	}
+
+	os.Setenv("ALLOW_PRIVILEGED_NAMESPACES", "kube-system, default")
+	defer os.Unsetenv("ALLOW_PRIVILEGED_NAMESPACES")
+	reconcileTheia(t, r, found)
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); err != nil {
+		t.Errorf("expected the privileged Theia to be allowed in a trusted namespace: %v", err)
+	}
+}
+
+func TestReconcileScalesDownTheiaBecomingPrivileged(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	replicas := func() int32 {
+		ss := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), key, ss); err != nil {
+			t.Fatal(err)
+		}
+		return *ss.Spec.Replicas
+	}
+	if replicas() != 1 {
+		t.Fatalf("expected the Theia to be running")
+	}
+
+	privileged := true
+	instance.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	found := reconcileTheia(t, r, instance)
+	if found.Status.Conditions[0].Reason != "Rejected" {
+		t.Errorf("expected the privileged Theia to be rejected, got %+v", found.Status)
+	}
+	if replicas() != 0 {
+		t.Errorf("expected the Theia which became privileged to be scaled down")
+	}
+
+	found.Spec.Template.Spec.Containers[0].SecurityContext = nil
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, found)
+	if replicas() != 1 {
+		t.Errorf("expected the Theia to be scaled up again once valid")
+	}
+}
+
+func TestGenerateStatefulSetDownwardAPIEnv(t *testing.T) {
+	fieldPaths := func(ss *appsv1.StatefulSet) map[string]string {
+		result := map[string]string{}
+		for _, env := range ss.Spec.Template.Spec.Containers[0].Env {
+			if env.ValueFrom != nil && env.ValueFrom.FieldRef != nil {
+				result[env.Name] = env.ValueFrom.FieldRef.FieldPath
+			}
+		}
+		return result
+	}
+	expected := map[string]string{
+		"POD_NAME":  "metadata.name",
+		"POD_IP":    "status.podIP",
+		"NODE_NAME": "spec.nodeName",
+	}
+	if env := fieldPaths(generateStatefulSet(newTestTheia())); !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected downward API env %v, got %v", expected, env)
+	}
+
+	// The env vars of the template are replaced rather than duplicated
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "POD_NAME", Value: "static"}}
+	count := 0
+	for _, env := range generateStatefulSet(instance).Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "POD_NAME" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected a single POD_NAME env var, got %d", count)
+	}
+
+	os.Setenv("ADD_DOWNWARD_API_ENV", "false")
+	defer os.Unsetenv("ADD_DOWNWARD_API_ENV")
+	if env := fieldPaths(generateStatefulSet(newTestTheia())); len(env) != 0 {
+		t.Errorf("expected no downward API env when disabled, got %v", env)
+	}
+}
+
+func TestReconcileResourceQuotaExceeded(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceMemory: resource.MustParse("2Gi"),
+	}
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "default"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourceRequestsMemory: resource.MustParse("4Gi")},
+			Used: corev1.ResourceList{corev1.ResourceRequestsMemory: resource.MustParse("3Gi")},
+		},
+	}
+	r := newTestReconciler(instance, quota)
+	instance = reconcileTheia(t, r, instance)
+	if len(instance.Status.Conditions) == 0 || instance.Status.Conditions[0].Type != QuotaExceeded {
+		t.Errorf("expected a %s condition, got %+v", QuotaExceeded, instance.Status.Conditions)
+	}
+	if e := <-r.EventRecorder.(*record.FakeRecorder).Events; !strings.HasPrefix(e, "Warning "+QuotaExceeded) {
+		t.Errorf("unexpected event %q", e)
+	}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, &appsv1.StatefulSet{})
+	if !apierrs.IsNotFound(err) {
+		t.Errorf("expected no StatefulSet to be created, got %v", err)
+	}
+
+	// Every replica is charged to the quota
+	replicas := int32(3)
+	instance = newTestTheia()
+	instance.Spec.Replicas = &replicas
+	instance.Spec.Template.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceMemory: resource.MustParse("512Mi"),
+	}
+	r = newTestReconciler(instance, quota)
+	instance = reconcileTheia(t, r, instance)
+	if len(instance.Status.Conditions) == 0 || instance.Status.Conditions[0].Type != QuotaExceeded ||
+		!strings.Contains(instance.Status.Conditions[0].Message, "1536Mi") {
+		t.Errorf("expected a %s condition for the 3 replicas, got %+v", QuotaExceeded, instance.Status.Conditions)
+	}
+}
+
+func TestGenerateStatefulSetPodOverhead(t *testing.T) {
+	instance := newTestTheia()
+	runtimeClass := "kata"
+	overhead := corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("120Mi")}
+	instance.Spec.Template.Spec.RuntimeClassName = &runtimeClass
+	instance.Spec.Template.Spec.Overhead = overhead
+	if err := validateTheia(instance, nil); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	ss := generateStatefulSet(instance)
+	if !reflect.DeepEqual(ss.Spec.Template.Spec.Overhead, overhead) {
+		t.Errorf("expected the overhead to be kept, got %v", ss.Spec.Template.Spec.Overhead)
+	}
+
+	instance.Spec.Template.Spec.RuntimeClassName = nil
+	if err := validateTheia(instance, nil); err == nil {
+		t.Error("expected an overhead without a RuntimeClass to be rejected")
+	}
+}
+
+func TestReconcileMigratesStorageClass(t *testing.T) {
+	os.Setenv("ENABLE_STORAGE_MIGRATION", "true")
+	defer os.Unsetenv("ENABLE_STORAGE_MIGRATION")
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Annotations = map[string]string{MigrateStorageClassAnnotation: "fast"}
+	source := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0", Namespace: "default"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			},
+		},
+	}
+	r := newTestReconciler(instance, source)
+
+	instance = reconcileTheia(t, r, instance)
+	if migration := instance.Status.Migration; migration == nil || migration.Phase != v1alpha1.MigrationPending {
+		t.Fatalf("expected a pending migration, got %+v", migration)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if instance.Status.Migration.Phase != v1alpha1.MigrationCopying {
+		t.Fatalf("expected the workspace to be copying, got %+v", instance.Status.Migration)
+	}
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	if *ss.Spec.Replicas != 0 {
+		t.Errorf("expected the Theia to be stopped during the migration, got %d replicas", *ss.Spec.Replicas)
+	}
+	target := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "theia-my-theia-0-fast", Namespace: "default"}, target); err != nil {
+		t.Fatalf("expected the target PVC to be created: %v", err)
+	}
+	if *target.Spec.StorageClassName != "fast" || !reflect.DeepEqual(target.Spec.Resources, source.Spec.Resources) {
+		t.Errorf("unexpected target PVC spec %+v", target.Spec)
+	}
+	job := &batchv1.Job{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia-migrate-storage", Namespace: "default"}, job); err != nil {
+		t.Fatalf("expected the migration job to be created: %v", err)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if instance.Status.Migration.Phase != v1alpha1.MigrationSucceeded {
+		t.Fatalf("expected the migration to succeed, got %+v", instance.Status.Migration)
+	}
+	reconcileTheia(t, r, instance)
+	ss = &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	if claim, _ := r.workspaceClaimName(context.TODO(), instance, ss); len(ss.Spec.VolumeClaimTemplates) != 0 || claim != "theia-my-theia-0-fast" {
+		t.Errorf("expected the StatefulSet to mount the migrated PVC, got %+v", ss.Spec.Template.Spec.Volumes)
+	}
+	if *ss.Spec.Replicas != 1 {
+		t.Errorf("expected the Theia to be started again, got %d replicas", *ss.Spec.Replicas)
+	}
+}
+
+func TestReconcileRejectsClusterTemplateViolations(t *testing.T) {
+	clusterTemplate := &v1alpha1.TheiaClusterTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "org-defaults"},
+		Spec: v1alpha1.TheiaClusterTemplateSpec{
+			AllowedImages: []string{"theiaide/*"},
+			MaxResources:  corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")},
+		},
+	}
+	instance := newTestTheia()
+	instance.Spec.ClusterTemplate = "org-defaults"
+	instance.Spec.Template.Spec.Containers[0].Resources.Limits = corev1.ResourceList{
+		corev1.ResourceMemory: resource.MustParse("8Gi"),
+	}
+	r := newTestReconciler(instance, clusterTemplate)
+	found := reconcileTheia(t, r, instance)
+	if found.Status.Phase != v1alpha1.TheiaError || found.Status.Conditions[0].Reason != "Rejected" ||
+		!strings.Contains(found.Status.Conditions[0].Message, "exceeds the maximum") {
+		t.Errorf("expected the Theia exceeding the cluster template to be rejected, got %+v", found.Status)
+	}
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected no StatefulSet for a rejected Theia, got %v", err)
+	}
+
+	found.Spec.Template.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory] = resource.MustParse("2Gi")
+	if err := validateTheia(found, clusterTemplate); err != nil {
+		t.Errorf("expected the Theia within the cluster template to be valid: %v", err)
+	}
+	found.Spec.Template.Spec.Containers[0].Image = "docker.io/someone/theia"
+	if err := validateTheia(found, clusterTemplate); err == nil {
+		t.Error("expected an image outside of the allowlist to be rejected")
+	}
+
+	// The defaults and the containers injected by the controller are checked too
+	found.Spec.Template.Spec.Containers[0] = corev1.Container{Name: "theia"}
+	os.Setenv("DEFAULT_MEMORY_LIMIT", "8Gi")
+	err := validateTheia(found, clusterTemplate)
+	os.Unsetenv("DEFAULT_MEMORY_LIMIT")
+	if err == nil {
+		t.Error("expected default resources above the maximum to be rejected")
+	}
+	os.Setenv("ENABLE_ACTIVITY_SIDECAR", "true")
+	os.Setenv("ACTIVITY_SIDECAR_IMAGE", "example.com/activity-tracker:v1")
+	err = validateTheia(found, clusterTemplate)
+	os.Unsetenv("ENABLE_ACTIVITY_SIDECAR")
+	os.Unsetenv("ACTIVITY_SIDECAR_IMAGE")
+	if err == nil || !strings.Contains(err.Error(), "activity-tracker") {
+		t.Errorf("expected the image of the injected sidecar to be rejected, got %v", err)
+	}
+
+	// The Theia are validated again when their cluster template changes
+	other := newTestTheia()
+	other.Name = "other-theia"
+	if err := r.Create(context.TODO(), other); err != nil {
+		t.Fatal(err)
+	}
+	requests := r.clusterTemplateRequests(handler.MapObject{Meta: clusterTemplate, Object: clusterTemplate})
+	if len(requests) != 1 || requests[0].Name != "my-theia" {
+		t.Errorf("expected the Theia of the cluster template to be requeued, got %+v", requests)
+	}
+}
+
+func TestGenerateStatefulSetPreStopGracePeriod(t *testing.T) {
+	instance := newTestTheia()
+	timeout := int64(90)
+	instance.Spec.Template.PreStopTimeoutSeconds = &timeout
+	ss := generateStatefulSet(instance)
+	if ss.Spec.Template.Spec.TerminationGracePeriodSeconds != nil {
+		t.Errorf("expected the grace period to be unchanged without a preStop hook")
+	}
+
+	instance.Spec.Template.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"sh", "-c", "sleep 60"}}},
+	}
+	ss = generateStatefulSet(instance)
+	if gracePeriod := ss.Spec.Template.Spec.TerminationGracePeriodSeconds; gracePeriod == nil || *gracePeriod != 90 {
+		t.Errorf("expected the grace period to be extended to 90s, got %v", gracePeriod)
+	}
+
+	gracePeriod := int64(120)
+	instance.Spec.Template.Spec.TerminationGracePeriodSeconds = &gracePeriod
+	ss = generateStatefulSet(instance)
+	if *ss.Spec.Template.Spec.TerminationGracePeriodSeconds != 120 {
+		t.Errorf("expected a longer grace period to be kept, got %d", *ss.Spec.Template.Spec.TerminationGracePeriodSeconds)
+	}
+}
+
+func TestGenerateStatefulSetNetworkBandwidth(t *testing.T) {
+	instance := newTestTheia()
+	ingress, egress := resource.MustParse("10M"), resource.MustParse("1M")
+	instance.Spec.NetworkBandwidth = &v1alpha1.NetworkBandwidthSpec{Ingress: &ingress, Egress: &egress}
+	if err := validateTheia(instance, nil); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	annotations := generateStatefulSet(instance).Spec.Template.Annotations
+	if annotations[IngressBandwidthAnnotation] != "10M" || annotations[EgressBandwidthAnnotation] != "1M" {
+		t.Errorf("expected the bandwidth annotations on the pod template, got %v", annotations)
+	}
+
+	tooLarge := resource.MustParse("100G")
+	instance.Spec.NetworkBandwidth.Egress = &tooLarge
+	if err := validateTheia(instance, nil); err == nil {
+		t.Error("expected a bandwidth above the limit of the plugin to be rejected")
+	}
+}
+
+func TestGenerateStatefulSetActivitySidecar(t *testing.T) {
+	os.Setenv("ENABLE_ACTIVITY_SIDECAR", "true")
+	defer os.Unsetenv("ENABLE_ACTIVITY_SIDECAR")
+	instance := newTestTheia()
+	if podSpec := generateStatefulSet(instance).Spec.Template.Spec; len(podSpec.Containers) != 1 {
+		t.Errorf("expected no activity tracker without ACTIVITY_SIDECAR_IMAGE, got %+v", podSpec.Containers)
+	}
+	os.Setenv("ACTIVITY_SIDECAR_IMAGE", "example.com/activity-tracker:v1")
+	defer os.Unsetenv("ACTIVITY_SIDECAR_IMAGE")
+	podSpec := generateStatefulSet(instance).Spec.Template.Spec
+	if len(podSpec.Containers) != 2 || podSpec.Containers[1].Name != "activity-tracker" {
+		t.Fatalf("expected the activity tracker to be injected, got %+v", podSpec.Containers)
+	}
+	sidecar := podSpec.Containers[1]
+	if sidecar.Ports[0].ContainerPort != ActivitySidecarPort {
+		t.Errorf("unexpected sidecar ports %+v", sidecar.Ports)
+	}
+	if !hasVolume(&podSpec, "activity") || sidecar.VolumeMounts[0].Name != "activity" {
+		t.Errorf("expected the activity volume to be mounted, got %+v", podSpec.Volumes)
+	}
+	if env := sidecar.Env[1]; env.Name != "UPSTREAM_URL" || env.Value != "http://localhost:3000" {
+		t.Errorf("expected the sidecar to proxy to the Theia container, got %+v", env)
+	}
+	if port := generateService(instance).Spec.Ports[0].TargetPort.IntValue(); port != ActivitySidecarPort {
+		t.Errorf("expected the Service to target the activity tracker, got %d", port)
+	}
+}
+
+func TestIstioGatewayReference(t *testing.T) {
+	for gateway, expected := range map[string]string{
+		"":                          DefaultIstioGateway,
+		"istio-system/main-gateway": "istio-system/main-gateway",
+		"main-gateway":              "default/main-gateway",
+		" main-gateway ":            "default/main-gateway",
+	} {
+		if reference := istioGatewayReference(gateway, "default"); reference != expected {
+			t.Errorf("expected gateway %q to be normalized to %q, got %q", gateway, expected, reference)
+		}
+	}
+}
+
+func TestEventIsReissued(t *testing.T) {
+	created := &corev1.Event{Reason: "SuccessfulCreate"}
+	backOff := &corev1.Event{Reason: "BackOff"}
+	if eventIsReissued(created) || !eventIsReissued(backOff) {
+		t.Errorf("expected only the BackOff event to be reissued by default")
+	}
+
+	os.Setenv("IGNORE_EVENT_REASONS", "BackOff")
+	if !eventIsReissued(created) || eventIsReissued(backOff) {
+		t.Errorf("expected only the denylisted BackOff event not to be reissued")
+	}
+	os.Unsetenv("IGNORE_EVENT_REASONS")
+
+	os.Setenv("REISSUE_EVENT_REASONS", "FailedScheduling, BackOff, Unhealthy")
+	defer os.Unsetenv("REISSUE_EVENT_REASONS")
+	if eventIsReissued(created) || !eventIsReissued(backOff) {
+		t.Errorf("expected only the allowlisted BackOff event to be reissued")
+	}
+}
+
+func TestGenerateStatefulSetProcMount(t *testing.T) {
+	instance := newTestTheia()
+	procMount := corev1.UnmaskedProcMount
+	instance.Spec.Template.ProcMount = &procMount
+	if err := validateTheia(instance, nil); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	sc := generateStatefulSet(instance).Spec.Template.Spec.Containers[0].SecurityContext
+	if sc == nil || sc.ProcMount == nil || *sc.ProcMount != corev1.UnmaskedProcMount {
+		t.Errorf("expected the Unmasked procMount to be applied, got %+v", sc)
+	}
+	if instance.Spec.Template.Spec.Containers[0].SecurityContext != nil {
+		t.Errorf("expected the Theia not to be mutated")
+	}
+
+	procMount = "Masked"
+	if err := validateTheia(instance, nil); err == nil {
+		t.Error("expected an unknown procMount to be rejected")
+	}
+}
+
+func TestReconcileUserInstanceLimit(t *testing.T) {
+	os.Setenv("MAX_INSTANCES_PER_USER", "1")
+	defer os.Unsetenv("MAX_INSTANCES_PER_USER")
+	first := newTestTheia()
+	first.Labels = map[string]string{UserLabel: "alice"}
+	second := newTestTheia()
+	second.Name = "other-theia"
+	second.Namespace = "team"
+	second.Labels = map[string]string{UserLabel: "alice"}
+	r := newTestReconciler(first, second)
+
+	reconcileTheia(t, r, first)
+	found := reconcileTheia(t, r, second)
+	if len(found.Status.Conditions) == 0 || found.Status.Conditions[0].Type != QuotaExceeded {
+		t.Errorf("expected the second Theia of the user to be blocked, got %+v", found.Status.Conditions)
+	}
+	key := types.NamespacedName{Name: "other-theia", Namespace: "team"}
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected no StatefulSet above the per-user cap, got %v", err)
+	}
+
+	// the first Theia of the user is still reconciled
+	reconcileTheia(t, r, first)
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, &appsv1.StatefulSet{}); err != nil {
+		t.Errorf("expected the first Theia to keep its StatefulSet: %v", err)
+	}
+}
+
+func TestReconcileUserInstanceLimitOnResume(t *testing.T) {
+	os.Setenv("MAX_INSTANCES_PER_USER", "1")
+	defer os.Unsetenv("MAX_INSTANCES_PER_USER")
+	first := newTestTheia()
+	first.Labels = map[string]string{UserLabel: "alice"}
+	second := newTestTheia()
+	second.Name = "other-theia"
+	second.Labels = map[string]string{UserLabel: "alice"}
+	second.Spec.Stopped = true
+	r := newTestReconciler(first, second)
+
+	first = reconcileTheia(t, r, first)
+	second = reconcileTheia(t, r, second)
+	key := types.NamespacedName{Name: "other-theia", Namespace: "default"}
+	replicas := func() int32 {
+		ss := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), key, ss); err != nil {
+			t.Fatal(err)
+		}
+		return *ss.Spec.Replicas
+	}
+	if replicas() != 0 {
+		t.Fatalf("expected the stopped Theia to have a scaled down StatefulSet")
+	}
+
+	second.Spec.Stopped = false
+	if err := r.Update(context.TODO(), second); err != nil {
+		t.Fatal(err)
+	}
+	second = reconcileTheia(t, r, second)
+	if len(second.Status.Conditions) == 0 || second.Status.Conditions[0].Type != QuotaExceeded {
+		t.Errorf("expected the resumed Theia to be blocked, got %+v", second.Status.Conditions)
+	}
+	if replicas() != 0 {
+		t.Errorf("expected the resumed Theia above the per-user cap to stay scaled down")
+	}
+
+	// Once the first Theia is stopped, the second one can be resumed
+	first.Spec.Stopped = true
+	if err := r.Update(context.TODO(), first); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, first)
+	reconcileTheia(t, r, second)
+	if replicas() != 1 {
+		t.Errorf("expected the Theia to be resumed below the per-user cap")
+	}
+}
+
+func TestSnapshotWorkspaceOnCull(t *testing.T) {
+	os.Setenv("ENABLE_SNAPSHOT_ON_CULL", "true")
+	defer os.Unsetenv("ENABLE_SNAPSHOT_ON_CULL")
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	r := newTestReconciler(instance)
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: SnapshotGroup, Version: "v1beta1", Kind: "VolumeSnapshot"},
+		&unstructured.Unstructured{})
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: SnapshotGroup, Version: "v1beta1", Kind: "VolumeSnapshotList"},
+		&unstructured.UnstructuredList{})
+	instance = reconcileTheia(t, r, instance)
+
+	culler.SetStopAnnotation(&instance.ObjectMeta, nil)
+	if err := r.snapshotWorkspace(context.TODO(), instance, generateStatefulSet(instance)); err != nil {
+		t.Fatalf("unable to snapshot the workspace: %v", err)
+	}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	snapshotName := instance.Annotations[SnapshotAnnotation]
+	snapshot := newVolumeSnapshot()
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: snapshotName, Namespace: "default"}, snapshot); err != nil {
+		t.Fatalf("expected a VolumeSnapshot to be taken on cull: %v", err)
+	}
+	if source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName"); source != "theia-my-theia-0" {
+		t.Errorf("expected the snapshot of the workspace PVC, got %q", source)
+	}
+
+	// the workspace is restored from the snapshot on resume
+	culler.RemoveStopAnnotation(&instance.ObjectMeta)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "theia-my-theia-0", Namespace: "default"}, pvc); err != nil {
+		t.Fatalf("expected the workspace to be restored: %v", err)
+	}
+	if pvc.Spec.DataSource == nil || pvc.Spec.DataSource.Name != snapshotName {
+		t.Errorf("expected the workspace to be restored from %s, got %+v", snapshotName, pvc.Spec.DataSource)
+	}
+	if _, ok := instance.Annotations[SnapshotAnnotation]; ok {
+		t.Errorf("expected the snapshot annotation to be removed once restored")
+	}
+}
+
+func TestGenerateVirtualServiceRouteName(t *testing.T) {
+	routeName := func() interface{} {
+		vsvc, err := generateVirtualService(newTestTheia())
+		if err != nil {
+			t.Fatal(err)
+		}
+		http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+		return http[0].(map[string]interface{})["name"]
+	}
+	if name := routeName(); name != "theia-my-theia" {
+		t.Errorf("expected the default route name, got %v", name)
+	}
+	os.Setenv("ISTIO_ROUTE_NAME", "{namespace}-{name}")
+	defer os.Unsetenv("ISTIO_ROUTE_NAME")
+	if name := routeName(); name != "default-my-theia" {
+		t.Errorf("expected the configured route name, got %v", name)
+	}
+	os.Setenv("ISTIO_ROUTE_NAME", "")
+	if name := routeName(); name != nil {
+		t.Errorf("expected no route name, got %v", name)
+	}
+}
+
+func TestGenerateStatefulSetDerivesLimits(t *testing.T) {
+	os.Setenv("LIMITS_TO_REQUESTS_RATIO", "2")
+	defer os.Unsetenv("LIMITS_TO_REQUESTS_RATIO")
+	instance := newTestTheia()
+	resources := generateStatefulSet(instance).Spec.Template.Spec.Containers[0].Resources
+	if resources.Limits != nil {
+		t.Errorf("expected no limits without requests, got %v", resources.Limits)
+	}
+
+	instance.Spec.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("500m"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+		},
+		Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+	}
+	limits := generateStatefulSet(instance).Spec.Template.Spec.Containers[0].Resources.Limits
+	if cpu := limits[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("4")) != 0 {
+		t.Errorf("expected the cpu limit to be kept, got %s", cpu.String())
+	}
+	if memory := limits[corev1.ResourceMemory]; memory.Cmp(resource.MustParse("2Gi")) != 0 {
+		t.Errorf("expected the memory limit to be twice the request, got %s", memory.String())
+	}
+	if _, ok := instance.Spec.Template.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory]; ok {
+		t.Errorf("expected the Theia not to be mutated")
+	}
+}
+
+func TestReconcileSkipsTerminatingNamespace(t *testing.T) {
+	instance := newTestTheia()
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+	}
+	r := newTestReconciler(instance, namespace)
+	found := reconcileTheia(t, r, instance)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected no StatefulSet in a terminating namespace, got %v", err)
+	}
+	if len(found.Status.Conditions) != 0 {
+		t.Errorf("expected the status to be left alone, got %+v", found.Status.Conditions)
+	}
+}
+
+func TestGenerateStatefulSetReadinessProbe(t *testing.T) {
+	os.Setenv("ADD_READINESS_PROBE", "true")
+	defer os.Unsetenv("ADD_READINESS_PROBE")
+	probe := generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0].ReadinessProbe
+	if probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Path != "/" || probe.HTTPGet.Port.IntValue() != DefaultContainerPort {
+		t.Errorf("expected a HTTP readiness probe, got %+v", probe)
+	}
+
+	os.Setenv("PROBE_SUCCESS_STATUS", "401")
+	defer os.Unsetenv("PROBE_SUCCESS_STATUS")
+	probe = generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0].ReadinessProbe
+	if probe == nil || probe.HTTPGet != nil || probe.TCPSocket == nil || probe.TCPSocket.Port.IntValue() != DefaultContainerPort {
+		t.Errorf("expected a TCP readiness probe for a status the kubelet can't check, got %+v", probe)
+	}
+
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+		Handler: corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}},
+	}
+	probe = generateStatefulSet(instance).Spec.Template.Spec.Containers[0].ReadinessProbe
+	if probe.Exec == nil || probe.TCPSocket != nil {
+		t.Errorf("expected the user probe to be kept, got %+v", probe)
+	}
+}
+
+func TestMaxIdleTime(t *testing.T) {
+	instance := newTestTheia()
+	if idle := maxIdleTime(instance); idle != culler.GetMaxIdleTime() {
+		t.Errorf("expected the default idle time, got %s", idle)
+	}
+	idleTimeMinutes := int32(0)
+	instance.Spec.CullingPolicy = &v1alpha1.CullingPolicySpec{IdleTimeMinutes: &idleTimeMinutes}
+	if idle := maxIdleTime(instance); idle != 0 {
+		t.Errorf("expected an idle time of 0 to be kept, got %s", idle)
+	}
+	idleTimeMinutes = 90
+	if idle := maxIdleTime(instance); idle != 90*time.Minute {
+		t.Errorf("expected the idle time of the culling policy, got %s", idle)
+	}
+}
+
+func TestReconcileSpecStopped(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Stopped = true
+	r := newTestReconciler(instance)
+	found := reconcileTheia(t, r, instance)
+	if found.Annotations[culler.STOP_REASON_ANNOTATION] != culler.STOP_REASON_SPEC {
+		t.Errorf("expected the stop reason %s, got %v", culler.STOP_REASON_SPEC, found.Annotations)
+	}
+	ss := &appsv1.StatefulSet{}
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	if *ss.Spec.Replicas != 0 {
+		t.Errorf("expected 0 replicas while stopped, got %d", *ss.Spec.Replicas)
+	}
+
+	found.Spec.Stopped = false
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatal(err)
+	}
+	found = reconcileTheia(t, r, found)
+	if culler.StopAnnotationIsSet(found.ObjectMeta) {
+		t.Errorf("expected the stop annotation to be cleared, got %v", found.Annotations)
+	}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	if *ss.Spec.Replicas != 1 {
+		t.Errorf("expected 1 replica once resumed, got %d", *ss.Spec.Replicas)
+	}
+
+	// A Theia stopped by the culler stays stopped
+	culled := &v1alpha1.Theia{}
+	found.DeepCopyInto(culled)
+	culled.Annotations = map[string]string{
+		culler.STOP_ANNOTATION:        time.Now().Format(time.RFC3339),
+		culler.STOP_REASON_ANNOTATION: culler.STOP_REASON_CULLED,
+	}
+	if syncStopAnnotation(culled) || !culler.StopAnnotationIsSet(culled.ObjectMeta) {
+		t.Errorf("expected the culler stop annotation to be kept, got %v", culled.Annotations)
+	}
+}
+
+func TestGenerateStatefulSetDisablesPrivilegeEscalation(t *testing.T) {
+	sc := generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0].SecurityContext
+	if sc == nil || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		t.Errorf("expected allowPrivilegeEscalation to be false by default, got %+v", sc)
+	}
+
+	instance := newTestTheia()
+	allow := true
+	instance.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{AllowPrivilegeEscalation: &allow}
+	sc = generateStatefulSet(instance).Spec.Template.Spec.Containers[0].SecurityContext
+	if sc.AllowPrivilegeEscalation == nil || !*sc.AllowPrivilegeEscalation {
+		t.Errorf("expected the user allowPrivilegeEscalation to be kept, got %+v", sc)
+	}
+
+	os.Setenv("DISABLE_PRIVILEGE_ESCALATION", "false")
+	defer os.Unsetenv("DISABLE_PRIVILEGE_ESCALATION")
+	if sc := generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0].SecurityContext; sc != nil {
+		t.Errorf("expected no security context when disabled, got %+v", sc)
+	}
+}
+
+func TestReconcileEnvoyFilterGatewayTimeout(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	os.Setenv("ENABLE_GATEWAY_TIMEOUT", "true")
+	defer os.Unsetenv("ENABLE_GATEWAY_TIMEOUT")
+	instance := newTestTheia()
+	instance.Spec.GatewayTimeout = &metav1.Duration{Duration: time.Hour}
+	r := newTestReconciler(instance)
+	for _, kind := range []string{"VirtualService", "EnvoyFilter"} {
+		r.Scheme.AddKnownTypeWithName(
+			schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: kind},
+			&unstructured.Unstructured{})
+	}
+	instance = reconcileTheia(t, r, instance)
+
+	envoyFilter := newEnvoyFilter()
+	key := types.NamespacedName{Name: "theia-my-theia-timeout", Namespace: "default"}
+	if err := r.Get(context.TODO(), key, envoyFilter); err != nil {
+		t.Fatalf("expected an EnvoyFilter to be created: %v", err)
+	}
+	patches, _, _ := unstructured.NestedSlice(envoyFilter.Object, "spec", "configPatches")
+	if len(patches) != 1 {
+		t.Fatalf("expected a single config patch, got %v", patches)
+	}
+	patch := patches[0].(map[string]interface{})
+	if timeout, _, _ := unstructured.NestedString(patch, "patch", "value", "route", "idle_timeout"); timeout != "3600s" {
+		t.Errorf("expected the idle timeout 3600s, got %q", timeout)
+	}
+	if route, _, _ := unstructured.NestedString(patch, "match", "routeConfiguration", "vhost", "route", "name"); route != "theia-my-theia" {
+		t.Errorf("expected the route of the virtual service to be patched, got %q", route)
+	}
+	if owners := envoyFilter.GetOwnerReferences(); len(owners) != 1 || owners[0].Name != "my-theia" {
+		t.Errorf("expected the Theia to own the EnvoyFilter, got %+v", owners)
+	}
+
+	instance.Spec.GatewayTimeout = nil
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), key, newEnvoyFilter()); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the EnvoyFilter to be deleted with the timeout, got %v", err)
+	}
+
+	instance.Spec.GatewayTimeout = &metav1.Duration{Duration: time.Hour}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), key, newEnvoyFilter()); err != nil {
+		t.Fatalf("expected the EnvoyFilter to be created again: %v", err)
+	}
+	os.Unsetenv("ENABLE_GATEWAY_TIMEOUT")
+	reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), key, newEnvoyFilter()); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the EnvoyFilter to be deleted once disabled, got %v", err)
+	}
+}
+
+func TestReconcileStatusURL(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	if found := reconcileTheia(t, r, instance); found.Status.URL != "http://my-theia.default.svc.cluster.local/" {
+		t.Errorf("expected the service URL without Istio, got %q", found.Status.URL)
+	}
+
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: "VirtualService"},
+		&unstructured.Unstructured{})
+	if found := reconcileTheia(t, r, instance); found.Status.URL != "/theia/default/my-theia/" {
+		t.Errorf("expected the gateway prefix with Istio, got %q", found.Status.URL)
+	}
+}
+
+func TestGenerateStatefulSetDefaultResources(t *testing.T) {
+	os.Setenv("DEFAULT_CPU_REQUEST", "500m")
+	defer os.Unsetenv("DEFAULT_CPU_REQUEST")
+	os.Setenv("DEFAULT_MEMORY_LIMIT", "2Gi")
+	defer os.Unsetenv("DEFAULT_MEMORY_LIMIT")
+	resources := generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0].Resources
+	if cpu := resources.Requests[corev1.ResourceCPU]; cpu.String() != "500m" {
+		t.Errorf("expected the default cpu request 500m, got %s", cpu.String())
+	}
+	if memory := resources.Limits[corev1.ResourceMemory]; memory.String() != "2Gi" {
+		t.Errorf("expected the default memory limit 2Gi, got %s", memory.String())
+	}
+
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+	}
+	resources = generateStatefulSet(instance).Spec.Template.Spec.Containers[0].Resources
+	if len(resources.Limits) != 0 || len(resources.Requests) != 1 {
+		t.Errorf("expected the user resources to be kept, got %+v", resources)
+	}
+}
+
+func TestCullTheiaCommitsWorkspace(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.GitRepo = &v1alpha1.GitRepoSpec{URL: "https://github.com/e2fyi/theia-controller.git"}
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	committed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		found := &v1alpha1.Theia{}
+		key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+		if err := r.Get(context.TODO(), key, found); err != nil || culler.StopAnnotationIsSet(found.ObjectMeta) {
+			t.Errorf("expected the workspace to be committed before the Theia is stopped")
+		}
+		if req.Method != http.MethodPost || req.URL.Path != "/default/my-theia/commit" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		committed = true
+	}))
+	defer server.Close()
+	os.Setenv("ENABLE_GIT_COMMIT_ON_CULL", "true")
+	defer os.Unsetenv("ENABLE_GIT_COMMIT_ON_CULL")
+	os.Setenv("GIT_COMMIT_URL", server.URL+"/{namespace}/{name}/commit")
+	defer os.Unsetenv("GIT_COMMIT_URL")
+
+	if err := r.cullTheia(context.TODO(), instance, generateStatefulSet(instance), culler.STOP_REASON_CULLED, "Stopped the idle Theia"); err != nil {
+		t.Fatal(err)
+	}
+	if !committed {
+		t.Errorf("expected the workspace to be committed on cull")
+	}
+	if !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		t.Errorf("expected the Theia to be stopped after the commit")
+	}
+}
+
+func TestGenerateServiceMultiplePorts(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{
+		{Name: "theia-port", ContainerPort: 3000, Protocol: corev1.ProtocolTCP},
+		{Name: "lsp", ContainerPort: 5007},
+		{ContainerPort: 9229, Protocol: corev1.ProtocolUDP},
+	}
+	ports := generateService(instance).Spec.Ports
+	expected := []corev1.ServicePort{
+		{Name: "http-my-theia", Port: DefaultServingPort, TargetPort: intstr.FromInt(3000), Protocol: corev1.ProtocolTCP},
+		{Name: "lsp", Port: 5007, TargetPort: intstr.FromInt(5007), Protocol: corev1.ProtocolTCP},
+		{Name: "port-9229", Port: 9229, TargetPort: intstr.FromInt(9229), Protocol: corev1.ProtocolUDP},
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected the service ports %+v, got %+v", expected, ports)
+	}
+}
+
+func TestGenerateVirtualServiceClusterDomain(t *testing.T) {
+	os.Setenv("CLUSTER_DOMAIN", "k8s.internal")
+	defer os.Unsetenv("CLUSTER_DOMAIN")
+	vsvc, err := generateVirtualService(newTestTheia())
+	if err != nil {
+		t.Fatal(err)
+	}
+	http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+	routes := http[0].(map[string]interface{})["route"].([]interface{})
+	host, _, _ := unstructured.NestedString(routes[0].(map[string]interface{}), "destination", "host")
+	if host != "my-theia.default.svc.k8s.internal" {
+		t.Errorf("expected the destination in the cluster domain, got %q", host)
+	}
+	if url := theiaURL(newTestTheia()); url != "http://my-theia.default.svc.k8s.internal/" {
+		t.Errorf("expected the status url in the cluster domain, got %q", url)
+	}
+}
+
+func TestReconcileAdoptsUnownedResources(t *testing.T) {
+	instance := newTestTheia()
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 8080}},
+		},
+	}
+	r := newTestReconciler(instance, service)
+	reconcileTheia(t, r, instance)
+	found := &corev1.Service{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, found); err != nil {
+		t.Fatal(err)
+	}
+	if owner := metav1.GetControllerOf(found); owner == nil || owner.Kind != "Theia" || owner.Name != "my-theia" {
+		t.Errorf("expected the Service to be adopted by the Theia, got %+v", found.OwnerReferences)
+	}
+	if found.Spec.Ports[0].Name != "http-my-theia" {
+		t.Errorf("expected the adopted Service to be updated, got %+v", found.Spec.Ports)
+	}
+
+	controller := true
+	owned := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other-theia",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: "other", Controller: &controller,
+			}},
+		},
+	}
+	other := newTestTheia()
+	other.Name = "other-theia"
+	r = newTestReconciler(other, owned)
+	reconcileTheia(t, r, other)
+	found = &corev1.Service{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "other-theia", Namespace: "default"}, found); err != nil {
+		t.Fatal(err)
+	}
+	if owner := metav1.GetControllerOf(found); owner == nil || owner.Kind != "Deployment" || len(found.Spec.Ports) != 0 {
+		t.Errorf("expected the Service of another owner to be left alone, got %+v", found)
+	}
+	if events := strings.Join(drainEvents(r), "\n"); !strings.Contains(events, EventReasonOwnerConflict) {
+		t.Errorf("expected an %s event, got %s", EventReasonOwnerConflict, events)
+	}
+}
+
+func TestReconcileIngress(t *testing.T) {
+	os.Setenv("USE_INGRESS", "true")
+	defer os.Unsetenv("USE_INGRESS")
+	os.Setenv("INGRESS_CLASS", "nginx")
+	defer os.Unsetenv("INGRESS_CLASS")
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+		&unstructured.Unstructured{})
+	reconcileTheia(t, r, instance)
+
+	ingress := newIngress()
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ingress); err != nil {
+		t.Fatalf("expected an Ingress to be created: %v", err)
+	}
+	if class, _, _ := unstructured.NestedString(ingress.Object, "spec", "ingressClassName"); class != "nginx" {
+		t.Errorf("expected the ingress class nginx, got %q", class)
+	}
+	rules, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "rules")
+	paths, _, _ := unstructured.NestedSlice(rules[0].(map[string]interface{}), "http", "paths")
+	path := paths[0].(map[string]interface{})
+	if path["path"] != "/theia/default/my-theia/(.*)" {
+		t.Errorf("expected the prefix of the Theia, got %v", path["path"])
+	}
+	if service, _, _ := unstructured.NestedString(path, "backend", "service", "name"); service != "my-theia" {
+		t.Errorf("expected the Service of the Theia as backend, got %q", service)
+	}
+	if ingress.GetAnnotations()[RewriteTargetAnnotation] != "/$1" {
+		t.Errorf("expected the rewrite-target annotation, got %v", ingress.GetAnnotations())
+	}
+	if owners := ingress.GetOwnerReferences(); len(owners) != 1 || owners[0].Name != "my-theia" {
+		t.Errorf("expected the Theia to own the Ingress, got %+v", owners)
+	}
+
+	os.Unsetenv("USE_INGRESS")
+	reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, newIngress()); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the Ingress to be deleted once disabled, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetArchitectureImage(t *testing.T) {
+	os.Setenv("ARCHITECTURE_IMAGES", "amd64=theiaide/theia:latest, arm64=theiaide/theia-arm64:latest")
+	defer os.Unsetenv("ARCHITECTURE_IMAGES")
+	os.Setenv("DEFAULT_ARCHITECTURE", "amd64")
+	defer os.Unsetenv("DEFAULT_ARCHITECTURE")
+	for arch, image := range map[string]string{
+		"":      "theiaide/theia:latest",
+		"arm64": "theiaide/theia-arm64:latest",
+	} {
+		instance := newTestTheia()
+		instance.Spec.Template.Architecture = arch
+		podSpec := generateStatefulSet(instance).Spec.Template.Spec
+		if podSpec.Containers[0].Image != image {
+			t.Errorf("expected the image %s for architecture %q, got %s", image, arch, podSpec.Containers[0].Image)
+		}
+		expected := arch
+		if expected == "" {
+			expected = "amd64"
+		}
+		if selected := podSpec.NodeSelector[corev1.LabelArchStable]; selected != expected {
+			t.Errorf("expected the nodes of architecture %s to be selected, got %q", expected, selected)
+		}
+	}
+
+	// an unknown architecture falls back to the default image without selector
+	instance := newTestTheia()
+	instance.Spec.Template.Architecture = "s390x"
+	podSpec := generateStatefulSet(instance).Spec.Template.Spec
+	if podSpec.Containers[0].Image != DefaultImage || len(podSpec.NodeSelector) != 0 {
+		t.Errorf("expected the default image without node selector, got %s %v", podSpec.Containers[0].Image, podSpec.NodeSelector)
+	}
+}
+
+func TestReconcileRunningCount(t *testing.T) {
+	instance := newTestTheia()
+	instance.Namespace = "running-count"
+	r := newTestReconciler(instance)
+	running := func() float64 {
+		return testutil.ToFloat64(testMetrics.TheiaRunningCount.WithLabelValues("running-count"))
+	}
+	instance = reconcileTheia(t, r, instance)
+	instance = reconcileTheia(t, r, instance)
+	if count := running(); count != 1 {
+		t.Errorf("expected 1 running Theia, got %v", count)
+	}
+
+	culler.SetStopAnnotation(&instance.ObjectMeta, nil)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if count := running(); count != 0 {
+		t.Errorf("expected the culled Theia not to be running, got %v", count)
+	}
+
+	culler.RemoveStopAnnotation(&instance.ObjectMeta)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+	if count := running(); count != 1 {
+		t.Errorf("expected the resumed Theia to be running again, got %v", count)
+	}
+}
+
+func TestReconcileExtensionsConfigMap(t *testing.T) {
+	os.Setenv("ENABLE_EXTENSIONS_CONFIGMAP", "true")
+	defer os.Unsetenv("ENABLE_EXTENSIONS_CONFIGMAP")
+	os.Setenv("THEIA_EXTENSIONS", "redhat.java")
+	defer os.Unsetenv("THEIA_EXTENSIONS")
+	instance := newTestTheia()
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "default",
+			Annotations: map[string]string{ExtensionsAnnotation: "ms-python.python, golang.go"},
+		},
+	}
+	r := newTestReconciler(instance, namespace)
+	reconcileTheia(t, r, instance)
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia-extensions", Namespace: "default"}, configMap); err != nil {
+		t.Fatalf("expected the extensions ConfigMap to be created: %v", err)
+	}
+	extensions := map[string][]string{}
+	if err := json.Unmarshal([]byte(configMap.Data[ExtensionsKey]), &extensions); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"ms-python.python", "golang.go"}; !reflect.DeepEqual(extensions["recommendations"], expected) {
+		t.Errorf("expected the extensions of the namespace %v, got %v", expected, extensions)
+	}
+	if owners := configMap.OwnerReferences; len(owners) != 1 || owners[0].Name != "my-theia" {
+		t.Errorf("expected the Theia to own the ConfigMap, got %+v", owners)
+	}
+
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	if !hasVolume(&ss.Spec.Template.Spec, "theia-extensions") {
+		t.Errorf("expected the extensions ConfigMap to be mounted, got %+v", ss.Spec.Template.Spec.Volumes)
+	}
+	if value := envValue(ss.Spec.Template.Spec.Containers[0].Env, "THEIA_DEFAULT_PLUGINS"); value != "local-dir:"+ExtensionsMountPath {
+		t.Errorf("expected the extensions to be a plugin source of Theia, got %q", value)
+	}
+
+	// The plugin sources of the container are kept
+	instance = newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "THEIA_DEFAULT_PLUGINS", Value: "local-dir:/plugins"}}
+	container := generateStatefulSet(instance).Spec.Template.Spec.Containers[0]
+	if value := envValue(container.Env, "THEIA_DEFAULT_PLUGINS"); value != "local-dir:/plugins,local-dir:"+ExtensionsMountPath {
+		t.Errorf("expected the extensions to be added to the plugin sources, got %q", value)
+	}
+
+	// A change of the annotation of the namespace requeues its Theia
+	requests := r.namespaceExtensionsRequests(handler.MapObject{Meta: namespace, Object: namespace})
+	if len(requests) != 1 || requests[0].Name != "my-theia" {
+		t.Errorf("expected the Theia of the namespace to be requeued, got %+v", requests)
+	}
+	updated := namespace.DeepCopy()
+	updated.Annotations[ExtensionsAnnotation] = "golang.go"
+	if !extensionsAnnotationChanged.Update(event.UpdateEvent{MetaOld: namespace, ObjectOld: namespace, MetaNew: updated, ObjectNew: updated}) {
+		t.Errorf("expected a change of the extensions annotation to be let through")
+	}
+}
+
+func TestReconcileObservesReadyLatency(t *testing.T) {
+	instance := newTestTheia()
+	instance.Namespace = "ready-latency"
+	instance.CreationTimestamp = metav1.NewTime(time.Now().Add(-30 * time.Second))
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	ss := &appsv1.StatefulSet{}
+	key := types.NamespacedName{Name: "my-theia", Namespace: "ready-latency"}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	ss.Status.ReadyReplicas = 1
+	if err := r.Update(context.TODO(), ss); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if _, ok := instance.Annotations[ReadyAtAnnotation]; !ok {
+		t.Errorf("expected the ready latency to be marked as observed, got %v", instance.Annotations)
+	}
+
+	// becoming ready again after a cull isn't observed
+	instance.Status.ReadyReplicas = 0
+	if err := r.Status().Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+
+	metric := &dto.Metric{}
+	observer := testMetrics.TheiaReadyLatency.WithLabelValues("ready-latency")
+	if err := observer.(prometheus.Histogram).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	if count := metric.GetHistogram().GetSampleCount(); count != 1 {
+		t.Errorf("expected a single observation, got %d", count)
+	}
+	if sum := metric.GetHistogram().GetSampleSum(); sum < 30 || sum > 60 {
+		t.Errorf("expected a latency of about 30s, got %v", sum)
+	}
+}
+
+func TestReconcileRejectsInvalidContainers(t *testing.T) {
+	empty := newTestTheia()
+	empty.Spec.Template.Spec.Containers = nil
+	badPort := newTestTheia()
+	badPort.Name = "bad-port"
+	badPort.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: -1}}
+	r := newTestReconciler(empty, badPort)
+	for _, instance := range []*v1alpha1.Theia{empty, badPort} {
+		found := reconcileTheia(t, r, instance)
+		if found.Status.Phase != v1alpha1.TheiaError || found.Status.Conditions[0].Reason != "Rejected" {
+			t.Errorf("expected %s to be rejected, got %+v", instance.Name, found.Status)
+		}
+		key := types.NamespacedName{Name: instance.Name, Namespace: "default"}
+		if err := r.Get(context.TODO(), key, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+			t.Errorf("expected no StatefulSet for %s, got %v", instance.Name, err)
+		}
+	}
+}
+
+func TestReconcileDefaultsEmptyContainerPorts(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{}
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	if ports := ss.Spec.Template.Spec.Containers[0].Ports; len(ports) != 1 || ports[0].ContainerPort != DefaultContainerPort {
+		t.Errorf("expected the default container port, got %+v", ports)
+	}
+	if port := generateService(instance).Spec.Ports[0].TargetPort.IntValue(); port != DefaultContainerPort {
+		t.Errorf("expected the Service to target the default port, got %d", port)
+	}
+}
+
+func TestReconcilePublishNotReadyAddresses(t *testing.T) {
+	if generateService(newTestTheia()).Spec.PublishNotReadyAddresses {
+		t.Errorf("expected the not ready addresses not to be published by default")
+	}
+	os.Setenv("USE_HEADLESS_SERVICE", "true")
+	defer os.Unsetenv("USE_HEADLESS_SERVICE")
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	publish := true
+	instance.Spec.PublishNotReadyAddresses = &publish
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+	for _, name := range []string{"my-theia", "my-theia-headless"} {
+		service := &corev1.Service{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "default"}, service); err != nil {
+			t.Fatal(err)
+		}
+		if !service.Spec.PublishNotReadyAddresses {
+			t.Errorf("expected Service %s to publish the not ready addresses", name)
+		}
+	}
+}
+
+func TestTheiaDefaulter(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaulter := &TheiaDefaulter{}
+	_ = defaulter.InjectDecoder(decoder)
+
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].WorkingDir = "/workspace"
+	raw, _ := json.Marshal(instance)
+	resp := defaulter.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: raw},
+	}})
+	if !resp.Allowed {
+		t.Fatalf("expected the Theia to be admitted, got %+v", resp.Result)
+	}
+	patched := map[string]interface{}{}
+	for _, patch := range resp.Patches {
+		patched[patch.Path] = patch.Value
+	}
+	expected := map[string]interface{}{
+		"/spec/template/spec/containers/0/image": DefaultImage,
+		"/spec/template/spec/containers/0/ports": []interface{}{map[string]interface{}{
+			"name": "theia-port", "containerPort": float64(DefaultContainerPort), "protocol": "TCP",
+		}},
+	}
+	if !reflect.DeepEqual(patched, expected) {
+		t.Errorf("expected the patches %v, got %v", expected, patched)
+	}
+}
+
+func TestReconcileRecordsAssignment(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+	if instance.Status.AssignedAt != nil {
+		t.Errorf("expected a Theia without user not to be assigned, got %v", instance.Status.AssignedAt)
+	}
+
+	instance.Labels = map[string]string{UserLabel: "alice"}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if instance.Status.AssignedAt == nil {
+		t.Fatalf("expected the assignment to the user to be recorded")
+	}
+	assignedAt := instance.Status.AssignedAt.Time
+	instance = reconcileTheia(t, r, instance)
+	if !instance.Status.AssignedAt.Time.Equal(assignedAt) {
+		t.Errorf("expected the assignment time to be kept, got %v", instance.Status.AssignedAt)
+	}
+}
+
+func TestReconcileImagePullSecrets(t *testing.T) {
+	os.Setenv("DEFAULT_IMAGE_PULL_SECRETS", "shared-registry")
+	defer os.Unsetenv("DEFAULT_IMAGE_PULL_SECRETS")
+	secrets := generateStatefulSet(newTestTheia()).Spec.Template.Spec.ImagePullSecrets
+	if expected := []corev1.LocalObjectReference{{Name: "shared-registry"}}; !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("expected the default pull secrets %v, got %v", expected, secrets)
+	}
+
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+	instance.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "my-registry"}}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	if expected := instance.Spec.ImagePullSecrets; !reflect.DeepEqual(ss.Spec.Template.Spec.ImagePullSecrets, expected) {
+		t.Errorf("expected the StatefulSet to be updated with the pull secrets %v, got %v",
+			expected, ss.Spec.Template.Spec.ImagePullSecrets)
+	}
+}
+
+func TestReconcileDestinationRule(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	os.Setenv("ENABLE_DESTINATION_RULE", "true")
+	defer os.Unsetenv("ENABLE_DESTINATION_RULE")
+	os.Setenv("ISTIO_MAX_CONNECTIONS", "64")
+	defer os.Unsetenv("ISTIO_MAX_CONNECTIONS")
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	for _, kind := range []string{"VirtualService", "DestinationRule"} {
+		r.Scheme.AddKnownTypeWithName(
+			schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: kind},
+			&unstructured.Unstructured{})
+	}
+	instance = reconcileTheia(t, r, instance)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	destinationRule := newDestinationRule()
+	if err := r.Get(context.TODO(), key, destinationRule); err != nil {
+		t.Fatalf("expected a DestinationRule to be created: %v", err)
+	}
+	if host, _, _ := unstructured.NestedString(destinationRule.Object, "spec", "host"); host != "my-theia.default.svc.cluster.local" {
+		t.Errorf("expected the service of the Theia as host, got %q", host)
+	}
+	maxConnections, _, _ := unstructured.NestedInt64(destinationRule.Object,
+		"spec", "trafficPolicy", "connectionPool", "tcp", "maxConnections")
+	if maxConnections != 64 {
+		t.Errorf("expected 64 max connections, got %d", maxConnections)
+	}
+	if owners := destinationRule.GetOwnerReferences(); len(owners) != 1 || owners[0].Name != "my-theia" {
+		t.Errorf("expected the Theia to own the DestinationRule, got %+v", owners)
+	}
+
+	os.Setenv("ISTIO_MAX_CONNECTIONS", "128")
+	reconcileTheia(t, r, instance)
+	destinationRule = newDestinationRule()
+	if err := r.Get(context.TODO(), key, destinationRule); err != nil {
+		t.Fatal(err)
+	}
+	maxConnections, _, _ = unstructured.NestedInt64(destinationRule.Object,
+		"spec", "trafficPolicy", "connectionPool", "tcp", "maxConnections")
+	if maxConnections != 128 {
+		t.Errorf("expected the DestinationRule to be updated to 128 max connections, got %d", maxConnections)
+	}
+	consecutiveErrors, _, _ := unstructured.NestedInt64(destinationRule.Object,
+		"spec", "trafficPolicy", "outlierDetection", "consecutive5xxErrors")
+	if consecutiveErrors != DefaultConsecutive5xxErrors {
+		t.Errorf("expected %d consecutive 5xx errors, got %d", DefaultConsecutive5xxErrors, consecutiveErrors)
+	}
+
+	os.Unsetenv("ENABLE_DESTINATION_RULE")
+	reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), key, newDestinationRule()); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the DestinationRule to be deleted once disabled, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetProxyEnv(t *testing.T) {
+	os.Setenv("DEFAULT_HTTP_PROXY", "http://proxy.corp:3128")
+	defer os.Unsetenv("DEFAULT_HTTP_PROXY")
+	os.Setenv("DEFAULT_NO_PROXY", ".svc,.cluster.local")
+	defer os.Unsetenv("DEFAULT_NO_PROXY")
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "NO_PROXY", Value: "localhost"}}
+	container := generateStatefulSet(instance).Spec.Template.Spec.Containers[0]
+
+	env := map[string][]string{}
+	for _, e := range container.Env {
+		env[e.Name] = append(env[e.Name], e.Value)
+	}
+	if values := env["HTTP_PROXY"]; len(values) != 1 || values[0] != "http://proxy.corp:3128" {
+		t.Errorf("expected HTTP_PROXY to be injected, got %v", values)
+	}
+	if values := env["NO_PROXY"]; len(values) != 1 || values[0] != "localhost" {
+		t.Errorf("expected NO_PROXY of the Theia to be kept, got %v", values)
+	}
+	if values, ok := env["HTTPS_PROXY"]; ok {
+		t.Errorf("expected no HTTPS_PROXY when unconfigured, got %v", values)
+	}
+}
+
+func TestGenerateStatefulSetVolumeSpec(t *testing.T) {
+	storageClass := "standard"
+	instance := newTestTheia()
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Spec.GitRepo = &v1alpha1.GitRepoSpec{URL: "https://github.com/e2fyi/theia-controller.git"}
+	instance.Spec.Volume = &v1alpha1.VolumeSpec{Name: "workspace", MountPath: "/workspace"}
+	ss := generateStatefulSet(instance)
+
+	if templates := ss.Spec.VolumeClaimTemplates; len(templates) != 1 || templates[0].Name != "workspace" {
+		t.Errorf("expected a volume claim template named workspace, got %+v", templates)
+	}
+	mounts := ss.Spec.Template.Spec.Containers[0].VolumeMounts
+	if len(mounts) != 1 || mounts[0].Name != "workspace" || mounts[0].MountPath != "/workspace" {
+		t.Errorf("expected the workspace to be mounted at /workspace, got %+v", mounts)
+	}
+	if target := ss.Spec.Template.Spec.InitContainers[0].Args[1]; target != "/workspace/theia-controller" {
+		t.Errorf("expected the repo to be cloned into /workspace, got %s", target)
+	}
+	if claim, _ := newTestReconciler().workspaceClaimName(context.TODO(), instance, ss); claim != "workspace-my-theia-0" {
+		t.Errorf("expected the workspace PVC workspace-my-theia-0, got %s", claim)
+	}
+
+	ss = generateStatefulSet(newTestTheia())
+	mounts = ss.Spec.Template.Spec.Containers[0].VolumeMounts
+	if len(mounts) != 1 || mounts[0].Name != DefaultVolumeName || mounts[0].MountPath != DefaultMountPath {
+		t.Errorf("expected the default workspace mount, got %+v", mounts)
+	}
+}
+
+func TestReconcileWarnsUnschedulableOnce(t *testing.T) {
+	instance := newTestTheia()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia-0", Namespace: "default", Labels: map[string]string{"statefulset": "my-theia"}},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+			Type:    corev1.PodScheduled,
+			Status:  corev1.ConditionFalse,
+			Reason:  corev1.PodReasonUnschedulable,
+			Message: "0/3 nodes are available: 3 Insufficient memory.",
+		}}},
+	}
+	r := newTestReconciler(instance, pod)
+	count := func() int {
+		n := 0
+		for _, e := range drainEvents(r) {
+			if strings.HasPrefix(e, "Warning "+EventReasonUnschedulable) {
+				n++
+			}
+		}
+		return n
+	}
+	found := reconcileTheia(t, r, instance)
+	found = reconcileTheia(t, r, found)
+	if n := count(); n != 1 {
+		t.Errorf("expected the Unschedulable warning to be emitted once, got %d", n)
+	}
+
+	pod.Status.Conditions[0].Status = corev1.ConditionTrue
+	pod.Status.Conditions[0].Reason = ""
+	_ = r.Status().Update(context.TODO(), pod)
+	found = reconcileTheia(t, r, found)
+	if _, ok := found.Status.Warnings[EventReasonUnschedulable]; ok {
+		t.Errorf("expected the Unschedulable warning to be cleared once scheduled")
+	}
+	pod.Status.Conditions[0].Status = corev1.ConditionFalse
+	pod.Status.Conditions[0].Reason = corev1.PodReasonUnschedulable
+	_ = r.Status().Update(context.TODO(), pod)
+	reconcileTheia(t, r, found)
+	if n := count(); n != 1 {
+		t.Errorf("expected the Unschedulable warning to be emitted again, got %d", n)
+	}
+}
+
+func TestReconcilePodWithoutContainerStatuses(t *testing.T) {
+	instance := newTestTheia()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "my-theia-0", Namespace: "default", Labels: map[string]string{"statefulset": "my-theia"}}}
+	r := newTestReconciler(instance, pod)
+	found := reconcileTheia(t, r, instance)
+	conditions := found.Status.Conditions
+	if len(conditions) != 1 || conditions[0].Type != "Pending" || conditions[0].Reason != "Creating" {
+		t.Fatalf("expected an initial Pending condition, got %+v", conditions)
+	}
+	if found.Status.Phase != v1alpha1.TheiaProvisioning {
+		t.Errorf("expected phase Pending, got %s", found.Status.Phase)
+	}
+
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+	}}
+	if err := r.Update(context.TODO(), pod); err != nil {
+		t.Fatal(err)
+	}
+	found = reconcileTheia(t, r, found)
+	if conditions := found.Status.Conditions; len(conditions) != 2 || conditions[0].Type != "Running" {
+		t.Errorf("expected the Running condition to follow the Pending one, got %+v", conditions)
+	}
+}
+
+func TestReconcileExistingClaim(t *testing.T) {
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	os.Setenv("CULLED_RETENTION_TIME", "1440")
+	defer os.Unsetenv("CULLED_RETENTION_TIME")
+	storageClass := "standard"
+	instance := newTestTheia()
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Spec.Volume = &v1alpha1.VolumeSpec{ExistingClaim: "team-workspace"}
+	ss := generateStatefulSet(instance)
+	if len(ss.Spec.VolumeClaimTemplates) != 0 {
+		t.Errorf("expected no volume claim template, got %+v", ss.Spec.VolumeClaimTemplates)
+	}
+	volumes := ss.Spec.Template.Spec.Volumes
+	if len(volumes) != 1 || volumes[0].Name != DefaultVolumeName ||
+		volumes[0].PersistentVolumeClaim == nil || volumes[0].PersistentVolumeClaim.ClaimName != "team-workspace" {
+		t.Errorf("expected the existing PVC to be mounted, got %+v", volumes)
+	}
+	if mounts := ss.Spec.Template.Spec.Containers[0].VolumeMounts; len(mounts) != 1 || mounts[0].Name != DefaultVolumeName {
+		t.Errorf("expected the existing PVC to be mounted in the container, got %+v", mounts)
+	}
+
+	// the shared PVC outlives the Theia
+	instance.Annotations = map[string]string{
+		culler.STOP_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-workspace", Namespace: "default"},
+	}
+	r := newTestReconciler(instance, pvc)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &v1alpha1.Theia{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the Theia to be deleted, got %v", err)
+	}
+	pvcKey := types.NamespacedName{Name: "team-workspace", Namespace: "default"}
+	if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); err != nil {
+		t.Errorf("expected the existing PVC to be kept, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetDefaultProbes(t *testing.T) {
+	container := generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0]
+	if container.ReadinessProbe != nil || container.LivenessProbe != nil {
+		t.Errorf("expected no probes by default, got %+v and %+v", container.ReadinessProbe, container.LivenessProbe)
+	}
+
+	os.Setenv("ADD_READINESS_PROBE", "true")
+	defer os.Unsetenv("ADD_READINESS_PROBE")
+	os.Setenv("ADD_LIVENESS_PROBE", "true")
+	defer os.Unsetenv("ADD_LIVENESS_PROBE")
+	container = generateStatefulSet(newTestTheia()).Spec.Template.Spec.Containers[0]
+	if probe := container.ReadinessProbe; probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Path != "/" {
+		t.Errorf("expected a default HTTP readiness probe, got %+v", probe)
+	}
+	if probe := container.LivenessProbe; probe == nil || probe.HTTPGet == nil ||
+		probe.HTTPGet.Port.IntValue() != DefaultContainerPort || probe.InitialDelaySeconds == 0 {
+		t.Errorf("expected a default HTTP liveness probe, got %+v", probe)
+	}
+
+	os.Unsetenv("ADD_READINESS_PROBE")
+	os.Unsetenv("ADD_LIVENESS_PROBE")
+	instance := newTestTheia()
+	instance.Spec.Probes = &v1alpha1.ProbesSpec{Path: "/theia/"}
+	container = generateStatefulSet(instance).Spec.Template.Spec.Containers[0]
+	if container.ReadinessProbe.HTTPGet.Path != "/theia/" || container.LivenessProbe.HTTPGet.Path != "/theia/" {
+		t.Errorf("expected the probes to use the path of the spec, got %+v and %+v",
+			container.ReadinessProbe, container.LivenessProbe)
+	}
+
+	instance.Spec.Probes = &v1alpha1.ProbesSpec{Disabled: true}
+	container = generateStatefulSet(instance).Spec.Template.Spec.Containers[0]
+	if container.ReadinessProbe != nil || container.LivenessProbe != nil {
+		t.Errorf("expected no probes when disabled, got %+v and %+v", container.ReadinessProbe, container.LivenessProbe)
+	}
+
+	// A Theia container without any port is probed on the default port
+	instance.Spec.Probes = &v1alpha1.ProbesSpec{}
+	instance.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{}
+	container = generateStatefulSet(instance).Spec.Template.Spec.Containers[0]
+	if probe := container.ReadinessProbe; probe == nil || probe.HTTPGet.Port.IntValue() != DefaultContainerPort {
+		t.Errorf("expected the probe to use the default port, got %+v", probe)
+	}
+}
+
+func TestReconcileArchivesCulledWorkspace(t *testing.T) {
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	os.Setenv("CULLED_RETENTION_TIME", "1440")
+	defer os.Unsetenv("CULLED_RETENTION_TIME")
+	os.Setenv("ENABLE_ARCHIVE_ON_DELETE", "true")
+	defer os.Unsetenv("ENABLE_ARCHIVE_ON_DELETE")
+	os.Setenv("ARCHIVE_BUCKET", "s3://workspaces/")
+	defer os.Unsetenv("ARCHIVE_BUCKET")
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Annotations = map[string]string{
+		culler.STOP_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0", Namespace: "default"},
+	}
+	r := newTestReconciler(instance, pvc)
+
+	found := reconcileTheia(t, r, instance)
+	if found.Status.ArchiveLocation != "s3://workspaces/default/my-theia.tar.gz" {
+		t.Errorf("expected the archive location to be recorded, got %q", found.Status.ArchiveLocation)
+	}
+	job := &batchv1.Job{}
+	jobKey := types.NamespacedName{Name: "my-theia-archive", Namespace: "default"}
+	if err := r.Get(context.TODO(), jobKey, job); err != nil {
+		t.Fatalf("expected an archive Job: %v", err)
+	}
+	if claim := job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "theia-my-theia-0" {
+		t.Errorf("expected the Job to mount the workspace PVC, got %+v", job.Spec.Template.Spec.Volumes)
+	}
+	pvcKey := types.NamespacedName{Name: "theia-my-theia-0", Namespace: "default"}
+	if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); err != nil {
+		t.Errorf("expected the PVC to be kept until archived, got %v", err)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := r.Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the PVC to be deleted once archived, got %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &v1alpha1.Theia{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the Theia to be deleted once archived, got %v", err)
+	}
+}
+
+func TestReconcileReportsFailedArchiveOnce(t *testing.T) {
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	os.Setenv("CULLED_RETENTION_TIME", "1440")
+	defer os.Unsetenv("CULLED_RETENTION_TIME")
+	os.Setenv("ENABLE_ARCHIVE_ON_DELETE", "true")
+	defer os.Unsetenv("ENABLE_ARCHIVE_ON_DELETE")
+	os.Setenv("ARCHIVE_BUCKET", "s3://workspaces/")
+	defer os.Unsetenv("ARCHIVE_BUCKET")
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Annotations = map[string]string{
+		culler.STOP_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-0", Namespace: "default"},
+	}
+	r := newTestReconciler(instance, pvc)
+	found := reconcileTheia(t, r, instance)
+
+	job := &batchv1.Job{}
+	_ = r.Get(context.TODO(), types.NamespacedName{Name: "my-theia-archive", Namespace: "default"}, job)
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	if err := r.Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	found = reconcileTheia(t, r, found)
+	found = reconcileTheia(t, r, found)
+	count := 0
+	for _, e := range drainEvents(r) {
+		if strings.HasPrefix(e, "Warning "+EventReasonArchiveFailed) {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected the failed archive to be reported once, got %d events", count)
+	}
+	if !strings.Contains(found.Status.Warnings[EventReasonArchiveFailed], "BackoffLimitExceeded") {
+		t.Errorf("expected the failed archive in the status warnings, got %v", found.Status.Warnings)
+	}
+}
+
+func TestGenerateStatefulSetScheduling(t *testing.T) {
+	os.Setenv("DEFAULT_NODE_SELECTOR", "pool=cpu")
+	defer os.Unsetenv("DEFAULT_NODE_SELECTOR")
+	os.Setenv("DEFAULT_TOLERATIONS", `[{"key":"dedicated","operator":"Equal","value":"theia","effect":"NoSchedule"}]`)
+	defer os.Unsetenv("DEFAULT_TOLERATIONS")
+	podSpec := generateStatefulSet(newTestTheia()).Spec.Template.Spec
+	if podSpec.NodeSelector["pool"] != "cpu" {
+		t.Errorf("expected the default node selector, got %v", podSpec.NodeSelector)
+	}
+	if len(podSpec.Tolerations) != 1 || podSpec.Tolerations[0].Value != "theia" {
+		t.Errorf("expected the default tolerations, got %+v", podSpec.Tolerations)
+	}
+
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.NodeSelector = map[string]string{"pool": "cpu", "zone": "a"}
+	instance.Spec.Template.Spec.Tolerations = []corev1.Toleration{{Key: "gpu", Effect: corev1.TaintEffectNoSchedule}}
+	instance.Spec.NodeSelector = map[string]string{"pool": "gpu"}
+	instance.Spec.Tolerations = []corev1.Toleration{{
+		Key: "gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule,
+	}}
+	instance.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{}}
+	podSpec = generateStatefulSet(instance).Spec.Template.Spec
+	if !reflect.DeepEqual(podSpec.NodeSelector, map[string]string{"pool": "gpu", "zone": "a"}) {
+		t.Errorf("expected the node selector of the spec to win, got %v", podSpec.NodeSelector)
+	}
+	if len(podSpec.Tolerations) != 1 || podSpec.Tolerations[0].Operator != corev1.TolerationOpExists {
+		t.Errorf("expected the toleration of the spec to win, got %+v", podSpec.Tolerations)
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil {
+		t.Errorf("expected the affinity of the spec, got %+v", podSpec.Affinity)
+	}
+	if len(instance.Spec.Template.Spec.Tolerations) != 1 || instance.Spec.Template.Spec.Tolerations[0].Operator != "" {
+		t.Errorf("expected the Theia not to be mutated, got %+v", instance.Spec.Template.Spec.Tolerations)
+	}
+}
+
+func TestReconcileCrashLoopBackOff(t *testing.T) {
+	instance := newTestTheia()
+	finishedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia-0", Namespace: "default", Labels: map[string]string{"statefulset": "my-theia"}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			RestartCount: 3,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+				Reason:  "CrashLoopBackOff",
+				Message: "back-off 40s restarting failed container",
+			}},
+			LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+				ExitCode:   1,
+				Reason:     "Error",
+				FinishedAt: metav1.NewTime(finishedAt),
+			}},
+		}}},
+	}
+	r := newTestReconciler(instance, pod)
+	found := reconcileTheia(t, r, instance)
+	conditions := found.Status.Conditions
+	if len(conditions) != 1 || conditions[0].Reason != "CrashLoopBackOff" {
+		t.Fatalf("expected a CrashLoopBackOff condition, got %+v", conditions)
+	}
+	for _, expected := range []string{"Back-off 40s", "2020-01-01T12:00:40Z", "exit code 1"} {
+		if !strings.Contains(conditions[0].Message, expected) {
+			t.Errorf("expected the condition message to contain %q, got %q", expected, conditions[0].Message)
+		}
+	}
+	if found.Status.Phase != v1alpha1.TheiaError {
+		t.Errorf("expected phase Failed, got %s", found.Status.Phase)
+	}
+}
+
+func TestReconcileDeletesRoutingOnDeletion(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	os.Setenv("USE_INGRESS", "true")
+	defer os.Unsetenv("USE_INGRESS")
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: "VirtualService"},
+		&unstructured.Unstructured{})
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+		&unstructured.Unstructured{})
+	found := reconcileTheia(t, r, instance)
+	if !containsString(found.Finalizers, RoutingFinalizer) {
+		t.Fatalf("expected the %s finalizer to be added", RoutingFinalizer)
+	}
+
+	virtualService := &unstructured.Unstructured{}
+	virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
+	virtualService.SetKind("VirtualService")
+	vsKey := types.NamespacedName{Name: virtualServiceName("my-theia", "default"), Namespace: "default"}
+	if err := r.Get(context.TODO(), vsKey, virtualService); err != nil {
+		t.Fatalf("expected a VirtualService: %v", err)
+	}
+	// the Ingress is already gone, e.g. after a partial cleanup
+	ingress := newIngress()
+	ingress.SetName("my-theia")
+	ingress.SetNamespace("default")
+	if err := r.Delete(context.TODO(), ingress); err != nil {
+		t.Fatal(err)
+	}
+
+	now := metav1.Now()
+	found.DeletionTimestamp = &now
+	_ = r.Update(context.TODO(), found)
+	found = reconcileTheia(t, r, found)
+	if containsString(found.Finalizers, RoutingFinalizer) {
+		t.Errorf("expected the %s finalizer to be removed", RoutingFinalizer)
+	}
+	virtualService = &unstructured.Unstructured{}
+	virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
+	virtualService.SetKind("VirtualService")
+	if err := r.Get(context.TODO(), vsKey, virtualService); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the VirtualService to be deleted, got %v", err)
+	}
+	if err := r.deleteRouting(context.TODO(), found); err != nil {
+		t.Errorf("expected deleting the routing again to succeed, got %v", err)
+	}
+}
+
+func TestTheiaDefaulterStorageClass(t *testing.T) {
+	os.Setenv("ENABLE_STORAGE_CLASS_DEFAULTING", "true")
+	defer os.Unsetenv("ENABLE_STORAGE_CLASS_DEFAULTING")
+	storageClass := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+		Name:        "standard",
+		Annotations: map[string]string{"storageclass.kubernetes.io/is-default-class": "true"},
+	}}
+	r := newTestReconciler(storageClass)
+	decoder, err := admission.NewDecoder(r.Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaulter := &TheiaDefaulter{Client: r.Client}
+	_ = defaulter.InjectDecoder(decoder)
+
+	raw, _ := json.Marshal(newTestTheia())
+	resp := defaulter.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if !resp.Allowed {
+		t.Fatalf("expected the Theia to be admitted, got %+v", resp.Result)
+	}
+	patched := map[string]interface{}{}
+	for _, patch := range resp.Patches {
+		patched[patch.Path] = patch.Value
+	}
+	if class := patched["/spec/template/pvc/storageClassName"]; class != "standard" {
+		t.Fatalf("expected the default storage class of the cluster, got %v", patched)
+	}
+	if modes := patched["/spec/template/pvc/accessModes"]; !reflect.DeepEqual(modes, []interface{}{"ReadWriteOnce"}) {
+		t.Errorf("expected the ReadWriteOnce access mode, got %v", modes)
+	}
+
+	os.Setenv("DEFAULT_STORAGE_CLASS", "fast")
+	defer os.Unsetenv("DEFAULT_STORAGE_CLASS")
+	instance := newTestTheia()
+	if err := defaulter.defaultStorageClass(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	if class := instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName; class == nil || *class != "fast" {
+		t.Errorf("expected the storage class of the controller, got %v", class)
+	}
+}
+
+func TestGenerateVirtualServiceTimeout(t *testing.T) {
+	timeout := func(instance *v1alpha1.Theia) interface{} {
+		vsvc, err := generateVirtualService(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+		return http[0].(map[string]interface{})["timeout"]
+	}
+	instance := newTestTheia()
+	if value := timeout(instance); value != DefaultRouteTimeout {
+		t.Errorf("expected the default timeout, got %v", value)
+	}
+	instance.Spec.Routing = &v1alpha1.RoutingSpec{Timeout: "1h30m"}
+	if value := timeout(instance); value != "5400s" {
+		t.Errorf("expected a timeout of 5400s, got %v", value)
+	}
+
+	for _, invalid := range []string{"-5m", "forever"} {
+		instance.Spec.Routing = &v1alpha1.RoutingSpec{Timeout: invalid}
+		if err := validateTheia(instance, nil); err == nil {
+			t.Errorf("expected the timeout %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestReconcileSkipsEventOfDeletedTheia(t *testing.T) {
+	events := []*corev1.Event{{
+		ObjectMeta:     metav1.ObjectMeta{Name: "my-theia.15f", Namespace: "default"},
+		InvolvedObject: corev1.ObjectReference{Kind: "StatefulSet", Name: "my-theia", Namespace: "default"},
+		Reason:         "BackOff",
+		Type:           corev1.EventTypeWarning,
+	}, {
+		ObjectMeta:     metav1.ObjectMeta{Name: "my-theia-0.15f", Namespace: "default"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "my-theia-0", Namespace: "default"},
+		Reason:         "BackOff",
+		Type:           corev1.EventTypeWarning,
+	}}
+	r := newTestReconciler(events[0], events[1])
+	for _, event := range events {
+		key := types.NamespacedName{Name: event.Name, Namespace: event.Namespace}
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+			t.Errorf("expected the event %s of a deleted Theia to be skipped, got %v", event.Name, err)
+		}
+	}
+	if reissued := drainEvents(r); len(reissued) != 0 {
+		t.Errorf("expected no event to be reissued, got %v", reissued)
+	}
+}
+
+func TestReconcileImageGCHint(t *testing.T) {
+	os.Setenv("DEFAULT_IMAGE_GC_POLICY", ImageGCEvict)
+	defer os.Unsetenv("DEFAULT_IMAGE_GC_POLICY")
+	podAnnotations := func(r *TheiaReconciler, namespace string) map[string]string {
+		ss := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: namespace}, ss); err != nil {
+			t.Fatal(err)
+		}
+		return ss.Spec.Template.Annotations
+	}
+
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+	if policy := podAnnotations(r, "default")[ImageGCAnnotation]; policy != ImageGCEvict {
+		t.Errorf("expected the default image GC policy, got %q", policy)
+	}
+
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team",
+		Annotations: map[string]string{ImageGCAnnotation: ImageGCRetain},
+	}}
+	instance = newTestTheia()
+	instance.Namespace = "team"
+	r = newTestReconciler(instance, namespace)
+	reconcileTheia(t, r, instance)
+	if policy := podAnnotations(r, "team")[ImageGCAnnotation]; policy != ImageGCRetain {
+		t.Errorf("expected the image GC policy of the namespace, got %q", policy)
+	}
+}
+
+func TestGenerateVirtualServiceWebsocketRoute(t *testing.T) {
+	os.Setenv("ISTIO_WEBSOCKET_ROUTING", "true")
+	defer os.Unsetenv("ISTIO_WEBSOCKET_ROUTING")
+	instance := newTestTheia()
+	instance.Spec.Routing = &v1alpha1.RoutingSpec{Timeout: "10m"}
+	vsvc, err := generateVirtualService(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+	if len(http) != 2 {
+		t.Fatalf("expected a websocket and a http route, got %v", http)
+	}
+	websocket, route := http[0].(map[string]interface{}), http[1].(map[string]interface{})
+	if websocket["timeout"] != "0s" || websocket["name"] != "theia-my-theia-websocket" {
+		t.Errorf("expected a websocket route without timeout, got %v", websocket)
+	}
+	upgrade, _, _ := unstructured.NestedString(websocket["match"].([]interface{})[0].(map[string]interface{}),
+		"headers", "upgrade", "exact")
+	if upgrade != "websocket" {
+		t.Errorf("expected the websocket route to match the upgrades, got %v", websocket["match"])
+	}
+	if route["timeout"] != "600s" || route["name"] != "theia-my-theia" {
+		t.Errorf("expected the http route to keep its timeout, got %v", route)
+	}
+	if _, ok := route["match"].([]interface{})[0].(map[string]interface{})["headers"]; ok {
+		t.Errorf("expected the http route not to be mutated, got %v", route["match"])
+	}
+
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	if !destinationRuleIsEnabled() {
+		t.Errorf("expected the DestinationRule to close the idle websockets")
+	}
+}
+
+func TestGenerateVirtualServiceGateway(t *testing.T) {
+	os.Setenv("ISTIO_GATEWAY", "istio-system/internal-gateway")
+	defer os.Unsetenv("ISTIO_GATEWAY")
+	gateways := func(instance *v1alpha1.Theia) []string {
+		vsvc, err := generateVirtualService(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gateways, _, _ := unstructured.NestedStringSlice(vsvc.Object, "spec", "gateways")
+		return gateways
+	}
+	instance := newTestTheia()
+	if g := gateways(instance); !reflect.DeepEqual(g, []string{"istio-system/internal-gateway"}) {
+		t.Errorf("expected the gateway of the controller, got %v", g)
+	}
+	instance.Spec.Routing = &v1alpha1.RoutingSpec{Gateway: "istio-system/external-gateway"}
+	if g := gateways(instance); !reflect.DeepEqual(g, []string{"istio-system/external-gateway"}) {
+		t.Errorf("expected the gateway of the Theia, got %v", g)
+	}
+	if err := validateTheia(instance, nil); err != nil {
+		t.Errorf("expected the gateway to be valid, got %v", err)
+	}
+
+	for _, invalid := range []string{"external-gateway", "istio-system/", "a/b/c", "Istio/gateway"} {
+		instance.Spec.Routing = &v1alpha1.RoutingSpec{Gateway: invalid}
+		if err := validateTheia(instance, nil); err == nil {
+			t.Errorf("expected the gateway %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestReconcileServiceAccount(t *testing.T) {
+	os.Setenv("CREATE_SERVICE_ACCOUNT", "true")
+	defer os.Unsetenv("CREATE_SERVICE_ACCOUNT")
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	reconcileTheia(t, r, instance)
+
+	serviceAccount := &corev1.ServiceAccount{}
+	key := types.NamespacedName{Name: "theia-my-theia", Namespace: "default"}
+	if err := r.Get(context.TODO(), key, serviceAccount); err != nil {
+		t.Fatalf("expected a ServiceAccount to be created: %v", err)
+	}
+	if owners := serviceAccount.GetOwnerReferences(); len(owners) != 1 || owners[0].Name != "my-theia" {
+		t.Errorf("expected the Theia to own the ServiceAccount, got %+v", owners)
+	}
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	if name := ss.Spec.Template.Spec.ServiceAccountName; name != "theia-my-theia" {
+		t.Errorf("expected the pod to run as the ServiceAccount of the Theia, got %q", name)
+	}
+
+	instance = newTestTheia()
+	instance.Spec.Template.Spec.ServiceAccountName = "builder"
+	if name := generateStatefulSet(instance).Spec.Template.Spec.ServiceAccountName; name != "builder" {
+		t.Errorf("expected the ServiceAccount of the pod template to be kept, got %q", name)
+	}
+}
+
+func TestReconcilePhaseTerminating(t *testing.T) {
+	instance := newTestTheia()
+	instance.Finalizers = []string{"example.com/keep"}
+	r := newTestReconciler(instance)
+	found := reconcileTheia(t, r, instance)
+	if found.Status.Phase != v1alpha1.TheiaProvisioning {
+		t.Errorf("expected phase Provisioning after creation, got %s", found.Status.Phase)
+	}
+
+	now := metav1.Now()
+	found.DeletionTimestamp = &now
+	_ = r.Update(context.TODO(), found)
+	found = reconcileTheia(t, r, found)
+	if found.Status.Phase != v1alpha1.TheiaTerminating {
+		t.Errorf("expected phase Terminating once deleted, got %s", found.Status.Phase)
+	}
+}
+
+func TestReconcileMaintenanceMode(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	instance := newTestTheia()
+	instance.Annotations = map[string]string{MaintenanceAnnotation: "true"}
+	r := newTestReconciler(instance)
+	r.Scheme.AddKnownTypeWithName(
+		schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: "VirtualService"},
+		&unstructured.Unstructured{})
+	fault := func() interface{} {
+		virtualService := &unstructured.Unstructured{}
+		virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
+		virtualService.SetKind("VirtualService")
+		key := types.NamespacedName{Name: virtualServiceName("my-theia", "default"), Namespace: "default"}
+		if err := r.Get(context.TODO(), key, virtualService); err != nil {
+			t.Fatal(err)
+		}
+		http, _, _ := unstructured.NestedSlice(virtualService.Object, "spec", "http")
+		return http[0].(map[string]interface{})["fault"]
+	}
+	found := reconcileTheia(t, r, instance)
+	status, _, _ := unstructured.NestedInt64(map[string]interface{}{"fault": fault()}, "fault", "abort", "httpStatus")
+	if status != 503 {
+		t.Errorf("expected the route to abort with a 503 in maintenance, got %v", fault())
+	}
+	percentage, _, _ := unstructured.NestedInt64(map[string]interface{}{"fault": fault()}, "fault", "abort", "percentage", "value")
+	if percentage != 100 {
+		t.Errorf("expected every request to be aborted in maintenance, got %v", fault())
+	}
+
+	delete(found.Annotations, MaintenanceAnnotation)
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, found)
+	if f := fault(); f != nil {
+		t.Errorf("expected the fault to be removed after the maintenance, got %v", f)
+	}
+}
+
+func TestGenerateStatefulSetSidecarFirst(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers = []corev1.Container{
+		{Name: "sidecar", Ports: []corev1.ContainerPort{{ContainerPort: 9000}}},
+		{Name: "theia", Ports: []corev1.ContainerPort{{ContainerPort: 3100}}},
+	}
+	ss := generateStatefulSet(instance)
+	containers := ss.Spec.Template.Spec.Containers
+	if len(containers[0].VolumeMounts) != 0 || len(containers[0].Env) != 0 {
+		t.Errorf("expected the sidecar to be left alone, got %+v", containers[0])
+	}
+	if mounts := containers[1].VolumeMounts; len(mounts) != 1 || mounts[0].MountPath != DefaultMountPath {
+		t.Errorf("expected the workspace to be mounted into the theia container, got %+v", mounts)
+	}
+	if port := generateService(instance).Spec.Ports[0].TargetPort.IntValue(); port != 3100 {
+		t.Errorf("expected the service to target the theia container port 3100, got %d", port)
+	}
+
+	instance.Annotations = map[string]string{TheiaContainerAnnotation: "sidecar"}
+	ss = generateStatefulSet(instance)
+	if mounts := ss.Spec.Template.Spec.Containers[0].VolumeMounts; len(mounts) != 1 {
+		t.Errorf("expected the workspace to be mounted into the annotated container, got %+v", mounts)
+	}
+	if port := generateService(instance).Spec.Ports[0].TargetPort.IntValue(); port != 9000 {
+		t.Errorf("expected the service to target the annotated container port 9000, got %d", port)
+	}
+
+	// Without a container named theia, the first container is the Theia one
+	instance = newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Name = "ide"
+	ss = generateStatefulSet(instance)
+	if mounts := ss.Spec.Template.Spec.Containers[0].VolumeMounts; len(mounts) != 1 {
+		t.Errorf("expected the workspace to be mounted into the first container, got %+v", mounts)
+	}
+}
+
+func TestReconcileGenerationSkew(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	ss.Generation = 2
+	ss.Status.ObservedGeneration = 1
+	if err := r.Status().Update(context.TODO(), ss); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	conditions := instance.Status.Conditions
+	if len(conditions) == 0 || conditions[0].Type != ReconcilingCondition || conditions[0].Reason != "GenerationSkew" {
+		t.Fatalf("expected a Reconciling condition, got %+v", conditions)
+	}
+
+	ss = &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	ss.Status.ObservedGeneration = 2
+	if err := r.Status().Update(context.TODO(), ss); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	for _, condition := range instance.Status.Conditions {
+		if condition.Type == ReconcilingCondition {
+			t.Errorf("expected the Reconciling condition to be removed, got %+v", instance.Status.Conditions)
+		}
+	}
+}
+
+func TestReconcileTTLExpired(t *testing.T) {
+	instance := newTestTheia()
+	instance.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	instance.Annotations = map[string]string{culler.TTL_ANNOTATION: "1h"}
+	r := newTestReconciler(instance)
+	found := reconcileTheia(t, r, instance)
+	if reason := culler.GetStopReason(found.ObjectMeta); reason != culler.STOP_REASON_TTL {
+		t.Fatalf("expected the expired Theia to be stopped, got stop reason %q", reason)
+	}
+	reconcileTheia(t, r, found)
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	if *ss.Spec.Replicas != 0 {
+		t.Errorf("expected the expired Theia to be scaled down, got %d replicas", *ss.Spec.Replicas)
+	}
+
+	os.Setenv("DELETE_ON_TTL_EXPIRY", "true")
+	defer os.Unsetenv("DELETE_ON_TTL_EXPIRY")
+	instance = newTestTheia()
+	instance.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	instance.Annotations = map[string]string{culler.TTL_ANNOTATION: "1h"}
+	r = newTestReconciler(instance)
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &v1alpha1.Theia{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the expired Theia to be deleted, got %v", err)
+	}
+
+	// A Theia whose TTL hasn't expired is checked again once it expires
+	instance = newTestTheia()
+	instance.CreationTimestamp = metav1.NewTime(time.Now())
+	instance.Annotations = map[string]string{culler.TTL_ANNOTATION: "10s"}
+	if requeue := requeueTime(instance); requeue <= 0 || requeue > 10*time.Second {
+		t.Errorf("expected a requeue once the TTL expires, got %v", requeue)
+	}
+}
+
+func TestReconcileEnvFrom(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "template"}}},
+	}
+	instance.Spec.EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "proxy"}}},
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"}}},
+	}
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+	reconcileTheia(t, r, instance)
+
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, ss); err != nil {
+		t.Fatal(err)
+	}
+	container := ss.Spec.Template.Spec.Containers[0]
+	envFrom := container.EnvFrom
+	if len(envFrom) != 3 || envFrom[0].ConfigMapRef.Name != "template" ||
+		envFrom[1].ConfigMapRef.Name != "proxy" || envFrom[2].SecretRef.Name != "credentials" {
+		t.Errorf("expected the EnvFrom of the spec to be appended, got %+v", envFrom)
+	}
+	for _, name := range []string{"THEIA_NAME", "THEIA_PREFIX", "NAMESPACE"} {
+		count := 0
+		for _, env := range container.Env {
+			if env.Name == name {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("expected %s to be injected once, got %d", name, count)
+		}
+	}
+}
+
+func TestGenerateStatefulSetReplacesTemplateEnv(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "NAMESPACE", Value: "other"},
+		{Name: "EDITOR", Value: "vim"},
+	}
+	ss := generateStatefulSet(instance)
+	namespaces := []string{}
+	editor := false
+	for _, env := range ss.Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "NAMESPACE" {
+			namespaces = append(namespaces, env.Value)
+		}
+		editor = editor || env.Name == "EDITOR"
+	}
+	if !reflect.DeepEqual(namespaces, []string{"default"}) {
+		t.Errorf("expected exactly one NAMESPACE set to default, got %v", namespaces)
+	}
+	if !editor {
+		t.Error("expected the other variables of the template to be kept")
+	}
+}
+
+func TestGenerateStatefulSetFSGroupOverride(t *testing.T) {
+	fsGroup := int64(2000)
+	instance := newTestTheia()
+	instance.Spec.FSGroup = &fsGroup
+	ss := generateStatefulSet(instance)
+	if group := ss.Spec.Template.Spec.SecurityContext.FSGroup; group == nil || *group != fsGroup {
+		t.Errorf("expected fsGroup %d, got %v", fsGroup, group)
+	}
+
+	os.Setenv("ADD_FSGROUP", "false")
+	defer os.Unsetenv("ADD_FSGROUP")
+	ss = generateStatefulSet(instance)
+	if group := ss.Spec.Template.Spec.SecurityContext.FSGroup; group == nil || *group != fsGroup {
+		t.Errorf("expected spec.fsGroup to be set when ADD_FSGROUP=false, got %v", group)
+	}
+
+	// The security context of the pod template wins
+	runAsNonRoot := true
+	templateGroup := int64(3000)
+	instance.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		FSGroup:      &templateGroup,
+	}
+	ss = generateStatefulSet(instance)
+	securityContext := ss.Spec.Template.Spec.SecurityContext
+	if securityContext.FSGroup == nil || *securityContext.FSGroup != templateGroup {
+		t.Errorf("expected the fsGroup of the template to be kept, got %v", securityContext.FSGroup)
+	}
+	if securityContext.RunAsNonRoot == nil || !*securityContext.RunAsNonRoot {
+		t.Errorf("expected runAsNonRoot to be kept, got %v", securityContext.RunAsNonRoot)
+	}
+}
+
+func TestReconcilePreservesServicePorts(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	addDebugPort := func() {
+		service := &corev1.Service{}
+		if err := r.Get(context.TODO(), key, service); err != nil {
+			t.Fatal(err)
+		}
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name: "debug", Port: 9229, TargetPort: intstr.FromInt(9229), Protocol: "TCP",
+		})
+		if err := r.Update(context.TODO(), service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	servicePorts := func() []corev1.ServicePort {
+		service := &corev1.Service{}
+		if err := r.Get(context.TODO(), key, service); err != nil {
+			t.Fatal(err)
+		}
+		return service.Spec.Ports
+	}
+
+	addDebugPort()
+	instance = reconcileTheia(t, r, instance)
+	if ports := servicePorts(); len(ports) != 1 {
+		t.Errorf("expected the added port to be reverted by default, got %+v", ports)
+	}
+
+	os.Setenv("PRESERVE_SERVICE_PORTS", "true")
+	defer os.Unsetenv("PRESERVE_SERVICE_PORTS")
+	addDebugPort()
+	reconcileTheia(t, r, instance)
+	ports := servicePorts()
+	if len(ports) != 2 || ports[0].Name != "http-my-theia" || ports[1].Name != "debug" {
+		t.Errorf("expected the added port to be preserved, got %+v", ports)
+	}
+}
+
+func TestGenerateStatefulSetWorkloadAntiAffinity(t *testing.T) {
+	os.Setenv("ENABLE_WORKLOAD_ANTI_AFFINITY", "true")
+	defer os.Unsetenv("ENABLE_WORKLOAD_ANTI_AFFINITY")
+	os.Setenv("ANTI_AFFINITY_SELECTOR", "workload=batch")
+	defer os.Unsetenv("ANTI_AFFINITY_SELECTOR")
+	os.Setenv("ANTI_AFFINITY_NAMESPACES", "jobs, etl")
+	defer os.Unsetenv("ANTI_AFFINITY_NAMESPACES")
+
+	ss := generateStatefulSet(newTestTheia())
+	affinity := ss.Spec.Template.Spec.Affinity
+	if affinity == nil || affinity.PodAntiAffinity == nil ||
+		len(affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution) != 1 {
+		t.Fatalf("expected a preferred pod anti-affinity, got %+v", affinity)
+	}
+	term := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm
+	if !reflect.DeepEqual(term.LabelSelector.MatchLabels, map[string]string{"workload": "batch"}) {
+		t.Errorf("expected the anti-affinity to target workload=batch, got %v", term.LabelSelector.MatchLabels)
+	}
+	if !reflect.DeepEqual(term.Namespaces, []string{"jobs", "etl"}) || term.TopologyKey != corev1.LabelHostname {
+		t.Errorf("unexpected anti-affinity term %+v", term)
+	}
+
+	// The affinity of the user is left alone
+	instance := newTestTheia()
+	instance.Spec.Template.Spec.Affinity = &corev1.Affinity{}
+	ss = generateStatefulSet(instance)
+	if affinity := ss.Spec.Template.Spec.Affinity; affinity.PodAntiAffinity != nil {
+		t.Errorf("expected the affinity of the template to be kept, got %+v", affinity)
+	}
+}
+
+func TestReconcileReplicas(t *testing.T) {
+	replicas := int32(3)
+	instance := newTestTheia()
+	instance.Spec.Replicas = &replicas
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	statefulSetReplicas := func() int32 {
+		ss := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), key, ss); err != nil {
+			t.Fatal(err)
+		}
+		return *ss.Spec.Replicas
+	}
+	if got := statefulSetReplicas(); got != 3 {
+		t.Errorf("expected 3 replicas, got %d", got)
+	}
+
+	// A culled Theia stays stopped on every reconcile
+	culler.SetStopAnnotation(&instance.ObjectMeta, nil)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	instance = reconcileTheia(t, r, instance)
+	if got := statefulSetReplicas(); got != 0 {
+		t.Errorf("expected the culled Theia to be scaled down, got %d replicas", got)
+	}
+
+	culler.RemoveStopAnnotation(&instance.ObjectMeta)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+	if got := statefulSetReplicas(); got != 3 {
+		t.Errorf("expected 3 replicas once resumed, got %d", got)
+	}
+}
+
+func TestReconcileDoesNotCullStartingTheia(t *testing.T) {
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	os.Setenv("IDLE_TIME", "1")
+	defer os.Unsetenv("IDLE_TIME")
+	instance := newTestTheia()
+	instance.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia-0", Namespace: "default", Labels: map[string]string{"statefulset": "my-theia"}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "theia",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+			}},
+		},
+	}
+	r := newTestReconciler(instance, pod)
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	found := &v1alpha1.Theia{}
+	if err := r.Get(context.TODO(), key, found); err != nil {
+		t.Fatal(err)
+	}
+	if theiaIsServing(found) || culler.StopAnnotationIsSet(found.ObjectMeta) {
+		t.Errorf("expected the waiting Theia not to be culled, got %+v", found.Annotations)
+	}
+	if result.RequeueAfter == 0 {
+		t.Error("expected the waiting Theia to be checked again")
+	}
+
+	found.Status.ContainerState = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	if !theiaIsServing(found) {
+		t.Error("expected a running Theia to be serving")
+	}
+}
+
+func TestReconcileTrimsOversizedStatus(t *testing.T) {
+	os.Setenv("MAX_STATUS_SIZE", "4096")
+	defer os.Unsetenv("MAX_STATUS_SIZE")
+	instance := newTestTheia()
+	for i := 0; i < 30; i++ {
+		instance.Status.Conditions = append(instance.Status.Conditions, v1alpha1.TheiaCondition{
+			Type:    "Waiting",
+			Reason:  "Reason" + strconv.Itoa(i),
+			Message: strings.Repeat("x", 2000),
+		})
+	}
+	r := newTestReconciler(instance)
+	if err := r.updateStatus(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	found := &v1alpha1.Theia{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "my-theia", Namespace: "default"}, found); err != nil {
+		t.Fatal(err)
+	}
+	conditions := found.Status.Conditions
+	if len(conditions) == 0 || len(conditions) > 4 || conditions[0].Reason != "Reason0" {
+		t.Fatalf("expected the latest conditions to be kept within 4096 bytes, got %d conditions", len(conditions))
+	}
+	if message := conditions[0].Message; len(message) != DefaultMaxConditionMessageLength || !strings.HasSuffix(message, "...") {
+		t.Errorf("expected the message to be truncated, got %d characters", len(message))
+	}
+	if size := statusSize(&found.Status); size > 4096 {
+		t.Errorf("expected the status to fit in 4096 bytes, got %d", size)
+	}
+	if events := drainEvents(r); len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+EventReasonStatusTrimmed) {
+		t.Errorf("expected a StatusTrimmed warning, got %v", events)
+	}
+
+	// The messages are truncated without splitting a multi-byte character
+	instance = newTestTheia()
+	instance.Status.Conditions = []v1alpha1.TheiaCondition{{Type: "Waiting", Message: strings.Repeat("é", 1000)}}
+	trimStatus(instance)
+	if message := instance.Status.Conditions[0].Message; !utf8.ValidString(message) || len(message) > DefaultMaxConditionMessageLength {
+		t.Errorf("expected a valid message of at most %d bytes, got %d bytes", DefaultMaxConditionMessageLength, len(message))
+	}
+
+	// The condition history is capped even when the status is small
+	instance = newTestTheia()
+	for i := 0; i < 30; i++ {
+		instance.Status.Conditions = append(instance.Status.Conditions, v1alpha1.TheiaCondition{Type: "Running"})
+	}
+	if trimStatus(instance) || len(instance.Status.Conditions) != DefaultMaxConditions {
+		t.Errorf("expected %d conditions, got %d", DefaultMaxConditions, len(instance.Status.Conditions))
+	}
+}
+
+func TestCullTheiaEmitsCulledEvent(t *testing.T) {
+	instance := newTestTheia()
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+	drainEvents(r)
+
+	if err := r.cullTheia(context.TODO(), instance, generateStatefulSet(instance), culler.STOP_REASON_CULLED, idleCullMessage(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Normal Culled Stopped the Theia after it was idle for more than 1h0m0s"
+	if events := drainEvents(r); len(events) != 1 || events[0] != expected {
+		t.Errorf("expected a Culled event with the idle time, got %v", events)
+	}
+}
+
+func TestGenerateStatefulSetBlockWorkspace(t *testing.T) {
+	storageClass := "block"
+	volumeMode := corev1.PersistentVolumeBlock
+	instance := newTestTheia()
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	instance.Spec.Template.PersistentVolumeClaimSpec.VolumeMode = &volumeMode
+	instance.Spec.Template.VolumeDevices = []corev1.VolumeDevice{{Name: DefaultVolumeName, DevicePath: "/dev/workspace"}}
+	if err := validateTheia(instance, nil); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	ss := generateStatefulSet(instance)
+	templates := ss.Spec.VolumeClaimTemplates
+	if len(templates) != 1 || templates[0].Spec.VolumeMode == nil || *templates[0].Spec.VolumeMode != corev1.PersistentVolumeBlock {
+		t.Fatalf("expected a block volume claim template, got %+v", templates)
+	}
+	container := ss.Spec.Template.Spec.Containers[0]
+	if devices := container.VolumeDevices; len(devices) != 1 || devices[0].Name != templates[0].Name ||
+		devices[0].DevicePath != "/dev/workspace" {
+		t.Errorf("expected the workspace to be attached as a volume device, got %+v", devices)
+	}
+	if len(container.VolumeMounts) != 0 {
+		t.Errorf("expected the block workspace not to be mounted, got %+v", container.VolumeMounts)
+	}
+
+	instance.Spec.Template.VolumeDevices[0].DevicePath = "dev/workspace"
+	if err := validateTheia(instance, nil); err == nil {
+		t.Error("expected a relative device path to be rejected")
+	}
+	instance.Spec.Template.VolumeDevices = nil
+	if err := validateTheia(instance, nil); err == nil {
+		t.Error("expected a block workspace without a volume device to be rejected")
+	}
+	instance.Spec.Template.PersistentVolumeClaimSpec.VolumeMode = nil
+	instance.Spec.Template.VolumeDevices = []corev1.VolumeDevice{{Name: DefaultVolumeName, DevicePath: "/dev/workspace"}}
+	if err := validateTheia(instance, nil); err == nil {
+		t.Error("expected a volume device of a filesystem workspace to be rejected")
+	}
+}
+
+func TestReconcileInspectsPodOfLowestOrdinal(t *testing.T) {
+	instance := newTestTheia()
+	labels := map[string]string{"statefulset": "my-theia"}
+	podOfOrdinal := func(ordinal string, state corev1.ContainerState) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-theia-" + ordinal, Namespace: "default", Labels: labels},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "theia", State: state}},
+			},
+		}
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	waiting := corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}
+	r := newTestReconciler(instance, podOfOrdinal("12", waiting), podOfOrdinal("3", running))
+	found := reconcileTheia(t, r, instance)
+	if found.Status.ContainerState.Running == nil {
+		t.Errorf("expected the state of pod my-theia-3 to be reported, got %+v", found.Status.ContainerState)
+	}
+}
+
+// recordingLogSource records the pods whose logs are read, which are always
+// fresh.
+type recordingLogSource struct {
+	pods []string
+}
+
+func (s *recordingLogSource) LastLogTime(namespace, name string) (time.Time, error) {
+	s.pods = append(s.pods, name)
+	return time.Now(), nil
+}
+
+func TestReconcileUsesOrdinalOfPodAndClaim(t *testing.T) {
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	os.Setenv("ENABLE_LOG_ACTIVITY", "true")
+	defer os.Unsetenv("ENABLE_LOG_ACTIVITY")
+	logs := &recordingLogSource{}
+	culler.SetPodLogSource(logs)
+	defer culler.SetPodLogSource(nil)
+
+	instance := newTestTheia()
+	storageClass := "standard"
+	instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName = &storageClass
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-theia-3", Namespace: "default", Labels: map[string]string{"statefulset": "my-theia"}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "theia",
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		}}},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "theia-my-theia-3", Namespace: "default"},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Phase:    corev1.ClaimBound,
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("250Mi")},
+		},
+	}
+	r := newTestReconciler(instance, pod, pvc)
+	found := reconcileTheia(t, r, instance)
+	found = reconcileTheia(t, r, found)
+	if found.Status.VolumeName != "theia-my-theia-3" {
+		t.Errorf("expected the PVC of ordinal 3 to be reported, got %q", found.Status.VolumeName)
+	}
+	if len(logs.pods) == 0 || logs.pods[len(logs.pods)-1] != "my-theia-3" {
+		t.Errorf("expected the logs of my-theia-3 to be read, got %v", logs.pods)
+	}
+
+	// The PVC outliving the pod is the one deleted with the culled Theia
+	os.Setenv("ENABLE_CULLED_DELETION", "true")
+	defer os.Unsetenv("ENABLE_CULLED_DELETION")
+	_ = r.Delete(context.TODO(), pod)
+	found.Annotations = map[string]string{culler.STOP_ANNOTATION: time.Now().Add(-30 * 24 * time.Hour).Format(time.RFC3339)}
+	_ = r.Update(context.TODO(), found)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	pvcKey := types.NamespacedName{Name: "theia-my-theia-3", Namespace: "default"}
+	if err := r.Get(context.TODO(), pvcKey, &corev1.PersistentVolumeClaim{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the PVC of ordinal 3 to be deleted, got %v", err)
+	}
+}
+
+func TestReconcileServiceAndStatefulSetMetadata(t *testing.T) {
+	instance := newTestTheia()
+	instance.Labels = map[string]string{"team": "data", "cost-center": "default"}
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+
+	instance.Spec.ServiceLabels = map[string]string{"cost-center": "finance"}
+	instance.Spec.ServiceAnnotations = map[string]string{"cloud.google.com/load-balancer-type": "Internal"}
+	instance.Spec.StatefulSetLabels = map[string]string{"cost-center": "finance"}
+	instance.Spec.StatefulSetAnnotations = map[string]string{"owner": "data-team"}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	service := &corev1.Service{}
+	if err := r.Get(context.TODO(), key, service); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(service.Labels, map[string]string{"team": "data", "cost-center": "finance"}) {
+		t.Errorf("expected the service labels to be merged with the Theia labels, got %v", service.Labels)
+	}
+	if service.Annotations["cloud.google.com/load-balancer-type"] != "Internal" {
+		t.Errorf("expected the service annotation to be set, got %v", service.Annotations)
+	}
+	ss := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), key, ss); err != nil {
+		t.Fatal(err)
+	}
+	if ss.Labels["cost-center"] != "finance" || ss.Annotations["owner"] != "data-team" {
+		t.Errorf("expected the StatefulSet metadata to be updated, got %v %v", ss.Labels, ss.Annotations)
+	}
+	if instance.Labels["cost-center"] != "default" {
+		t.Errorf("expected the Theia labels not to be mutated, got %v", instance.Labels)
+	}
+}
+
+// failingDeleteClient fails the deletion of the objects of a kind
+type failingDeleteClient struct {
+	client.Client
+	kind string
+}
+
+func (c *failingDeleteClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	if object, ok := obj.(*unstructured.Unstructured); ok && object.GetKind() == c.kind {
+		return fmt.Errorf("unable to delete %s", c.kind)
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func TestReconcileForceRemovesFinalizerAfterFailedCleanups(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	os.Setenv("CLEANUP_TIMEOUT", "30")
+	defer os.Unsetenv("CLEANUP_TIMEOUT")
+	instance := newTestTheia()
+	now := metav1.Now()
+	instance.DeletionTimestamp = &now
+	instance.Finalizers = []string{RoutingFinalizer}
+	r := newTestReconciler(instance)
+	r.Client = &failingDeleteClient{Client: r.Client, kind: "VirtualService"}
+
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	getTheia := func() *v1alpha1.Theia {
+		found := &v1alpha1.Theia{}
+		if err := r.Get(context.TODO(), key, found); err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	resourceVersion := ""
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err == nil {
+			t.Fatalf("expected cleanup attempt %d to fail", attempt)
+		}
+		found := getTheia()
+		if !containsString(found.Finalizers, RoutingFinalizer) {
+			t.Fatalf("expected the finalizer to be kept after %d failed cleanups", attempt)
+		}
+		if found.Annotations[CleanupFailingSinceAnnotation] == "" {
+			t.Fatalf("expected the first failure to be recorded")
+		}
+		// Only the first failure updates the Theia, so that the retries back off
+		if attempt > 1 && found.ResourceVersion != resourceVersion {
+			t.Errorf("expected failed cleanup %d not to update the Theia", attempt)
+		}
+		resourceVersion = found.ResourceVersion
+	}
+	drainEvents(r)
+
+	instance = getTheia()
+	instance.Annotations[CleanupFailingSinceAnnotation] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	found := reconcileTheia(t, r, instance)
+	if containsString(found.Finalizers, RoutingFinalizer) {
+		t.Errorf("expected the finalizer to be removed once the cleanup timed out")
+	}
+	events := drainEvents(r)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+EventReasonCleanupFailed) {
+		t.Errorf("expected a CleanupFailed warning, got %q", events)
+	}
+}
+
+func TestReconcileServiceType(t *testing.T) {
+	instance := newTestTheia()
+	instance.Spec.ServiceType = corev1.ServiceTypeLoadBalancer
+	instance.Spec.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+	svc := generateService(instance)
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer ||
+		!reflect.DeepEqual(svc.Spec.LoadBalancerSourceRanges, []string{"10.0.0.0/8"}) {
+		t.Errorf("expected a LoadBalancer Service limited to 10.0.0.0/8, got %+v", svc.Spec)
+	}
+	if svc := generateService(newTestTheia()); svc.Spec.Type != corev1.ServiceTypeClusterIP {
+		t.Errorf("expected a ClusterIP Service by default, got %s", svc.Spec.Type)
+	}
+
+	instance.Spec.LoadBalancerSourceRanges = []string{"10.0.0.0"}
+	if err := validateTheia(instance, nil); err == nil {
+		t.Errorf("expected a source range which isn't a CIDR to be rejected")
+	}
+	instance = newTestTheia()
+	nodePort := int32(30080)
+	instance.Spec.NodePort = &nodePort
+	if err := validateTheia(instance, nil); err == nil {
+		t.Errorf("expected a node port of a ClusterIP Service to be rejected")
+	}
+
+	// The node port allocated by the cluster is kept
+	instance.Spec.ServiceType = corev1.ServiceTypeNodePort
+	instance.Spec.NodePort = nil
+	r := newTestReconciler(instance)
+	instance = reconcileTheia(t, r, instance)
+	key := types.NamespacedName{Name: "my-theia", Namespace: "default"}
+	service := &corev1.Service{}
+	if err := r.Get(context.TODO(), key, service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != corev1.ServiceTypeNodePort {
+		t.Fatalf("expected a NodePort Service, got %s", service.Spec.Type)
+	}
+	service.Spec.Ports[0].NodePort = 31234
+	if err := r.Update(context.TODO(), service); err != nil {
+		t.Fatal(err)
+	}
+	instance = reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), key, service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Ports[0].NodePort != 31234 {
+		t.Errorf("expected the allocated node port to be kept, got %d", service.Spec.Ports[0].NodePort)
+	}
+
+	// A fixed node port wins
+	instance.Spec.NodePort = &nodePort
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	reconcileTheia(t, r, instance)
+	if err := r.Get(context.TODO(), key, service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Ports[0].NodePort != nodePort {
+		t.Errorf("expected the node port %d, got %d", nodePort, service.Spec.Ports[0].NodePort)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	v1alpha1 "theia-controller/api/v1alpha1"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// DefaultingWebhookPath is the path the TheiaDefaulter is served at
+	DefaultingWebhookPath = "/mutate-e2-fyi-v1alpha1-theia"
+	// DefaultStorageSize is the storage requested by a workspace PVC without any
+	DefaultStorageSize = "10Gi"
+	// isDefaultStorageClassAnnotation marks the default storage class of the cluster
+	isDefaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+	// betaIsDefaultStorageClassAnnotation is the beta version of isDefaultStorageClassAnnotation
+	betaIsDefaultStorageClassAnnotation = "storageclass.beta.kubernetes.io/is-default-class"
+)
+
+// +kubebuilder:webhook:path=/mutate-e2-fyi-v1alpha1-theia,mutating=true,failurePolicy=fail,groups=e2.fyi,resources=theia,verbs=create;update,versions=v1alpha1,name=mtheia.e2.fyi
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+
+// TheiaDefaulter writes the defaults of the Theia container into the Theia at
+// admission, so that the stored Theia shows the image, working dir and ports
+// which are going to run. The defaults are the same as the ones applied to the
+// StatefulSet. A Theia created without storage class gets one when
+// ENABLE_STORAGE_CLASS_DEFAULTING is set to "true".
+type TheiaDefaulter struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &TheiaDefaulter{}
+
+// InjectDecoder injects the decoder of the admission requests.
+func (d *TheiaDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+// Handle patches the Theia of the admission request with its defaults.
+func (d *TheiaDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	instance := &v1alpha1.Theia{}
+	if err := d.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// a Theia without containers is rejected by the reconciliation
+	if len(instance.Spec.Template.Spec.Containers) == 0 {
+		return admission.Allowed("")
+	}
+	defaultTheiaContainer(instance, &instance.Spec.Template.Spec)
+	// the volume claim template of an existing StatefulSet can't be changed
+	if req.Operation == admissionv1beta1.Create && os.Getenv("ENABLE_STORAGE_CLASS_DEFAULTING") == "true" {
+		if err := d.defaultStorageClass(ctx, instance); err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+	}
+	marshalled, err := json.Marshal(instance)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshalled)
+}
+
+// defaultStorageClass sets the storage class of the workspace PVC of a Theia
+// without any to the DEFAULT_STORAGE_CLASS of the controller, or else to the
+// default storage class of the cluster. The access mode and the storage
+// request of the PVC are defaulted alongside, so that the PVC can be created.
+func (d *TheiaDefaulter) defaultStorageClass(ctx context.Context, instance *v1alpha1.Theia) error {
+	pvcSpec := &instance.Spec.Template.PersistentVolumeClaimSpec
+	if pvcSpec.StorageClassName != nil {
+		return nil
+	}
+	storageClass := os.Getenv("DEFAULT_STORAGE_CLASS")
+	if storageClass == "" {
+		storageClasses := &storagev1.StorageClassList{}
+		if err := d.Client.List(ctx, storageClasses); err != nil {
+			return err
+		}
+		for _, class := range storageClasses.Items {
+			if class.Annotations[isDefaultStorageClassAnnotation] == "true" ||
+				class.Annotations[betaIsDefaultStorageClassAnnotation] == "true" {
+				storageClass = class.Name
+				break
+			}
+		}
+	}
+	if storageClass == "" {
+		return nil
+	}
+	pvcSpec.StorageClassName = &storageClass
+	if len(pvcSpec.AccessModes) == 0 {
+		pvcSpec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+	if _, ok := pvcSpec.Resources.Requests[corev1.ResourceStorage]; !ok {
+		size, err := resource.ParseQuantity(os.Getenv("DEFAULT_STORAGE_SIZE"))
+		if err != nil {
+			size = resource.MustParse(DefaultStorageSize)
+		}
+		if pvcSpec.Resources.Requests == nil {
+			pvcSpec.Resources.Requests = corev1.ResourceList{}
+		}
+		pvcSpec.Resources.Requests[corev1.ResourceStorage] = size
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	v1alpha1 "theia-controller/api/v1alpha1"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// validateTheia checks the Theia against the policies enforced by the
+// controller and the cluster template, if any. Nothing is created for a Theia
+// violating them.
+func validateTheia(instance *v1alpha1.Theia, clusterTemplate *v1alpha1.TheiaClusterTemplate) error {
+	if err := validateContainers(instance); err != nil {
+		return err
+	}
+	if err := validatePrivileged(instance); err != nil {
+		return err
+	}
+	if err := validateOverhead(instance); err != nil {
+		return err
+	}
+	if err := validateNetworkBandwidth(instance); err != nil {
+		return err
+	}
+	if err := validateProcMount(instance); err != nil {
+		return err
+	}
+	if err := validateRouting(instance); err != nil {
+		return err
+	}
+	if err := validateVolumeDevices(instance); err != nil {
+		return err
+	}
+	if err := validateService(instance); err != nil {
+		return err
+	}
+	if clusterTemplate != nil {
+		return validateClusterTemplate(&generateStatefulSet(instance).Spec.Template.Spec, clusterTemplate)
+	}
+	return nil
+}
+
+// getClusterTemplate returns the TheiaClusterTemplate referenced by the Theia,
+// or the one named by DEFAULT_CLUSTER_TEMPLATE when the Theia references none.
+func (r *TheiaReconciler) getClusterTemplate(ctx context.Context, instance *v1alpha1.Theia) (*v1alpha1.TheiaClusterTemplate, error) {
+	name := instance.Spec.ClusterTemplate
+	if name == "" {
+		name = os.Getenv("DEFAULT_CLUSTER_TEMPLATE")
+	}
+	if name == "" {
+		return nil, nil
+	}
+	clusterTemplate := &v1alpha1.TheiaClusterTemplate{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name}, clusterTemplate); err != nil {
+		return nil, err
+	}
+	return clusterTemplate, nil
+}
+
+// validateClusterTemplate checks the images and the resources of the containers
+// of the generated pod spec against the constraints of the cluster template, so
+// that the defaults and the containers injected by the controller are checked
+// too.
+func validateClusterTemplate(podSpec *corev1.PodSpec, clusterTemplate *v1alpha1.TheiaClusterTemplate) error {
+	containers := append([]corev1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+	for _, container := range containers {
+		if !imageIsAllowed(container.Image, clusterTemplate.Spec.AllowedImages) {
+			return fmt.Errorf("image %s of container %s is not allowed by cluster template %s",
+				container.Image, container.Name, clusterTemplate.Name)
+		}
+		for name, max := range clusterTemplate.Spec.MaxResources {
+			for _, resources := range []corev1.ResourceList{container.Resources.Requests, container.Resources.Limits} {
+				if quantity, ok := resources[name]; ok && quantity.Cmp(max) > 0 {
+					return fmt.Errorf("%s of %s for container %s exceeds the maximum of %s of cluster template %s",
+						name, quantity.String(), container.Name, max.String(), clusterTemplate.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// clusterTemplateRequests maps a TheiaClusterTemplate to the Theia using it, so
+// that they are validated again when the template changes.
+func (r *TheiaReconciler) clusterTemplateRequests(a handler.MapObject) []ctrl.Request {
+	theias := &v1alpha1.TheiaList{}
+	if err := r.List(context.TODO(), theias); err != nil {
+		r.Log.Error(err, "unable to list the Theia of cluster template", "name", a.Meta.GetName())
+		return nil
+	}
+	isDefault := os.Getenv("DEFAULT_CLUSTER_TEMPLATE") == a.Meta.GetName()
+	requests := []ctrl.Request{}
+	for _, theia := range theias.Items {
+		name := theia.Spec.ClusterTemplate
+		if name == a.Meta.GetName() || (name == "" && isDefault) {
+			requests = append(requests, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: theia.Name, Namespace: theia.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
+// imageIsAllowed returns true if the image matches one of the allowed images,
+// or if there are no allowed images.
+func imageIsAllowed(image string, allowedImages []string) bool {
+	if len(allowedImages) == 0 {
+		return true
+	}
+	for _, allowed := range allowedImages {
+		if image == allowed || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(image, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// inNamespaceList returns true if namespace is in the comma separated list of
+// namespaces in the env var
+func inNamespaceList(env string, namespace string) bool {
+	return listContains(os.Getenv(env), namespace)
+}
+
+// listContains returns true if value is in the comma separated list
+func listContains(list string, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateContainers rejects a Theia without any container, as it needs at
+// least the Theia container picked by theiaContainerIndex, and container ports
+// out of the 1-65535 range. A Theia container without ports gets the default
+// one from defaultTheiaContainer.
+func validateContainers(instance *v1alpha1.Theia) error {
+	podSpec := &instance.Spec.Template.Spec
+	if len(podSpec.Containers) == 0 {
+		return fmt.Errorf("spec.template.spec.containers must have at least one container")
+	}
+	containers := append([]corev1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			if port.ContainerPort < 1 || port.ContainerPort > 65535 {
+				return fmt.Errorf("containerPort %d of container %s is not between 1 and 65535",
+					port.ContainerPort, container.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePrivileged denies privileged containers, which would allow escaping
+// the workspace, unless the namespace is listed in ALLOW_PRIVILEGED_NAMESPACES.
+func validatePrivileged(instance *v1alpha1.Theia) error {
+	if inNamespaceList("ALLOW_PRIVILEGED_NAMESPACES", instance.Namespace) {
+		return nil
+	}
+	podSpec := &instance.Spec.Template.Spec
+	containers := append([]corev1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+	for _, container := range containers {
+		if sc := container.SecurityContext; sc != nil && sc.Privileged != nil && *sc.Privileged {
+			return fmt.Errorf("privileged container %s is not allowed in namespace %s",
+				container.Name, instance.Namespace)
+		}
+	}
+	return nil
+}
+
+// validateOverhead rejects a pod overhead without a RuntimeClass, as the
+// overhead is only accounted for the RuntimeClass defining it and such a pod
+// would be refused by the RuntimeClass admission.
+func validateOverhead(instance *v1alpha1.Theia) error {
+	podSpec := &instance.Spec.Template.Spec
+	if len(podSpec.Overhead) > 0 && (podSpec.RuntimeClassName == nil || *podSpec.RuntimeClassName == "") {
+		return fmt.Errorf("pod overhead requires a runtimeClassName")
+	}
+	return nil
+}
+
+// validateNetworkBandwidth rejects bandwidth limits the CNI bandwidth plugin
+// can't enforce. The plugin accepts limits from 1k to 32G bits per second.
+func validateNetworkBandwidth(instance *v1alpha1.Theia) error {
+	bandwidth := instance.Spec.NetworkBandwidth
+	if bandwidth == nil {
+		return nil
+	}
+	min, max := resource.MustParse("1k"), resource.MustParse("32G")
+	for name, limit := range map[string]*resource.Quantity{"ingress": bandwidth.Ingress, "egress": bandwidth.Egress} {
+		if limit != nil && (limit.Cmp(min) < 0 || limit.Cmp(max) > 0) {
+			return fmt.Errorf("%s bandwidth %s is not between %s and %s", name, limit.String(), min.String(), max.String())
+		}
+	}
+	return nil
+}
+
+// validateRouting rejects a route timeout which is negative or isn't a Go
+// duration, and a gateway which isn't in the namespace/name form.
+func validateRouting(instance *v1alpha1.Theia) error {
+	routing := instance.Spec.Routing
+	if routing == nil {
+		return nil
+	}
+	if routing.Timeout != "" {
+		timeout, err := time.ParseDuration(routing.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid routing timeout %q: %v", routing.Timeout, err)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("routing timeout %s is negative", routing.Timeout)
+		}
+	}
+	if routing.Gateway != "" {
+		parts := strings.Split(routing.Gateway, "/")
+		if len(parts) != 2 || len(validation.IsDNS1123Label(parts[0])) > 0 ||
+			len(validation.IsDNS1123Subdomain(parts[1])) > 0 {
+			return fmt.Errorf("routing gateway %q is not in the namespace/name form", routing.Gateway)
+		}
+	}
+	return nil
+}
+
+// validateService rejects load balancer source ranges which aren't CIDRs or
+// without a LoadBalancer Service, and a node port without a Service exposed on
+// the nodes.
+func validateService(instance *v1alpha1.Theia) error {
+	svcType := serviceType(instance)
+	for _, sourceRange := range instance.Spec.LoadBalancerSourceRanges {
+		if svcType != corev1.ServiceTypeLoadBalancer {
+			return fmt.Errorf("loadBalancerSourceRanges require the LoadBalancer service type, not %s", svcType)
+		}
+		if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+			return fmt.Errorf("invalid load balancer source range %q: %v", sourceRange, err)
+		}
+	}
+	if instance.Spec.NodePort != nil && svcType == corev1.ServiceTypeClusterIP {
+		return fmt.Errorf("nodePort requires the NodePort or LoadBalancer service type")
+	}
+	return nil
+}
+
+// validateVolumeDevices rejects volume devices with relative or duplicated
+// paths, or of unknown volumes, and a block workspace which isn't attached as a
+// volume device or can't be used as a block device.
+func validateVolumeDevices(instance *v1alpha1.Theia) error {
+	volumeName := workspaceVolumeName(instance)
+	block := blockWorkspace(instance)
+	workspaceDevice := false
+	paths := map[string]bool{}
+	for _, device := range instance.Spec.Template.VolumeDevices {
+		if !path.IsAbs(device.DevicePath) {
+			return fmt.Errorf("volume device %s has a relative path %q", device.Name, device.DevicePath)
+		}
+		devicePath := path.Clean(device.DevicePath)
+		if paths[devicePath] {
+			return fmt.Errorf("volume device path %s is used more than once", devicePath)
+		}
+		paths[devicePath] = true
+		if device.Name == volumeName {
+			if !block {
+				return fmt.Errorf("volume device %s requires a pvc of volumeMode Block", device.Name)
+			}
+			workspaceDevice = true
+		} else if !hasVolume(&instance.Spec.Template.Spec, device.Name) {
+			return fmt.Errorf("volume device %s doesn't reference a volume of the pod", device.Name)
+		}
+	}
+	if !block {
+		return nil
+	}
+	if !workspaceDevice {
+		return fmt.Errorf("pvc of volumeMode Block requires a volume device named %s", volumeName)
+	}
+	if instance.Spec.Template.PersistentVolumeClaimSpec.StorageClassName == nil || existingClaim(instance) != "" {
+		return fmt.Errorf("volumeMode Block requires the volume claim template of a storage class")
+	}
+	if instance.Spec.GitRepo != nil {
+		return fmt.Errorf("gitRepo can't be cloned into a block workspace")
+	}
+	return nil
+}
+
+// validateProcMount rejects unknown proc mount types.
+func validateProcMount(instance *v1alpha1.Theia) error {
+	procMount := instance.Spec.Template.ProcMount
+	if procMount == nil || *procMount == corev1.DefaultProcMount || *procMount == corev1.UnmaskedProcMount {
+		return nil
+	}
+	return fmt.Errorf("unknown procMount %s", *procMount)
+}
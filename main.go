@@ -21,13 +21,16 @@ import (
 	"os"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	e2fyiv1alpha1 "theia-controller/api/v1alpha1"
 	"theia-controller/controllers"
+	"theia-controller/pkg/culler"
 	controller_metrics "theia-controller/pkg/metrics"
 	// +kubebuilder:scaffold:imports
 )
@@ -55,7 +58,8 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	cfg := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
@@ -67,6 +71,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	culler.SetPodLogSource(culler.NewKubeletLogSource(kubernetes.NewForConfigOrDie(cfg).CoreV1()))
+
 	if err = (&controllers.TheiaReconciler{
 		Client:        mgr.GetClient(),
 		Log:           ctrl.Log.WithName("controllers").WithName("Theia"),
@@ -77,6 +83,12 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "Theia")
 		os.Exit(1)
 	}
+	// The webhook server needs the certificates of the [WEBHOOK] sections of
+	// the config
+	if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+		mgr.GetWebhookServer().Register(controllers.DefaultingWebhookPath,
+			&webhook.Admission{Handler: &controllers.TheiaDefaulter{Client: mgr.GetClient()}})
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -1,16 +1,20 @@
 package culler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"theia-controller/pkg/metrics"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
@@ -26,6 +30,36 @@ const DEFAULT_IDLE_TIME = "1440" // One day
 const DEFAULT_CULLING_CHECK_PERIOD = "1"
 const DEFAULT_ENABLE_CULLING = "false"
 const DEFAULT_CLUSTER_DOMAIN = "cluster.local"
+const DEFAULT_ENABLE_LOG_ACTIVITY = "false"
+const DEFAULT_ENABLE_CULLED_DELETION = "false"
+const DEFAULT_CULLED_RETENTION_TIME = "10080" // One week
+const DEFAULT_ENABLE_TERMINAL_ACTIVITY = "false"
+const DEFAULT_ENABLE_ACTIVITY_SIDECAR = "false"
+const DEFAULT_ENABLE_DIRTY_STATE_PROTECTION = "false"
+const DEFAULT_ENABLE_GIT_COMMIT_ON_CULL = "false"
+const DEFAULT_GIT_COMMIT_MESSAGE = "Save the workspace before culling"
+const DEFAULT_ENABLE_ACTIVITY_ANNOTATION = "false"
+
+// The activity tracker sidecar injected with ENABLE_ACTIVITY_SIDECAR proxies
+// the requests to Theia, and reports their last activity at this path in the
+// same format as the Theia /api/status endpoint.
+const ACTIVITY_SIDECAR_PATH = "/theia-activity"
+
+// The endpoints of the theia server reporting additional activity signals can
+// be configured with the {name}, {namespace} and {domain} placeholders.
+const DEFAULT_TERMINAL_ACTIVITY_URL = "http://{name}.{namespace}.svc.{domain}/theia/{namespace}/{name}/api/terminals"
+const DEFAULT_DIRTY_STATE_URL = "http://{name}.{namespace}.svc.{domain}/theia/{namespace}/{name}/api/dirty"
+
+// With ENABLE_ACTIVITY_ANNOTATION, the controller polls this endpoint on each
+// reconcile, and records the last activity it reports, in the same format as
+// the Theia /api/status endpoint, with the LAST_ACTIVITY_ANNOTATION. The
+// culling then keys off the annotation instead of querying Theia itself.
+const DEFAULT_ACTIVITY_URL = "http://{name}.{namespace}.svc.{domain}/theia/{namespace}/{name}/api/status"
+const LAST_ACTIVITY_ANNOTATION = "theia.e2.fyi/last-activity"
+
+// The endpoint of the theia server committing and pushing the git workspace,
+// which is called before culling when ENABLE_GIT_COMMIT_ON_CULL is set.
+const DEFAULT_GIT_COMMIT_URL = "http://{name}.{namespace}.svc.{domain}/theia/{namespace}/{name}/api/git/commit"
 
 // When a Resource should be stopped/culled, then the controller should add this
 // annotation in the Resource's Metadata. Then, inside the reconcile loop,
@@ -37,6 +71,28 @@ const DEFAULT_CLUSTER_DOMAIN = "cluster.local"
 // this annotation is set. If it's not set, then it will make the replicas 1.
 const STOP_ANNOTATION = "kubeflow-resource-stopped"
 
+// The culler records why it stopped a Resource with this annotation, so that
+// an auto-cull can be told apart from a stop requested by the user, who only
+// sets the STOP_ANNOTATION. Both are resumed the same way, by removing the
+// STOP_ANNOTATION.
+const STOP_REASON_ANNOTATION = "theia.e2.fyi/stop-reason"
+const STOP_REASON_CULLED = "Culled"
+const STOP_REASON_USER = "UserStopped"
+
+// The controller stops a Resource with this reason while its spec.stopped is
+// true, and resumes it once spec.stopped is false again.
+const STOP_REASON_SPEC = "SpecStopped"
+
+// Resources with this annotation (a duration, e.g. "8h") are stopped once the
+// duration has elapsed since their creation, whether they are idle or not. The
+// controller records STOP_REASON_TTL as the reason.
+const TTL_ANNOTATION = "theia.e2.fyi/ttl"
+const STOP_REASON_TTL = "TTLExpired"
+
+// Resources with this annotation set to "true" (e.g. test or CI instances) are
+// still culled, but aren't accounted in the culling metrics.
+const EXCLUDE_METRICS_ANNOTATION = "theia.e2.fyi/exclude-from-metrics"
+
 type theiaStatus struct {
 	Started      string `json:"started"`
 	LastActivity string `json:"last_activity"`
@@ -44,6 +100,62 @@ type theiaStatus struct {
 	Kernels      int    `json:"kernels"`
 }
 
+// terminalStatus is reported by the TERMINAL_ACTIVITY_URL endpoint
+type terminalStatus struct {
+	Terminals int `json:"terminals"`
+}
+
+// dirtyStatus is reported by the DIRTY_STATE_URL endpoint
+type dirtyStatus struct {
+	Dirty bool `json:"dirty"`
+}
+
+// gitCommitRequest is posted to the GIT_COMMIT_URL endpoint
+type gitCommitRequest struct {
+	Message string `json:"message"`
+	Push    bool   `json:"push"`
+}
+
+// PodLogSource returns the time of the most recent log line of a Pod. It is
+// used as an additional activity signal when ENABLE_LOG_ACTIVITY is set.
+type PodLogSource interface {
+	LastLogTime(namespace, name string) (time.Time, error)
+}
+
+var podLogSource PodLogSource
+
+// SetPodLogSource sets the source used to check the Pod log activity.
+func SetPodLogSource(source PodLogSource) {
+	podLogSource = source
+}
+
+// kubeletLogSource reads the Pod logs through the kubelet log API.
+type kubeletLogSource struct {
+	pods corev1client.PodsGetter
+}
+
+// NewKubeletLogSource returns a PodLogSource backed by the kubelet log API.
+func NewKubeletLogSource(pods corev1client.PodsGetter) PodLogSource {
+	return &kubeletLogSource{pods: pods}
+}
+
+func (s *kubeletLogSource) LastLogTime(namespace, name string) (time.Time, error) {
+	tailLines := int64(1)
+	raw, err := s.pods.Pods(namespace).GetLogs(name, &corev1.PodLogOptions{
+		Timestamps: true,
+		TailLines:  &tailLines,
+	}).DoRaw()
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Each line is prefixed with a RFC3339Nano timestamp when Timestamps is set
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("no logs for pod %s/%s", namespace, name)
+	}
+	return time.Parse(time.RFC3339Nano, fields[0])
+}
+
 // Some Utility Functions
 func getEnvDefault(variable string, defaultVal string) string {
 	envVar := os.Getenv(variable)
@@ -59,6 +171,12 @@ func createTimestamp() string {
 	return now.Format(time.RFC3339)
 }
 
+// GetClusterDomain returns the DNS domain of the cluster from the
+// CLUSTER_DOMAIN env var.
+func GetClusterDomain() string {
+	return getEnvDefault("CLUSTER_DOMAIN", DEFAULT_CLUSTER_DOMAIN)
+}
+
 func GetRequeueTime() time.Duration {
 	// The frequency in which we check if the Pod needs culling
 	// Uses ENV var: CULLING_CHECK_PERIOD
@@ -75,7 +193,7 @@ func GetRequeueTime() time.Duration {
 	return time.Duration(realCullingPeriod) * time.Minute
 }
 
-func getMaxIdleTime() time.Duration {
+func GetMaxIdleTime() time.Duration {
 	idleTime := getEnvDefault("IDLE_TIME", DEFAULT_IDLE_TIME)
 	realIdleTime, err := strconv.Atoi(idleTime)
 	if err != nil {
@@ -88,6 +206,20 @@ func getMaxIdleTime() time.Duration {
 	return time.Minute * time.Duration(realIdleTime)
 }
 
+func getCulledRetentionTime() time.Duration {
+	retentionTime := getEnvDefault(
+		"CULLED_RETENTION_TIME", DEFAULT_CULLED_RETENTION_TIME)
+	realRetentionTime, err := strconv.Atoi(retentionTime)
+	if err != nil {
+		log.Info(fmt.Sprintf(
+			"CULLED_RETENTION_TIME should be Int. Got %s instead. Using default value.",
+			retentionTime))
+		realRetentionTime, _ = strconv.Atoi(DEFAULT_CULLED_RETENTION_TIME)
+	}
+
+	return time.Minute * time.Duration(realRetentionTime)
+}
+
 // Stop Annotation handling functions
 func SetStopAnnotation(meta *metav1.ObjectMeta, m *metrics.Metrics) {
 	if meta == nil {
@@ -97,17 +229,23 @@ func SetStopAnnotation(meta *metav1.ObjectMeta, m *metrics.Metrics) {
 	t := time.Now()
 	if meta.GetAnnotations() != nil {
 		meta.Annotations[STOP_ANNOTATION] = t.Format(time.RFC3339)
+		meta.Annotations[STOP_REASON_ANNOTATION] = STOP_REASON_CULLED
 	} else {
 		meta.SetAnnotations(map[string]string{
-			STOP_ANNOTATION: t.Format(time.RFC3339),
+			STOP_ANNOTATION:        t.Format(time.RFC3339),
+			STOP_REASON_ANNOTATION: STOP_REASON_CULLED,
 		})
 	}
-	if m != nil {
+	if m != nil && !ExcludedFromMetrics(*meta) {
 		m.TheiaCullingCount.WithLabelValues(meta.Namespace, meta.Name).Inc()
 		m.TheiaCullingTimestamp.WithLabelValues(meta.Namespace, meta.Name).Set(float64(t.Unix()))
 	}
 }
 
+func ExcludedFromMetrics(meta metav1.ObjectMeta) bool {
+	return meta.GetAnnotations()[EXCLUDE_METRICS_ANNOTATION] == "true"
+}
+
 func RemoveStopAnnotation(meta *metav1.ObjectMeta) {
 	if meta == nil {
 		log.Info("Error: Metadata is Nil. Can't remove Annotations")
@@ -121,6 +259,7 @@ func RemoveStopAnnotation(meta *metav1.ObjectMeta) {
 	if _, ok := meta.GetAnnotations()[STOP_ANNOTATION]; ok {
 		delete(meta.GetAnnotations(), STOP_ANNOTATION)
 	}
+	delete(meta.GetAnnotations(), STOP_REASON_ANNOTATION)
 }
 
 func StopAnnotationIsSet(meta metav1.ObjectMeta) bool {
@@ -135,18 +274,66 @@ func StopAnnotationIsSet(meta metav1.ObjectMeta) bool {
 	}
 }
 
-// Culling Logic
-func getTheiaApiStatus(nm, ns string) *theiaStatus {
-	// Get the theia Status from the Server's /api/status endpoint
-	domain := getEnvDefault("CLUSTER_DOMAIN", DEFAULT_CLUSTER_DOMAIN)
-	url := fmt.Sprintf(
-		"http://%s.%s.svc.%s/theia/%s/%s/api/status",
-		nm, ns, domain, ns, nm)
+// Retention of culled Resources
+func CulledDeletionIsEnabled() bool {
+	return getEnvDefault(
+		"ENABLE_CULLED_DELETION", DEFAULT_ENABLE_CULLED_DELETION) == "true"
+}
 
+// CulledRetentionElapsed returns true if the Resource has been stopped for
+// longer than CULLED_RETENTION_TIME and should be deleted to reclaim its
+// storage. Deletion is disabled unless 'ENABLE_CULLED_DELETION=true'.
+func CulledRetentionElapsed(meta metav1.ObjectMeta) bool {
+	if !CulledDeletionIsEnabled() || !StopAnnotationIsSet(meta) {
+		return false
+	}
+
+	stoppedAt, err := time.Parse(time.RFC3339, meta.GetAnnotations()[STOP_ANNOTATION])
+	if err != nil {
+		log.Info(fmt.Sprintf("Error parsing the stop time for %s/%s",
+			meta.Namespace, meta.Name), "error", err)
+		return false
+	}
+	return time.Now().After(stoppedAt.Add(getCulledRetentionTime()))
+}
+
+// TTLRemaining returns how long the Resource may still run before its
+// TTL_ANNOTATION expires, which is negative once it has expired. Returns false
+// if the Resource has no valid TTL.
+func TTLRemaining(meta metav1.ObjectMeta) (time.Duration, bool) {
+	value, ok := meta.GetAnnotations()[TTL_ANNOTATION]
+	if !ok {
+		return 0, false
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Info(fmt.Sprintf("Invalid TTL '%s' for %s/%s", value,
+			meta.Namespace, meta.Name))
+		return 0, false
+	}
+	return time.Until(meta.CreationTimestamp.Add(ttl)), true
+}
+
+// GetStopReason returns why the Resource was stopped, or an empty string if it
+// isn't stopped.
+func GetStopReason(meta metav1.ObjectMeta) string {
+	if !StopAnnotationIsSet(meta) {
+		return ""
+	}
+	if reason, ok := meta.GetAnnotations()[STOP_REASON_ANNOTATION]; ok && reason != "" {
+		return reason
+	}
+	return STOP_REASON_USER
+}
+
+// Culling Logic
+// getJSON decodes the JSON response of a GET to the url into v. Failures are
+// logged and reported as false.
+func getJSON(url string, v interface{}) bool {
 	resp, err := client.Get(url)
 	if err != nil {
 		log.Info(fmt.Sprintf("Error talking to %s", url), "error", err)
-		return nil
+		return false
 	}
 
 	// Decode the body
@@ -154,22 +341,166 @@ func getTheiaApiStatus(nm, ns string) *theiaStatus {
 	if resp.StatusCode != 200 {
 		log.Info(fmt.Sprintf(
 			"Warning: GET to %s: %d", url, resp.StatusCode))
-		return nil
+		return false
 	}
 
-	status := new(theiaStatus)
-	err = json.NewDecoder(resp.Body).Decode(status)
+	err = json.NewDecoder(resp.Body).Decode(v)
 	if err != nil {
 		log.Info(fmt.Sprintf(
-			"Error parsing the JSON response for theia %s/%s", nm, ns),
+			"Error parsing the JSON response from %s", url),
 			"error", err)
+		return false
+	}
+	return true
+}
+
+// expandTheiaURL replaces the {name}, {namespace} and {domain} placeholders of
+// a configurable endpoint of the theia server.
+func expandTheiaURL(url, nm, ns string) string {
+	domain := GetClusterDomain()
+	return strings.NewReplacer(
+		"{name}", nm, "{namespace}", ns, "{domain}", domain).Replace(url)
+}
+
+func ActivityAnnotationIsEnabled() bool {
+	return getEnvDefault("ENABLE_ACTIVITY_ANNOTATION", DEFAULT_ENABLE_ACTIVITY_ANNOTATION) == "true"
+}
+
+// GetActivityCheckPeriod returns how often the activity of a running Resource
+// is polled, from the ACTIVITY_CHECK_PERIOD env var in minutes. Defaults to the
+// culling check period.
+func GetActivityCheckPeriod() time.Duration {
+	period, err := strconv.Atoi(os.Getenv("ACTIVITY_CHECK_PERIOD"))
+	if err != nil || period <= 0 {
+		return GetRequeueTime()
+	}
+	return time.Duration(period) * time.Minute
+}
+
+// UpdateLastActivity polls the ACTIVITY_URL endpoint of the Resource and
+// records the last activity it reports with the LAST_ACTIVITY_ANNOTATION,
+// unless an earlier one is reported. Returns true if the annotation changed.
+func UpdateLastActivity(meta *metav1.ObjectMeta) bool {
+	url := expandTheiaURL(
+		getEnvDefault("ACTIVITY_URL", DEFAULT_ACTIVITY_URL), meta.Name, meta.Namespace)
+	status := new(theiaStatus)
+	if !getJSON(url, status) {
+		return false
+	}
+	lastActivity, err := time.Parse(time.RFC3339, status.LastActivity)
+	if err != nil {
+		log.Info(fmt.Sprintf("Error parsing the activity of %s/%s",
+			meta.Namespace, meta.Name), "error", err)
+		return false
+	}
+	if recorded, err := time.Parse(time.RFC3339, meta.Annotations[LAST_ACTIVITY_ANNOTATION]); err == nil &&
+		!lastActivity.After(recorded) {
+		return false
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[LAST_ACTIVITY_ANNOTATION] = lastActivity.Format(time.RFC3339)
+	return true
+}
+
+// annotatedStatus returns the last activity recorded by UpdateLastActivity,
+// or nil until an activity is recorded.
+func annotatedStatus(meta metav1.ObjectMeta) *theiaStatus {
+	lastActivity, ok := meta.GetAnnotations()[LAST_ACTIVITY_ANNOTATION]
+	if !ok {
 		return nil
 	}
+	return &theiaStatus{LastActivity: lastActivity}
+}
+
+// ActivitySidecarIsEnabled returns whether the activity tracker sidecar is
+// injected, which also needs its image to be set with ACTIVITY_SIDECAR_IMAGE.
+func ActivitySidecarIsEnabled() bool {
+	return getEnvDefault("ENABLE_ACTIVITY_SIDECAR", DEFAULT_ENABLE_ACTIVITY_SIDECAR) == "true" &&
+		os.Getenv("ACTIVITY_SIDECAR_IMAGE") != ""
+}
+
+func GitCommitOnCullIsEnabled() bool {
+	return getEnvDefault("ENABLE_GIT_COMMIT_ON_CULL", DEFAULT_ENABLE_GIT_COMMIT_ON_CULL) == "true"
+}
 
+// CommitWorkspace asks the theia server to commit and push the changes of its
+// git workspace, so that the work isn't lost when the theia is culled.
+func CommitWorkspace(nm, ns string) error {
+	url := expandTheiaURL(
+		getEnvDefault("GIT_COMMIT_URL", DEFAULT_GIT_COMMIT_URL), nm, ns)
+	body, err := json.Marshal(&gitCommitRequest{
+		Message: getEnvDefault("GIT_COMMIT_MESSAGE", DEFAULT_GIT_COMMIT_MESSAGE),
+		Push:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST to %s: %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+func getTheiaApiStatus(nm, ns string) *theiaStatus {
+	// Get the theia Status from the Server's /api/status endpoint, or from the
+	// activity tracker sidecar when it is injected
+	domain := GetClusterDomain()
+	url := fmt.Sprintf(
+		"http://%s.%s.svc.%s/theia/%s/%s/api/status",
+		nm, ns, domain, ns, nm)
+	if ActivitySidecarIsEnabled() {
+		url = expandTheiaURL("http://{name}.{namespace}.svc.{domain}"+ACTIVITY_SIDECAR_PATH, nm, ns)
+	}
+
+	status := new(theiaStatus)
+	if !getJSON(url, status) {
+		return nil
+	}
 	return status
 }
 
-func theiaIsIdle(nm, ns string, status *theiaStatus) bool {
+func hasOpenTerminals(nm, ns string) bool {
+	// Open terminals are active work, even without any HTTP traffic
+	if getEnvDefault("ENABLE_TERMINAL_ACTIVITY", DEFAULT_ENABLE_TERMINAL_ACTIVITY) != "true" {
+		return false
+	}
+
+	url := expandTheiaURL(
+		getEnvDefault("TERMINAL_ACTIVITY_URL", DEFAULT_TERMINAL_ACTIVITY_URL), nm, ns)
+	status := new(terminalStatus)
+	if !getJSON(url, status) {
+		return false
+	}
+	return status.Terminals > 0
+}
+
+func hasUnsavedChanges(nm, ns string) bool {
+	// Culling would lose the unsaved editor state
+	if getEnvDefault("ENABLE_DIRTY_STATE_PROTECTION", DEFAULT_ENABLE_DIRTY_STATE_PROTECTION) != "true" {
+		return false
+	}
+
+	// The state is unknown when the endpoint fails, so the theia is kept for
+	// this round rather than risking its unsaved changes
+	url := expandTheiaURL(
+		getEnvDefault("DIRTY_STATE_URL", DEFAULT_DIRTY_STATE_URL), nm, ns)
+	status := new(dirtyStatus)
+	if !getJSON(url, status) {
+		log.Info(fmt.Sprintf("Unable to check the unsaved changes of theia %s/%s, not culling it", ns, nm))
+		return true
+	}
+	return status.Dirty
+}
+
+func theiaIsIdle(nm, ns string, status *theiaStatus, maxIdleTime time.Duration, activeSince time.Time) bool {
 	// Being idle means that the theia can be culled
 	if status == nil {
 		return false
@@ -182,19 +513,45 @@ func theiaIsIdle(nm, ns string, status *theiaStatus) bool {
 		return false
 	}
 
-	timeCap := lastActivity.Add(getMaxIdleTime())
+	if lastActivity.Before(activeSince) {
+		lastActivity = activeSince
+	}
+	timeCap := lastActivity.Add(maxIdleTime)
 	if time.Now().After(timeCap) {
 		return true
 	}
 	return false
 }
 
-func TheiaNeedsCulling(nbMeta metav1.ObjectMeta) bool {
+func podLogsAreFresh(podName, ns string, maxIdleTime time.Duration) bool {
+	// Recent log output of the theia pod means that the theia is still in use
+	if getEnvDefault("ENABLE_LOG_ACTIVITY", DEFAULT_ENABLE_LOG_ACTIVITY) != "true" ||
+		podLogSource == nil {
+		return false
+	}
+
+	lastLog, err := podLogSource.LastLogTime(ns, podName)
+	if err != nil {
+		log.Info(fmt.Sprintf("Error reading the logs of pod %s/%s", ns, podName),
+			"error", err)
+		return false
+	}
+	return time.Since(lastLog) < maxIdleTime
+}
+
+// TheiaNeedsCulling returns true if the theia has been idle for longer than
+// maxIdleTime. podName is the pod of the theia whose logs are checked. A maxIdleTime of 0 disables the culling of the theia. The theia
+// isn't idle before activeSince, e.g. when it was assigned to its user from a
+// pool of started theia.
+func TheiaNeedsCulling(nbMeta metav1.ObjectMeta, podName string, maxIdleTime time.Duration, activeSince time.Time) bool {
 	if getEnvDefault("ENABLE_CULLING", DEFAULT_ENABLE_CULLING) != "true" {
 		log.Info("Culling of idle Pods is Disabled. To enable it set the " +
 			"ENV Var 'ENABLE_CULLING=true'")
 		return false
 	}
+	if maxIdleTime <= 0 {
+		return false
+	}
 
 	nm, ns := nbMeta.GetName(), nbMeta.GetNamespace()
 	if StopAnnotationIsSet(nbMeta) {
@@ -202,6 +559,26 @@ func TheiaNeedsCulling(nbMeta metav1.ObjectMeta) bool {
 		return false
 	}
 
-	theiaStatus := getTheiaApiStatus(nm, ns)
-	return theiaIsIdle(nm, ns, theiaStatus)
+	if podLogsAreFresh(podName, ns, maxIdleTime) {
+		log.Info(fmt.Sprintf("theia %s/%s has recent log activity", ns, nm))
+		return false
+	}
+
+	if hasOpenTerminals(nm, ns) {
+		log.Info(fmt.Sprintf("theia %s/%s has open terminals", ns, nm))
+		return false
+	}
+
+	if hasUnsavedChanges(nm, ns) {
+		log.Info(fmt.Sprintf("theia %s/%s has unsaved changes", ns, nm))
+		return false
+	}
+
+	var status *theiaStatus
+	if ActivityAnnotationIsEnabled() {
+		status = annotatedStatus(nbMeta)
+	} else {
+		status = getTheiaApiStatus(nm, ns)
+	}
+	return theiaIsIdle(nm, ns, status, maxIdleTime, activeSince)
 }
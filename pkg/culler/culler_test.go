@@ -0,0 +1,218 @@
+package culler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"theia-controller/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeLogSource struct {
+	lastLog time.Time
+}
+
+func (s *fakeLogSource) LastLogTime(namespace, name string) (time.Time, error) {
+	return s.lastLog, nil
+}
+
+func TestPodLogsAreFresh(t *testing.T) {
+	os.Setenv("ENABLE_LOG_ACTIVITY", "true")
+	defer os.Unsetenv("ENABLE_LOG_ACTIVITY")
+	defer SetPodLogSource(nil)
+
+	SetPodLogSource(&fakeLogSource{lastLog: time.Now().Add(-time.Minute)})
+	if !podLogsAreFresh("my-theia-0", "default", GetMaxIdleTime()) {
+		t.Errorf("expected recent logs to be fresh")
+	}
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	if TheiaNeedsCulling(metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}, "my-theia-0", GetMaxIdleTime(), time.Time{}) {
+		t.Errorf("expected theia with recent logs not to be culled")
+	}
+	SetPodLogSource(&fakeLogSource{lastLog: time.Now().Add(-2 * GetMaxIdleTime())})
+	if podLogsAreFresh("my-theia-0", "default", GetMaxIdleTime()) {
+		t.Errorf("expected old logs not to be fresh")
+	}
+}
+
+func TestHasOpenTerminals(t *testing.T) {
+	terminals := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/default/my-theia/terminals" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"terminals": %d}`, terminals)
+	}))
+	defer server.Close()
+	os.Setenv("ENABLE_TERMINAL_ACTIVITY", "true")
+	defer os.Unsetenv("ENABLE_TERMINAL_ACTIVITY")
+	os.Setenv("TERMINAL_ACTIVITY_URL", server.URL+"/{namespace}/{name}/terminals")
+	defer os.Unsetenv("TERMINAL_ACTIVITY_URL")
+
+	if !hasOpenTerminals("my-theia", "default") {
+		t.Errorf("expected an open terminal to be reported")
+	}
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	if TheiaNeedsCulling(metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}, "my-theia-0", GetMaxIdleTime(), time.Time{}) {
+		t.Errorf("expected theia with open terminals not to be culled")
+	}
+	terminals = 0
+	if hasOpenTerminals("my-theia", "default") {
+		t.Errorf("expected no open terminals to be reported")
+	}
+}
+
+func TestHasUnsavedChanges(t *testing.T) {
+	dirty := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/default/my-theia/dirty" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"dirty": %t}`, dirty)
+	}))
+	defer server.Close()
+	os.Setenv("ENABLE_DIRTY_STATE_PROTECTION", "true")
+	defer os.Unsetenv("ENABLE_DIRTY_STATE_PROTECTION")
+	os.Setenv("DIRTY_STATE_URL", server.URL+"/{namespace}/{name}/dirty")
+	defer os.Unsetenv("DIRTY_STATE_URL")
+
+	if !hasUnsavedChanges("my-theia", "default") {
+		t.Errorf("expected unsaved changes to be reported")
+	}
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	if TheiaNeedsCulling(metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}, "my-theia-0", GetMaxIdleTime(), time.Time{}) {
+		t.Errorf("expected theia with unsaved changes not to be culled")
+	}
+	dirty = false
+	if hasUnsavedChanges("my-theia", "default") {
+		t.Errorf("expected no unsaved changes to be reported")
+	}
+	if !hasUnsavedChanges("other-theia", "default") {
+		t.Errorf("expected a failing dirty state endpoint to be treated as unsaved changes")
+	}
+	server.Close()
+	if TheiaNeedsCulling(metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}, "my-theia-0", GetMaxIdleTime(), time.Time{}) {
+		t.Errorf("expected theia with an unreachable dirty state endpoint not to be culled")
+	}
+}
+
+func TestSetStopAnnotationExcludedFromMetrics(t *testing.T) {
+	m := metrics.NewMetrics(nil)
+	excluded := metav1.ObjectMeta{
+		Name:        "ci-theia",
+		Namespace:   "default",
+		Annotations: map[string]string{EXCLUDE_METRICS_ANNOTATION: "true"},
+	}
+	SetStopAnnotation(&excluded, m)
+	if !StopAnnotationIsSet(excluded) {
+		t.Errorf("expected the excluded instance to be culled")
+	}
+	if count := testutil.ToFloat64(m.TheiaCullingCount.WithLabelValues("default", "ci-theia")); count != 0 {
+		t.Errorf("expected the excluded instance not to be counted, got %v", count)
+	}
+
+	included := metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}
+	SetStopAnnotation(&included, m)
+	if count := testutil.ToFloat64(m.TheiaCullingCount.WithLabelValues("default", "my-theia")); count != 1 {
+		t.Errorf("expected the instance to be counted once, got %v", count)
+	}
+}
+
+func TestTheiaIsIdleWithMaxIdleTime(t *testing.T) {
+	status := &theiaStatus{LastActivity: time.Now().Add(-30 * time.Minute).Format(time.RFC3339)}
+	if !theiaIsIdle("my-theia", "default", status, 10*time.Minute, time.Time{}) {
+		t.Errorf("expected theia to be idle after 10 minutes")
+	}
+	if theiaIsIdle("my-theia", "default", status, time.Hour, time.Time{}) {
+		t.Errorf("expected theia not to be idle before an hour")
+	}
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	if TheiaNeedsCulling(metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}, "my-theia-0", 0, time.Time{}) {
+		t.Errorf("expected a max idle time of 0 to disable culling")
+	}
+}
+
+func TestTheiaIsIdleSinceAssignment(t *testing.T) {
+	status := &theiaStatus{LastActivity: time.Now().Add(-30 * time.Minute).Format(time.RFC3339)}
+	if theiaIsIdle("my-theia", "default", status, 10*time.Minute, time.Now().Add(-5*time.Minute)) {
+		t.Errorf("expected theia assigned 5 minutes ago not to be idle")
+	}
+	if !theiaIsIdle("my-theia", "default", status, 10*time.Minute, time.Now().Add(-20*time.Minute)) {
+		t.Errorf("expected theia assigned 20 minutes ago to be idle")
+	}
+}
+
+func TestTTLRemaining(t *testing.T) {
+	meta := metav1.ObjectMeta{
+		Name:              "my-theia",
+		Namespace:         "default",
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-2 * time.Hour)),
+	}
+	if _, ok := TTLRemaining(meta); ok {
+		t.Errorf("expected no TTL without the annotation")
+	}
+	meta.Annotations = map[string]string{TTL_ANNOTATION: "3h"}
+	if remaining, ok := TTLRemaining(meta); !ok || remaining <= 0 || remaining > time.Hour {
+		t.Errorf("expected about an hour left, got %v", remaining)
+	}
+	meta.Annotations[TTL_ANNOTATION] = "1h"
+	if remaining, ok := TTLRemaining(meta); !ok || remaining > 0 {
+		t.Errorf("expected the TTL to be expired, got %v", remaining)
+	}
+	meta.Annotations[TTL_ANNOTATION] = "forever"
+	if _, ok := TTLRemaining(meta); ok {
+		t.Errorf("expected an invalid TTL to be ignored")
+	}
+}
+
+func TestUpdateLastActivity(t *testing.T) {
+	lastActivity := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/default/my-theia/status" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"last_activity": %q}`, lastActivity)
+	}))
+	defer server.Close()
+	os.Setenv("ACTIVITY_URL", server.URL+"/{namespace}/{name}/status")
+	defer os.Unsetenv("ACTIVITY_URL")
+
+	meta := metav1.ObjectMeta{Name: "my-theia", Namespace: "default"}
+	if !UpdateLastActivity(&meta) || meta.Annotations[LAST_ACTIVITY_ANNOTATION] != lastActivity {
+		t.Fatalf("expected the last activity to be recorded, got %v", meta.Annotations)
+	}
+	recent := time.Now().UTC().Format(time.RFC3339)
+	meta.Annotations[LAST_ACTIVITY_ANNOTATION] = recent
+	if UpdateLastActivity(&meta) || meta.Annotations[LAST_ACTIVITY_ANNOTATION] != recent {
+		t.Errorf("expected an earlier activity not to be recorded, got %v", meta.Annotations)
+	}
+
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	os.Setenv("ENABLE_ACTIVITY_ANNOTATION", "true")
+	defer os.Unsetenv("ENABLE_ACTIVITY_ANNOTATION")
+	if TheiaNeedsCulling(meta, "my-theia-0", time.Hour, time.Time{}) {
+		t.Errorf("expected a recently active instance not to be culled")
+	}
+	meta.Annotations[LAST_ACTIVITY_ANNOTATION] = lastActivity
+	if !TheiaNeedsCulling(meta, "my-theia-0", time.Hour, time.Time{}) {
+		t.Errorf("expected the culling to key off the last activity annotation")
+	}
+	delete(meta.Annotations, LAST_ACTIVITY_ANNOTATION)
+	if TheiaNeedsCulling(meta, "my-theia-0", time.Hour, time.Time{}) {
+		t.Errorf("expected an instance without recorded activity not to be culled")
+	}
+}
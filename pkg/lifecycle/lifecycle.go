@@ -0,0 +1,110 @@
+package lifecycle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+var log = logf.Log.WithName("lifecycle")
+var client = &http.Client{
+	Timeout: time.Second * 10,
+}
+
+// The lifecycle transitions of a Theia which are sent to the callback.
+const (
+	Created = "created"
+	Ready   = "ready"
+	Culled  = "culled"
+	Deleted = "deleted"
+)
+
+type theiaEvent struct {
+	Event       string            `json:"event"`
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	UID         string            `json:"uid"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Timestamp   string            `json:"timestamp"`
+}
+
+// delivery is a lifecycle event waiting to be posted to the callback.
+type delivery struct {
+	url       string
+	event     string
+	name      string
+	namespace string
+	body      []byte
+}
+
+// The events are posted in order by a single background sender, so that a
+// slow callback never stalls the reconciliation of the Theia.
+var deliveries = make(chan delivery, 1000)
+var startSender sync.Once
+
+// Enabled returns true if a lifecycle callback is configured with the
+// ENV var 'LIFECYCLE_WEBHOOK_URL'.
+func Enabled() bool {
+	return os.Getenv("LIFECYCLE_WEBHOOK_URL") != ""
+}
+
+// Notify queues the lifecycle transition of the Theia to be posted to the
+// configured callback. Failures are only logged, and the event is dropped if
+// the queue is full, so that an unavailable external system never blocks the
+// reconciliation.
+func Notify(event string, meta metav1.ObjectMeta) {
+	url := os.Getenv("LIFECYCLE_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+
+	body, err := json.Marshal(&theiaEvent{
+		Event:       event,
+		Name:        meta.Name,
+		Namespace:   meta.Namespace,
+		UID:         string(meta.UID),
+		Labels:      meta.Labels,
+		Annotations: meta.Annotations,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Info("Error encoding the lifecycle event", "error", err)
+		return
+	}
+
+	startSender.Do(func() {
+		go func() {
+			for d := range deliveries {
+				post(d)
+			}
+		}()
+	})
+	select {
+	case deliveries <- delivery{url: url, event: event, name: meta.Name, namespace: meta.Namespace, body: body}:
+	default:
+		log.Info(fmt.Sprintf("Dropping the %s event of theia %s/%s, too many events are waiting",
+			event, meta.Namespace, meta.Name))
+	}
+}
+
+func post(d delivery) {
+	resp, err := client.Post(d.url, "application/json", bytes.NewReader(d.body))
+	if err != nil {
+		log.Info(fmt.Sprintf("Error talking to %s", d.url), "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Info(fmt.Sprintf(
+			"Warning: POST %s event of theia %s/%s to %s: %d",
+			d.event, d.namespace, d.name, d.url, resp.StatusCode))
+	}
+}
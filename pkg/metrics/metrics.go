@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"context"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	appsv1 "k8s.io/api/apps/v1"
@@ -17,6 +18,12 @@ type Metrics struct {
 	TheiaFailCreation     *prometheus.CounterVec
 	TheiaCullingCount     *prometheus.CounterVec
 	TheiaCullingTimestamp *prometheus.GaugeVec
+	TheiaRunningCount     *prometheus.GaugeVec
+	TheiaReadyLatency     *prometheus.HistogramVec
+
+	// running holds the namespace/name of the Theia accounted in TheiaRunningCount
+	mu      sync.Mutex
+	running map[string]bool
 }
 
 func NewMetrics(cli client.Client) *Metrics {
@@ -57,6 +64,23 @@ func NewMetrics(cli client.Client) *Metrics {
 			},
 			[]string{"namespace", "name"},
 		),
+		TheiaRunningCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "theia_running_instances",
+				Help: "Current Theia instances which aren't stopped",
+			},
+			[]string{"namespace"},
+		),
+		TheiaReadyLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "theia_ready_latency_seconds",
+				Help: "Time from the creation of a theia to its pod being ready in seconds",
+				// from 5 seconds to about 10 minutes
+				Buckets: prometheus.ExponentialBuckets(5, 2, 8),
+			},
+			[]string{"namespace"},
+		),
+		running: map[string]bool{},
 	}
 
 	metrics.Registry.MustRegister(m)
@@ -68,6 +92,8 @@ func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
 	m.runningTheias.Describe(ch)
 	m.TheiaCreation.Describe(ch)
 	m.TheiaFailCreation.Describe(ch)
+	m.TheiaRunningCount.Describe(ch)
+	m.TheiaReadyLatency.Describe(ch)
 }
 
 // Collect implements the prometheus.Collector interface.
@@ -76,6 +102,27 @@ func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
 	m.runningTheias.Collect(ch)
 	m.TheiaCreation.Collect(ch)
 	m.TheiaFailCreation.Collect(ch)
+	m.TheiaRunningCount.Collect(ch)
+	m.TheiaReadyLatency.Collect(ch)
+}
+
+// SetTheiaRunning records whether the Theia is running, i.e. its StatefulSet
+// has a replica. TheiaRunningCount only changes when the Theia starts or stops,
+// so that it can be called on every reconciliation.
+func (m *Metrics) SetTheiaRunning(namespace, name string, running bool) {
+	key := namespace + "/" + name
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running[key] == running {
+		return
+	}
+	if running {
+		m.running[key] = true
+		m.TheiaRunningCount.WithLabelValues(namespace).Inc()
+	} else {
+		delete(m.running, key)
+		m.TheiaRunningCount.WithLabelValues(namespace).Dec()
+	}
 }
 
 // scrape gets current running theia statefulsets.